@@ -0,0 +1,135 @@
+// Copyright 2017 Quentin Machu & eco authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package main implements a command that exports the auth state of a live etcd cluster as an init-acl config.
+package main
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
+
+	"github.com/quentin-m/etcd-cloud-operator/pkg/etcd"
+	"github.com/quentin-m/etcd-cloud-operator/pkg/logger"
+)
+
+const (
+	exportTimeout = 30 * time.Second
+
+	exportHeader = `# Generated by acl-export. Passwords can not be read from etcd: the users that authenticate with one keep it
+# when this config is adopted, and it is changed in place once filled in.
+`
+)
+
+func main() {
+	// Parse command-line arguments.
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	flagEndpoints := flag.String("endpoints", "127.0.0.1", "Comma-separated list of the addresses of the etcd members.")
+	flagCertFile := flag.String("cert-file", "", "Client certificate, whose common name must be a user with the root role.")
+	flagKeyFile := flag.String("key-file", "", "Client certificate's key.")
+	flagTrustedCAFile := flag.String("trusted-ca-file", "", "CA used to verify the members' certificates, which are not verified otherwise.")
+	flagExclude := flag.String("exclude", "root,etcd", "Comma-separated list of users and roles to leave out of the export.")
+	flagOutput := flag.String("output", "", "Write the config to the specified file rather than to the standard output.")
+	flagLogLevel := flag.String("log-level", "warn", "Define the logging level.")
+	flag.Parse()
+
+	// Initialize logging system, on the standard error as the config may be written to the standard output.
+	logger.ConfigureOutput(*flagLogLevel, "stderr")
+
+	sc := etcd.SecurityConfig{
+		CertFile:      *flagCertFile,
+		KeyFile:       *flagKeyFile,
+		TrustedCAFile: *flagTrustedCAFile,
+		VerifyServer:  *flagTrustedCAFile != "",
+	}
+	client, err := etcd.NewClient(strings.Split(*flagEndpoints, ","), sc, false)
+	if err != nil {
+		zap.S().With(zap.Error(err)).Fatal("failed to create etcd client")
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+	defer cancel()
+
+	state, err := client.AuthState(ctx)
+	if err != nil {
+		zap.S().With(zap.Error(err)).Fatal("failed to read the auth state")
+	}
+
+	b, err := yaml.Marshal(filterACL(state, strings.Split(*flagExclude, ",")))
+	if err != nil {
+		zap.S().With(zap.Error(err)).Fatal("failed to marshal the ACL config")
+	}
+	b = append([]byte(exportHeader), b...)
+
+	if *flagOutput == "" {
+		os.Stdout.Write(b)
+		return
+	}
+	if err := ioutil.WriteFile(*flagOutput, b, 0600); err != nil {
+		zap.S().With(zap.Error(err)).Fatal("failed to write the ACL config")
+	}
+}
+
+// filterACL leaves the excluded users and roles out of the given config, as well as the roles without permission,
+// which can not be declared in an init-acl config.
+func filterACL(state *etcd.ACLConfig, excluded []string) *etcd.ACLConfig {
+	isExcluded := func(name string) bool {
+		for _, e := range excluded {
+			if e == name {
+				return true
+			}
+		}
+		return false
+	}
+
+	config := &etcd.ACLConfig{}
+	exported := map[string]bool{"root": true}
+	for _, role := range state.Roles {
+		if isExcluded(role.Name) {
+			continue
+		}
+		if len(role.Permissions) == 0 {
+			zap.S().Warnf("role %q has no permission and can not be exported", role.Name)
+			continue
+		}
+		config.Roles = append(config.Roles, role)
+		exported[role.Name] = true
+	}
+
+	for _, user := range state.Users {
+		if isExcluded(user.Name) {
+			continue
+		}
+
+		roles := make([]string, 0, len(user.Roles))
+		for _, role := range user.Roles {
+			if !exported[role] {
+				zap.S().Warnf("role %q of user %q has not been exported and is left out", role, user.Name)
+				continue
+			}
+			roles = append(roles, role)
+		}
+		user.Roles = roles
+		config.Users = append(config.Users, user)
+	}
+
+	return config
+}
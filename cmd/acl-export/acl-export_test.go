@@ -0,0 +1,81 @@
+// Copyright 2017 Quentin Machu & eco authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/quentin-m/etcd-cloud-operator/pkg/etcd"
+)
+
+func TestFilterACL(t *testing.T) {
+	read := etcd.Permission{Mode: "read", Key: "/app/", Prefix: true}
+	app := etcd.Role{Name: "app", Permissions: []etcd.Permission{read}}
+	empty := etcd.Role{Name: "empty"}
+	etcdRole := etcd.Role{Name: "etcd", Permissions: []etcd.Permission{read}}
+
+	for _, tc := range []struct {
+		name      string
+		state     *etcd.ACLConfig
+		excluded  []string
+		wantRoles []etcd.Role
+		wantUsers []etcd.User
+	}{
+		{
+			name:      "nothing excluded",
+			state:     &etcd.ACLConfig{Roles: []etcd.Role{app}, Users: []etcd.User{{Name: "alice", Roles: []string{"app"}}}},
+			wantRoles: []etcd.Role{app},
+			wantUsers: []etcd.User{{Name: "alice", Roles: []string{"app"}}},
+		},
+		{
+			name: "excluded users and roles",
+			state: &etcd.ACLConfig{
+				Roles: []etcd.Role{app, etcdRole},
+				Users: []etcd.User{{Name: "root", Roles: []string{"root"}}, {Name: "alice", Roles: []string{"app", "etcd"}}},
+			},
+			excluded:  []string{"root", "etcd"},
+			wantRoles: []etcd.Role{app},
+			wantUsers: []etcd.User{{Name: "alice", Roles: []string{"app"}}},
+		},
+		{
+			name:      "role without permission",
+			state:     &etcd.ACLConfig{Roles: []etcd.Role{app, empty}, Users: []etcd.User{{Name: "alice", Roles: []string{"empty", "app"}}}},
+			wantRoles: []etcd.Role{app},
+			wantUsers: []etcd.User{{Name: "alice", Roles: []string{"app"}}},
+		},
+		{
+			name:      "root role kept on the exported users",
+			state:     &etcd.ACLConfig{Users: []etcd.User{{Name: "admin", Roles: []string{"root"}}}},
+			excluded:  []string{"root", "etcd"},
+			wantUsers: []etcd.User{{Name: "admin", Roles: []string{"root"}}},
+		},
+		{
+			name:      "user without role",
+			state:     &etcd.ACLConfig{Users: []etcd.User{{Name: "alice"}}},
+			wantUsers: []etcd.User{{Name: "alice", Roles: []string{}}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config := filterACL(tc.state, tc.excluded)
+			if !reflect.DeepEqual(config.Roles, tc.wantRoles) {
+				t.Errorf("got roles %+v, want %+v", config.Roles, tc.wantRoles)
+			}
+			if !reflect.DeepEqual(config.Users, tc.wantUsers) {
+				t.Errorf("got users %+v, want %+v", config.Users, tc.wantUsers)
+			}
+		})
+	}
+}
@@ -39,6 +39,7 @@ func defaultConfig() config {
 		ECO: operator.Config{
 			CheckInterval: 15 * time.Second,
 			UnhealthyMemberTTL: 2 * time.Minute,
+			CertificateExpiryWarning: 14 * 24 * time.Hour,
 			Etcd: etcd.EtcdConfiguration{
 				DataDir: "/var/lib/etcd",
 				PeerTransportSecurity: etcd.SecurityConfig{
@@ -52,6 +53,9 @@ func defaultConfig() config {
 				Interval: 30 * time.Minute,
 				TTL:      24 * time.Hour,
 			},
+			ACLAudit: operator.ACLAuditConfig{
+				Interval: 5 * time.Minute,
+			},
 		},
 	}
 }
@@ -87,6 +91,13 @@ func loadConfig(path string) (config, error) {
 		return config, err
 	}
 
+	err = config.ECO.Etcd.InitACL.ResolveSecrets()
+	if err != nil {
+		return config, err
+	}
+
+	config.ECO.Etcd.ApplyInternalCA()
+
 	zap.S().Infof("loaded configuration file %v", path)
 	return config, err
 }
@@ -26,7 +26,12 @@ import (
 
 	// Register providers.
 	_ "github.com/quentin-m/etcd-cloud-operator/pkg/providers/asg/aws"
+	_ "github.com/quentin-m/etcd-cloud-operator/pkg/providers/asg/azure"
+	_ "github.com/quentin-m/etcd-cloud-operator/pkg/providers/asg/dns"
 	_ "github.com/quentin-m/etcd-cloud-operator/pkg/providers/asg/docker"
+	_ "github.com/quentin-m/etcd-cloud-operator/pkg/providers/asg/gce"
+	_ "github.com/quentin-m/etcd-cloud-operator/pkg/providers/asg/kubernetes"
+	_ "github.com/quentin-m/etcd-cloud-operator/pkg/providers/asg/static"
 	_ "github.com/quentin-m/etcd-cloud-operator/pkg/providers/asg/sts"
 	_ "github.com/quentin-m/etcd-cloud-operator/pkg/providers/snapshot/file"
 	_ "github.com/quentin-m/etcd-cloud-operator/pkg/providers/snapshot/s3"
@@ -42,12 +47,22 @@ func main() {
 	// Initialize logging system.
 	logger.Configure(*flagLogLevel)
 
-	// Read configuration.
-	config, err := loadConfig(*flagConfigPath)
+	// Read configuration, the same way it is going to be reloaded upon SIGHUP.
+	loader := func() (operator.Config, error) {
+		config, err := loadConfig(*flagConfigPath)
+		if config.ECO.LogLevel == "" {
+			config.ECO.LogLevel = *flagLogLevel
+		}
+		return config.ECO, err
+	}
+	config, err := loader()
 	if err != nil {
 		zap.S().With(zap.Error(err)).Fatal("failed to load configuration")
 	}
+	if err := logger.SetLevel(config.LogLevel); err != nil {
+		zap.S().With(zap.Error(err)).Fatal("failed to set log level")
+	}
 
 	// Run.
-	operator.New(config.ECO).Run()
+	operator.New(config, loader).Run()
 }
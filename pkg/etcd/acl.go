@@ -0,0 +1,449 @@
+// Copyright 2017 Quentin Machu & eco authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.etcd.io/etcd/api/v3/authpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	"go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+// ACLDiff lists the changes required to converge etcd's auth state to a declared ACLConfig.
+//
+// UnknownPasswords lists the existing users that are declared without a password, and whose password is unknown
+// because they have been adopted rather than created from the config. It is not a change in itself, but must be
+// persisted along with the applied config, so that filling in their password later on changes it rather than being
+// taken for a certificate-only user switching to a password.
+type ACLDiff struct {
+	Roles            []RoleDiff `json:"roles,omitempty"`
+	Users            []UserDiff `json:"users,omitempty"`
+	UnknownPasswords []string   `json:"-"`
+}
+
+// RoleDiff lists the changes required on a single role.
+type RoleDiff struct {
+	Name   string       `json:"name"`
+	Create bool         `json:"create,omitempty"`
+	Delete bool         `json:"delete,omitempty"`
+	Grant  []Permission `json:"grant,omitempty"`
+	Revoke []Permission `json:"revoke,omitempty"`
+}
+
+// UserDiff lists the changes required on a single user.
+//
+// SwitchAuthentication is set when the user must switch between password and certificate-only authentication, which
+// etcd only allows by deleting and adding the user again. As its clients would lose access meanwhile, the switch is
+// refused: it is reported, and the user keeps its authentication method until it is deleted by hand.
+type UserDiff struct {
+	Name                 string   `json:"name"`
+	Create               bool     `json:"create,omitempty"`
+	SwitchAuthentication bool     `json:"switchAuthentication,omitempty"`
+	Delete               bool     `json:"delete,omitempty"`
+	ChangePassword       bool     `json:"changePassword,omitempty"`
+	GrantRoles           []string `json:"grantRoles,omitempty"`
+	RevokeRoles          []string `json:"revokeRoles,omitempty"`
+}
+
+// Empty returns whether the diff contains no change.
+func (d ACLDiff) Empty() bool {
+	return len(d.Roles) == 0 && len(d.Users) == 0
+}
+
+// RefusedSwitches lists the users whose authentication method is not switched, see UserDiff.SwitchAuthentication.
+func (d ACLDiff) RefusedSwitches() []string {
+	var users []string
+	for _, ud := range d.Users {
+		if ud.SwitchAuthentication {
+			users = append(users, ud.Name)
+		}
+	}
+	return users
+}
+
+// Range returns the key range covered by the permission, as expected by etcd.
+func (p Permission) Range() (key, rangeEnd string) {
+	if p.Prefix {
+		return p.Key, clientv3.GetPrefixRangeEnd(p.Key)
+	}
+	return p.Key, p.RangeEnd
+}
+
+// Type returns the etcd permission type corresponding to the permission's mode.
+func (p Permission) Type() (clientv3.PermissionType, error) {
+	switch strings.ToLower(p.Mode) {
+	case "read":
+		return clientv3.PermissionType(clientv3.PermRead), nil
+	case "write":
+		return clientv3.PermissionType(clientv3.PermWrite), nil
+	case "readwrite":
+		return clientv3.PermissionType(clientv3.PermReadWrite), nil
+	default:
+		return 0, fmt.Errorf("invalid permission mode %q", p.Mode)
+	}
+}
+
+// newPermission converts a permission read from etcd, using the prefix notation whenever it applies.
+func newPermission(perm *authpb.Permission) Permission {
+	p := Permission{
+		Mode: strings.ToLower(authpb.Permission_Type_name[int32(perm.PermType)]),
+		Key:  string(perm.Key),
+	}
+	if rangeEnd := string(perm.RangeEnd); rangeEnd != "" && rangeEnd == clientv3.GetPrefixRangeEnd(p.Key) {
+		p.Prefix = true
+	} else {
+		p.RangeEnd = rangeEnd
+	}
+	return p
+}
+
+// WithRequestTimeout runs the given etcd request with its own timeout, unless ctx expires first.
+func WithRequestTimeout(ctx context.Context, f func(context.Context) error) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultRequestTimeout)
+	defer cancel()
+	return f(ctx)
+}
+
+// AuthState reads the users and roles currently defined in etcd. Passwords can not be read back and are left empty.
+//
+// Each request has its own timeout, ctx bounds them all.
+func (c *Client) AuthState(ctx context.Context) (*ACLConfig, error) {
+	state := &ACLConfig{}
+
+	var roles *clientv3.AuthRoleListResponse
+	err := WithRequestTimeout(ctx, func(ctx context.Context) (err error) {
+		roles, err = c.RoleList(ctx)
+		return
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list roles: %v", err)
+	}
+	for _, name := range roles.Roles {
+		var resp *clientv3.AuthRoleGetResponse
+		err := WithRequestTimeout(ctx, func(ctx context.Context) (err error) {
+			resp, err = c.RoleGet(ctx, name)
+			return
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get role %q: %v", name, err)
+		}
+
+		role := Role{Name: name}
+		for _, perm := range resp.Perm {
+			role.Permissions = append(role.Permissions, newPermission(perm))
+		}
+		state.Roles = append(state.Roles, role)
+	}
+
+	var users *clientv3.AuthUserListResponse
+	err = WithRequestTimeout(ctx, func(ctx context.Context) (err error) {
+		users, err = c.UserList(ctx)
+		return
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list users: %v", err)
+	}
+	for _, name := range users.Users {
+		var resp *clientv3.AuthUserGetResponse
+		err := WithRequestTimeout(ctx, func(ctx context.Context) (err error) {
+			resp, err = c.UserGet(ctx, name)
+			return
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get user %q: %v", name, err)
+		}
+		state.Users = append(state.Users, User{Name: name, Roles: resp.Roles})
+	}
+
+	return state, nil
+}
+
+// DiffACL computes the changes required to converge the actual auth state to the desired config.
+//
+// Only the roles and users declared in the desired config are modified, except for those that were declared in the
+// previously applied config and have been removed since, which are deleted. Passwords can not be read from etcd,
+// therefore password changes are detected against the previously applied config if any, which may only hold their
+// hashes.
+func DiffACL(actual, previous, desired *ACLConfig) (ACLDiff, error) {
+	var diff ACLDiff
+	if actual == nil {
+		actual = &ACLConfig{}
+	}
+	if previous == nil {
+		previous = &ACLConfig{}
+	}
+	if desired == nil {
+		desired = &ACLConfig{}
+	}
+
+	for _, role := range desired.Roles {
+		rd := RoleDiff{Name: role.Name}
+
+		actualPerms := make(map[[2]string]clientv3.PermissionType)
+		actualRole := findRole(actual, role.Name)
+		if actualRole == nil {
+			rd.Create = true
+		} else {
+			for _, perm := range actualRole.Permissions {
+				t, err := perm.Type()
+				if err != nil {
+					return diff, err
+				}
+				key, rangeEnd := perm.Range()
+				actualPerms[[2]string{key, rangeEnd}] = t
+			}
+		}
+
+		desiredPerms := make(map[[2]string]struct{})
+		for _, perm := range role.Permissions {
+			t, err := perm.Type()
+			if err != nil {
+				return diff, err
+			}
+			key, rangeEnd := perm.Range()
+			desiredPerms[[2]string{key, rangeEnd}] = struct{}{}
+
+			// Granting a permission on an existing range overwrites its type, so it never has to be revoked first.
+			if at, ok := actualPerms[[2]string{key, rangeEnd}]; !ok || at != t {
+				rd.Grant = append(rd.Grant, perm)
+			}
+		}
+		if actualRole != nil {
+			for _, perm := range actualRole.Permissions {
+				key, rangeEnd := perm.Range()
+				if _, ok := desiredPerms[[2]string{key, rangeEnd}]; !ok {
+					rd.Revoke = append(rd.Revoke, perm)
+				}
+			}
+		}
+
+		if rd.Create || len(rd.Grant) > 0 || len(rd.Revoke) > 0 {
+			diff.Roles = append(diff.Roles, rd)
+		}
+	}
+	for _, role := range previous.Roles {
+		if role.Name != "root" && findRole(desired, role.Name) == nil && findRole(actual, role.Name) != nil {
+			diff.Roles = append(diff.Roles, RoleDiff{Name: role.Name, Delete: true})
+		}
+	}
+
+	for _, user := range desired.Users {
+		ud := UserDiff{Name: user.Name}
+
+		actualUser := findUser(actual, user.Name)
+		if actualUser == nil {
+			ud.Create = true
+			ud.GrantRoles = user.Roles
+			diff.Users = append(diff.Users, ud)
+			continue
+		}
+
+		previousUser := findUser(previous, user.Name)
+		if previousUser == nil || previousUser.Password.IsUnknown() {
+			// The user's password is unknown, make sure it matches.
+			ud.ChangePassword = user.Password.Value() != ""
+			if !ud.ChangePassword {
+				diff.UnknownPasswords = append(diff.UnknownPasswords, user.Name)
+			}
+		} else if previousUser.Password.IsEmpty() != (user.Password.Value() == "") {
+			ud.SwitchAuthentication = true
+		} else {
+			ud.ChangePassword = !user.Password.Matches(previousUser.Password)
+		}
+		ud.GrantRoles = missing(user.Roles, actualUser.Roles)
+		ud.RevokeRoles = missing(actualUser.Roles, user.Roles)
+
+		if ud.SwitchAuthentication || ud.ChangePassword || len(ud.GrantRoles) > 0 || len(ud.RevokeRoles) > 0 {
+			diff.Users = append(diff.Users, ud)
+		}
+	}
+	for _, user := range previous.Users {
+		if findUser(desired, user.Name) == nil && findUser(actual, user.Name) != nil {
+			diff.Users = append(diff.Users, UserDiff{Name: user.Name, Delete: true})
+		}
+	}
+
+	return diff, nil
+}
+
+// ApplyACLDiff applies the given diff, computed against the desired config.
+//
+// Grants are applied before revocations and deletions, so that clients never lose a permission that they are meant
+// to keep while the changes are being applied. Each request has its own timeout, ctx bounds them all.
+func (c *Client) ApplyACLDiff(ctx context.Context, diff ACLDiff, desired *ACLConfig) error {
+	for _, rd := range diff.Roles {
+		if rd.Create {
+			zap.S().Infof("adding role %q", rd.Name)
+			err := WithRequestTimeout(ctx, func(ctx context.Context) error {
+				_, err := c.RoleAdd(ctx, rd.Name)
+				return err
+			})
+			if err != nil && err != rpctypes.ErrRoleAlreadyExist {
+				return fmt.Errorf("failed to add role %q: %v", rd.Name, err)
+			}
+		}
+		for _, perm := range rd.Grant {
+			t, err := perm.Type()
+			if err != nil {
+				return err
+			}
+			key, rangeEnd := perm.Range()
+
+			zap.S().Infof("granting %s permission on [%q, %q) to role %q", perm.Mode, key, rangeEnd, rd.Name)
+			err = WithRequestTimeout(ctx, func(ctx context.Context) error {
+				_, err := c.RoleGrantPermission(ctx, rd.Name, key, rangeEnd, t)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("failed to grant permission to role %q: %v", rd.Name, err)
+			}
+		}
+	}
+
+	for _, ud := range diff.Users {
+		user := findUser(desired, ud.Name)
+
+		switch {
+		case ud.Create:
+			zap.S().Infof("adding user %q", ud.Name)
+			if err := c.addUser(ctx, user); err != nil {
+				return err
+			}
+		case ud.SwitchAuthentication:
+			zap.S().Errorf("refusing to switch the authentication method of user %q, which etcd only allows by re-creating it: delete it by hand to have it re-created", ud.Name)
+		case ud.ChangePassword:
+			zap.S().Infof("changing password of user %q", ud.Name)
+			err := WithRequestTimeout(ctx, func(ctx context.Context) error {
+				_, err := c.UserChangePassword(ctx, ud.Name, user.Password.Value())
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("failed to change password of user %q: %v", ud.Name, err)
+			}
+		}
+
+		for _, role := range ud.GrantRoles {
+			zap.S().Infof("granting role %q to user %q", role, ud.Name)
+			err := WithRequestTimeout(ctx, func(ctx context.Context) error {
+				_, err := c.UserGrantRole(ctx, ud.Name, role)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("failed to grant role %q to user %q: %v", role, ud.Name, err)
+			}
+		}
+	}
+
+	for _, ud := range diff.Users {
+		for _, role := range ud.RevokeRoles {
+			zap.S().Infof("revoking role %q from user %q", role, ud.Name)
+			err := WithRequestTimeout(ctx, func(ctx context.Context) error {
+				_, err := c.UserRevokeRole(ctx, ud.Name, role)
+				return err
+			})
+			if err != nil && err != rpctypes.ErrRoleNotGranted {
+				return fmt.Errorf("failed to revoke role %q from user %q: %v", role, ud.Name, err)
+			}
+		}
+		if ud.Delete {
+			zap.S().Infof("deleting user %q", ud.Name)
+			err := WithRequestTimeout(ctx, func(ctx context.Context) error {
+				_, err := c.UserDelete(ctx, ud.Name)
+				return err
+			})
+			if err != nil && err != rpctypes.ErrUserNotFound {
+				return fmt.Errorf("failed to delete user %q: %v", ud.Name, err)
+			}
+		}
+	}
+
+	for _, rd := range diff.Roles {
+		for _, perm := range rd.Revoke {
+			key, rangeEnd := perm.Range()
+
+			zap.S().Infof("revoking permission on [%q, %q) from role %q", key, rangeEnd, rd.Name)
+			err := WithRequestTimeout(ctx, func(ctx context.Context) error {
+				_, err := c.RoleRevokePermission(ctx, rd.Name, key, rangeEnd)
+				return err
+			})
+			if err != nil && err != rpctypes.ErrPermissionNotGranted {
+				return fmt.Errorf("failed to revoke permission from role %q: %v", rd.Name, err)
+			}
+		}
+		if rd.Delete {
+			zap.S().Infof("deleting role %q", rd.Name)
+			err := WithRequestTimeout(ctx, func(ctx context.Context) error {
+				_, err := c.RoleDelete(ctx, rd.Name)
+				return err
+			})
+			if err != nil && err != rpctypes.ErrRoleNotFound {
+				return fmt.Errorf("failed to delete role %q: %v", rd.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *Client) addUser(ctx context.Context, user *User) error {
+	opt := &clientv3.UserAddOptions{NoPassword: user.Password.Value() == ""}
+	err := WithRequestTimeout(ctx, func(ctx context.Context) error {
+		_, err := c.UserAddWithOptions(ctx, user.Name, user.Password.Value(), opt)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add user %q: %v", user.Name, err)
+	}
+	return nil
+}
+
+func findRole(config *ACLConfig, name string) *Role {
+	for i := range config.Roles {
+		if config.Roles[i].Name == name {
+			return &config.Roles[i]
+		}
+	}
+	return nil
+}
+
+func findUser(config *ACLConfig, name string) *User {
+	for i := range config.Users {
+		if config.Users[i].Name == name {
+			return &config.Users[i]
+		}
+	}
+	return nil
+}
+
+// missing returns the values of a that are not in b.
+func missing(a, b []string) (m []string) {
+	for _, v := range a {
+		found := false
+		for _, w := range b {
+			if v == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			m = append(m, v)
+		}
+	}
+	return m
+}
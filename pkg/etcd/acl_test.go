@@ -0,0 +1,261 @@
+// Copyright 2017 Quentin Machu & eco authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcd
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func fingerprint(t *testing.T, config *ACLConfig) *ACLConfig {
+	t.Helper()
+	f, err := config.Fingerprint()
+	if err != nil {
+		t.Fatalf("failed to fingerprint config: %v", err)
+	}
+	return f
+}
+
+func TestDiffACLRoles(t *testing.T) {
+	read := Permission{Mode: "read", Key: "/app/", Prefix: true}
+	write := Permission{Mode: "write", Key: "/app/", Prefix: true}
+	readRange := Permission{Mode: "read", Key: "/a", RangeEnd: "/b"}
+	readOther := Permission{Mode: "read", Key: "/other"}
+
+	for _, tc := range []struct {
+		name                      string
+		actual, previous, desired *ACLConfig
+		want                      ACLDiff
+	}{
+		{
+			name:    "missing role",
+			desired: &ACLConfig{Roles: []Role{{Name: "app", Permissions: []Permission{read}}}},
+			want:    ACLDiff{Roles: []RoleDiff{{Name: "app", Create: true, Grant: []Permission{read}}}},
+		},
+		{
+			name:    "identical role",
+			actual:  &ACLConfig{Roles: []Role{{Name: "app", Permissions: []Permission{read, readRange}}}},
+			desired: &ACLConfig{Roles: []Role{{Name: "app", Permissions: []Permission{readRange, read}}}},
+		},
+		{
+			name:    "prefix given as a range end",
+			actual:  &ACLConfig{Roles: []Role{{Name: "app", Permissions: []Permission{read}}}},
+			desired: &ACLConfig{Roles: []Role{{Name: "app", Permissions: []Permission{{Mode: "READ", Key: "/app/", RangeEnd: "/app0"}}}}},
+		},
+		{
+			name:    "missing, changed and extra permissions",
+			actual:  &ACLConfig{Roles: []Role{{Name: "app", Permissions: []Permission{read, readOther}}}},
+			desired: &ACLConfig{Roles: []Role{{Name: "app", Permissions: []Permission{write, readRange}}}},
+			want: ACLDiff{Roles: []RoleDiff{{
+				Name:   "app",
+				Grant:  []Permission{write, readRange},
+				Revoke: []Permission{readOther},
+			}}},
+		},
+		{
+			name:     "removed roles",
+			actual:   &ACLConfig{Roles: []Role{{Name: "root"}, {Name: "old"}, {Name: "gone"}, {Name: "unmanaged"}}},
+			previous: &ACLConfig{Roles: []Role{{Name: "root"}, {Name: "old"}, {Name: "already-deleted"}}},
+			desired:  &ACLConfig{},
+			want:     ACLDiff{Roles: []RoleDiff{{Name: "old", Delete: true}}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			diff, err := DiffACL(tc.actual, tc.previous, tc.desired)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(diff, tc.want) {
+				t.Errorf("got diff %+v, want %+v", diff, tc.want)
+			}
+		})
+	}
+}
+
+func TestDiffACLInvalidPermission(t *testing.T) {
+	desired := &ACLConfig{Roles: []Role{{Name: "app", Permissions: []Permission{{Mode: "admin", Key: "/"}}}}}
+	if _, err := DiffACL(nil, nil, desired); err == nil {
+		t.Error("expected an error for an invalid permission mode")
+	}
+}
+
+func TestDiffACLUsers(t *testing.T) {
+	withPassword := func(name, password string, roles ...string) User {
+		return User{Name: name, Password: NewSecret(password), Roles: roles}
+	}
+	certOnly := func(name string, roles ...string) User {
+		return User{Name: name, Roles: roles}
+	}
+
+	for _, tc := range []struct {
+		name                      string
+		actual, previous, desired []User
+		want                      []UserDiff
+	}{
+		{
+			name:    "missing user",
+			desired: []User{withPassword("alice", "a", "app")},
+			want:    []UserDiff{{Name: "alice", Create: true, GrantRoles: []string{"app"}}},
+		},
+		{
+			name:     "unchanged user",
+			actual:   []User{certOnly("alice", "app")},
+			previous: []User{withPassword("alice", "a", "app")},
+			desired:  []User{withPassword("alice", "a", "app")},
+		},
+		{
+			name:     "changed password",
+			actual:   []User{certOnly("alice", "app")},
+			previous: []User{withPassword("alice", "a", "app")},
+			desired:  []User{withPassword("alice", "b", "app")},
+			want:     []UserDiff{{Name: "alice", ChangePassword: true}},
+		},
+		{
+			name:    "unknown password",
+			actual:  []User{certOnly("alice", "app")},
+			desired: []User{withPassword("alice", "a", "app")},
+			want:    []UserDiff{{Name: "alice", ChangePassword: true}},
+		},
+		{
+			name:    "unknown certificate-only user",
+			actual:  []User{certOnly("alice", "app")},
+			desired: []User{certOnly("alice", "app")},
+		},
+		{
+			name:     "password removed",
+			actual:   []User{certOnly("alice", "app", "old")},
+			previous: []User{withPassword("alice", "a", "app")},
+			desired:  []User{certOnly("alice", "app")},
+			want:     []UserDiff{{Name: "alice", SwitchAuthentication: true, RevokeRoles: []string{"old"}}},
+		},
+		{
+			name:     "password added to a certificate-only user",
+			actual:   []User{certOnly("alice", "app")},
+			previous: []User{certOnly("alice", "app")},
+			desired:  []User{withPassword("alice", "a", "app")},
+			want:     []UserDiff{{Name: "alice", SwitchAuthentication: true}},
+		},
+		{
+			name:     "granted and revoked roles",
+			actual:   []User{certOnly("alice", "app", "old")},
+			previous: []User{certOnly("alice", "app", "old")},
+			desired:  []User{certOnly("alice", "app", "new")},
+			want:     []UserDiff{{Name: "alice", GrantRoles: []string{"new"}, RevokeRoles: []string{"old"}}},
+		},
+		{
+			name:     "removed users",
+			actual:   []User{certOnly("old"), certOnly("unmanaged")},
+			previous: []User{certOnly("old"), certOnly("already-deleted")},
+			want:     []UserDiff{{Name: "old", Delete: true}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			previous := fingerprint(t, &ACLConfig{Users: tc.previous})
+			diff, err := DiffACL(&ACLConfig{Users: tc.actual}, previous, &ACLConfig{Users: tc.desired})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(diff.Users, tc.want) {
+				t.Errorf("got diff %+v, want %+v", diff.Users, tc.want)
+			}
+		})
+	}
+}
+
+func TestDiffACLAdoptedPasswords(t *testing.T) {
+	// The auth state, as exported by acl-export: passwords can not be read from etcd.
+	actual := &ACLConfig{
+		Roles: []Role{{Name: "app", Permissions: []Permission{{Mode: "read", Key: "/app/", Prefix: true}}}},
+		Users: []User{{Name: "alice", Roles: []string{"app"}}, {Name: "bob", Roles: []string{"app"}}},
+	}
+	exported, err := yaml.Marshal(actual)
+	if err != nil {
+		t.Fatalf("failed to marshal config: %v", err)
+	}
+	var adopted ACLConfig
+	if err := yaml.Unmarshal(exported, &adopted); err != nil {
+		t.Fatalf("failed to unmarshal config: %v", err)
+	}
+
+	// Adopting the config changes nothing, but the passwords are recorded as unknown.
+	diff, err := DiffACL(actual, nil, &adopted)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !diff.Empty() {
+		t.Errorf("got diff %+v when adopting, want none", diff)
+	}
+	if want := []string{"alice", "bob"}; !reflect.DeepEqual(diff.UnknownPasswords, want) {
+		t.Errorf("got unknown passwords %v, want %v", diff.UnknownPasswords, want)
+	}
+
+	// The applied config is persisted and read back.
+	previous := fingerprint(t, &adopted)
+	previous.MarkUnknownPasswords(diff.UnknownPasswords)
+	b, err := yaml.Marshal(previous)
+	if err != nil {
+		t.Fatalf("failed to marshal config: %v", err)
+	}
+	previous = &ACLConfig{}
+	if err := yaml.Unmarshal(b, previous); err != nil {
+		t.Fatalf("failed to unmarshal config: %v", err)
+	}
+	if !adopted.Matches(previous) {
+		t.Error("adopted config does not match the persisted one")
+	}
+
+	// Filling in a password changes it in place, rather than re-creating the user.
+	filled := adopted
+	filled.Users = append([]User(nil), adopted.Users...)
+	filled.Users[0].Password = NewSecret("a")
+	diff, err = DiffACL(actual, previous, &filled)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := []UserDiff{{Name: "alice", ChangePassword: true}}; !reflect.DeepEqual(diff.Users, want) {
+		t.Errorf("got diff %+v after filling in a password, want %+v", diff.Users, want)
+	}
+	if want := []string{"bob"}; !reflect.DeepEqual(diff.UnknownPasswords, want) {
+		t.Errorf("got unknown passwords %v, want %v", diff.UnknownPasswords, want)
+	}
+
+	// Once applied, the password is known, and removing it would switch the user to certificate-only authentication.
+	previous = fingerprint(t, &filled)
+	previous.MarkUnknownPasswords(diff.UnknownPasswords)
+	diff, err = DiffACL(actual, previous, &adopted)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := []UserDiff{{Name: "alice", SwitchAuthentication: true}}; !reflect.DeepEqual(diff.Users, want) {
+		t.Errorf("got diff %+v after removing a password, want %+v", diff.Users, want)
+	}
+
+	// The switch is refused, hence the user keeps its password in the persisted config, and it is reported again.
+	if want := []string{"alice"}; !reflect.DeepEqual(diff.RefusedSwitches(), want) {
+		t.Errorf("got refused switches %v, want %v", diff.RefusedSwitches(), want)
+	}
+	stored := fingerprint(t, &adopted)
+	stored.MarkUnknownPasswords(diff.UnknownPasswords)
+	stored.KeepPasswords(previous, diff.RefusedSwitches())
+	diff, err = DiffACL(actual, stored, &adopted)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := []UserDiff{{Name: "alice", SwitchAuthentication: true}}; !reflect.DeepEqual(diff.Users, want) {
+		t.Errorf("got diff %+v once the switch was refused, want %+v", diff.Users, want)
+	}
+}
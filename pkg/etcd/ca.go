@@ -0,0 +1,297 @@
+// Copyright 2017 Quentin Machu & eco authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcd
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"path/filepath"
+	"time"
+)
+
+const (
+	defaultInternalCADir         = "/var/lib/eco/pki"
+	defaultInternalCACommonName  = "etcd-cloud-operator"
+	defaultInternalCAValidity    = 90 * 24 * time.Hour
+	defaultInternalCARenewBefore = 30 * 24 * time.Hour
+
+	internalCAValidity = 10 * 365 * 24 * time.Hour
+
+	InternalCAStoreFile     = "file"
+	InternalCAStoreSnapshot = "snapshot"
+)
+
+// InternalCAConfig configures the certificate authority run by the operator, which issues to every instance a client
+// and a peer certificate matching its address, so that the connections to the members can be fully verified.
+type InternalCAConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	// Store is where the CA's certificate and key are kept: "file" (default), at CertFile and KeyFile, which must be
+	// shared by all instances, or "snapshot", next to the snapshots, if the snapshot provider supports it.
+	Store    string `yaml:"store"`
+	CertFile string `yaml:"cert-file"`
+	KeyFile  string `yaml:"key-file"`
+
+	// Dir is the local directory where the issued certificates are written.
+	Dir string `yaml:"dir"`
+
+	// ClientCommonName is the common name of the issued client certificates, which is also the etcd user the
+	// operator authenticates as.
+	ClientCommonName string `yaml:"client-common-name"`
+
+	// Validity is the lifetime of the issued certificates, which are renewed RenewBefore they expire.
+	Validity    time.Duration `yaml:"validity"`
+	RenewBefore time.Duration `yaml:"renew-before"`
+
+	// ExtraClientCAFile is the trusted CA file originally configured for the clients, bundled with the internal CA.
+	ExtraClientCAFile string `yaml:"-"`
+}
+
+// Paths of the files written in the directory of the issued certificates.
+func (c *InternalCAConfig) CAFile() string         { return filepath.Join(c.Dir, "ca.crt") }
+func (c *InternalCAConfig) ClientCAFile() string   { return filepath.Join(c.Dir, "client-ca.crt") }
+func (c *InternalCAConfig) ServerCertFile() string { return filepath.Join(c.Dir, "server.crt") }
+func (c *InternalCAConfig) ServerKeyFile() string  { return filepath.Join(c.Dir, "server.key") }
+func (c *InternalCAConfig) PeerCertFile() string   { return filepath.Join(c.Dir, "peer.crt") }
+func (c *InternalCAConfig) PeerKeyFile() string    { return filepath.Join(c.Dir, "peer.key") }
+
+// ApplyInternalCA fills the defaults of the internal CA config, and points the client and peer transport securities to
+// the certificates it issues. Any trusted CA file configured for the clients is kept, bundled with the internal CA.
+func (c *EtcdConfiguration) ApplyInternalCA() {
+	ca := c.InternalCA
+	if ca == nil || !ca.Enabled {
+		return
+	}
+
+	if ca.Store == "" {
+		ca.Store = InternalCAStoreFile
+	}
+	if ca.Dir == "" {
+		ca.Dir = defaultInternalCADir
+	}
+	if ca.ClientCommonName == "" {
+		ca.ClientCommonName = defaultInternalCACommonName
+	}
+	if ca.Validity == 0 {
+		ca.Validity = defaultInternalCAValidity
+	}
+	if ca.RenewBefore == 0 {
+		ca.RenewBefore = defaultInternalCARenewBefore
+		if ca.RenewBefore >= ca.Validity {
+			ca.RenewBefore = ca.Validity / 3
+		}
+	}
+
+	c.ClientTransportSecurity.CertFile = ca.ServerCertFile()
+	c.ClientTransportSecurity.KeyFile = ca.ServerKeyFile()
+	c.ClientTransportSecurity.AutoTLS = false
+	c.ClientTransportSecurity.VerifyServer = true
+	if tca := c.ClientTransportSecurity.TrustedCAFile; tca != "" && tca != ca.ClientCAFile() {
+		ca.ExtraClientCAFile = tca
+	}
+	if ca.ExtraClientCAFile != "" {
+		c.ClientTransportSecurity.TrustedCAFile = ca.ClientCAFile()
+	} else {
+		c.ClientTransportSecurity.TrustedCAFile = ca.CAFile()
+	}
+
+	c.PeerTransportSecurity = SecurityConfig{
+		CertFile:      ca.PeerCertFile(),
+		KeyFile:       ca.PeerKeyFile(),
+		CertAuth:      true,
+		TrustedCAFile: ca.CAFile(),
+		VerifyServer:  true,
+	}
+}
+
+// CA is a certificate authority.
+type CA struct {
+	Cert    *x509.Certificate
+	CertPEM []byte
+	key     crypto.Signer
+}
+
+// NewCA creates a self-signed certificate authority, and returns it along with its PEM-encoded key.
+func NewCA(commonName string) (*CA, []byte, error) {
+	key, keyPEM, err := generateKey()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName + " CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(internalCAValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create CA certificate: %v", err)
+	}
+
+	ca, err := ParseCA(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), keyPEM)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ca, keyPEM, nil
+}
+
+// ParseCA reads a certificate authority from its PEM-encoded certificate and key.
+func ParseCA(certPEM, keyPEM []byte) (*CA, error) {
+	cert, err := parseCertificate(certPEM)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CA certificate: %v", err)
+	}
+	if !cert.IsCA {
+		return nil, errors.New("the CA certificate is not a certificate authority")
+	}
+
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("failed to decode CA key")
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CA key: %v", err)
+	}
+
+	return &CA{Cert: cert, CertPEM: certPEM, key: key}, nil
+}
+
+// Issue creates a certificate for the given common name and hosts, usable by both servers and clients, and returns it
+// along with its key, PEM-encoded.
+func (ca *CA) Issue(commonName string, hosts []string, validity time.Duration) ([]byte, []byte, error) {
+	key, keyPEM, err := generateKey()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if template.NotAfter.After(ca.Cert.NotAfter) {
+		template.NotAfter = ca.Cert.NotAfter
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if host != "" {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Cert, key.Public(), ca.key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create certificate: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), keyPEM, nil
+}
+
+// NeedsRenewal returns why the given PEM-encoded certificate must be re-issued: because it is not signed by the CA, does
+// not match all the hosts or the common name, or expires within renewBefore. It returns "" if it is still suitable.
+func (ca *CA) NeedsRenewal(certPEM []byte, commonName string, hosts []string, renewBefore time.Duration) string {
+	cert, err := parseCertificate(certPEM)
+	if err != nil {
+		return "it can not be parsed"
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	if _, err := cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}); err != nil {
+		return "it is not signed by the CA"
+	}
+	if cert.Subject.CommonName != commonName {
+		return "its common name changed"
+	}
+	for _, host := range hosts {
+		if host != "" && cert.VerifyHostname(host) != nil {
+			return fmt.Sprintf("it does not match %q", host)
+		}
+	}
+	if time.Until(cert.NotAfter) < renewBefore {
+		return fmt.Sprintf("it expires on %v", cert.NotAfter.Format(time.RFC3339))
+	}
+	return ""
+}
+
+// Bundle returns the CA certificate appended to the given PEM-encoded certificates.
+func (ca *CA) Bundle(certsPEM []byte) []byte {
+	var b bytes.Buffer
+	b.Write(bytes.TrimRight(certsPEM, "\n"))
+	if b.Len() > 0 {
+		b.WriteByte('\n')
+	}
+	b.Write(ca.CertPEM)
+	return b.Bytes()
+}
+
+func parseCertificate(certPEM []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("failed to decode certificate")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func generateKey() (crypto.Signer, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate key: %v", err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal key: %v", err)
+	}
+	return key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+func newSerialNumber() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %v", err)
+	}
+	return serial, nil
+}
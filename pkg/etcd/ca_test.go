@@ -0,0 +1,200 @@
+// Copyright 2017 Quentin Machu & eco authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcd
+
+import (
+	"bytes"
+	"crypto/x509"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestCA(t *testing.T) *CA {
+	t.Helper()
+	ca, keyPEM, err := NewCA("eco")
+	if err != nil {
+		t.Fatalf("failed to create CA: %v", err)
+	}
+	parsed, err := ParseCA(ca.CertPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("failed to parse CA: %v", err)
+	}
+	return parsed
+}
+
+func TestIssue(t *testing.T) {
+	ca := newTestCA(t)
+
+	certPEM, keyPEM, err := ca.Issue("eco", []string{"10.0.0.1", "localhost", ""}, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to issue certificate: %v", err)
+	}
+	if len(keyPEM) == 0 {
+		t.Error("got an empty key")
+	}
+
+	cert, err := parseCertificate(certPEM)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	if cert.Subject.CommonName != "eco" {
+		t.Errorf("got common name %q, want eco", cert.Subject.CommonName)
+	}
+	if len(cert.IPAddresses) != 1 || !cert.IPAddresses[0].Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("got IP SANs %v, want [10.0.0.1]", cert.IPAddresses)
+	}
+	if len(cert.DNSNames) != 1 || cert.DNSNames[0] != "localhost" {
+		t.Errorf("got DNS SANs %v, want [localhost]", cert.DNSNames)
+	}
+	if d := time.Until(cert.NotAfter); d > time.Hour || d < 59*time.Minute {
+		t.Errorf("got certificate expiring in %v, want 1h", d)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	for _, usage := range []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth} {
+		if _, err := cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{usage}}); err != nil {
+			t.Errorf("certificate can not be verified for usage %v: %v", usage, err)
+		}
+	}
+
+	// The issued certificates never outlive the CA.
+	certPEM, _, err = ca.Issue("eco", nil, 2*internalCAValidity)
+	if err != nil {
+		t.Fatalf("failed to issue certificate: %v", err)
+	}
+	if cert, _ := parseCertificate(certPEM); cert == nil || cert.NotAfter.After(ca.Cert.NotAfter) {
+		t.Error("certificate outlives the CA")
+	}
+}
+
+func TestNeedsRenewal(t *testing.T) {
+	ca := newTestCA(t)
+	hosts := []string{"10.0.0.1", "localhost"}
+
+	certPEM, _, err := ca.Issue("eco", hosts, 48*time.Hour)
+	if err != nil {
+		t.Fatalf("failed to issue certificate: %v", err)
+	}
+	otherCertPEM, _, err := newTestCA(t).Issue("eco", hosts, 48*time.Hour)
+	if err != nil {
+		t.Fatalf("failed to issue certificate: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name        string
+		certPEM     []byte
+		commonName  string
+		hosts       []string
+		renewBefore time.Duration
+		want        string
+	}{
+		{name: "valid", certPEM: certPEM, commonName: "eco", hosts: hosts, renewBefore: 24 * time.Hour},
+		{name: "subset of the hosts", certPEM: certPEM, commonName: "eco", hosts: []string{"localhost", ""}, renewBefore: 24 * time.Hour},
+		{name: "invalid", certPEM: []byte("garbage"), commonName: "eco", hosts: hosts, want: "it can not be parsed"},
+		{name: "other CA", certPEM: otherCertPEM, commonName: "eco", hosts: hosts, want: "it is not signed by the CA"},
+		{name: "common name", certPEM: certPEM, commonName: "other", hosts: hosts, want: "its common name changed"},
+		{name: "new IP", certPEM: certPEM, commonName: "eco", hosts: []string{"10.0.0.2"}, want: `it does not match "10.0.0.2"`},
+		{name: "new name", certPEM: certPEM, commonName: "eco", hosts: []string{"etcd.example.com"}, want: `it does not match "etcd.example.com"`},
+		{name: "expiring", certPEM: certPEM, commonName: "eco", hosts: hosts, renewBefore: 72 * time.Hour, want: "it expires on "},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := ca.NeedsRenewal(tc.certPEM, tc.commonName, tc.hosts, tc.renewBefore)
+			if (tc.want == "") != (got == "") || !strings.HasPrefix(got, tc.want) {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestBundle(t *testing.T) {
+	ca := newTestCA(t)
+
+	if got := ca.Bundle(nil); !bytes.Equal(got, ca.CertPEM) {
+		t.Errorf("got bundle %q, want the CA certificate alone", got)
+	}
+	if got, want := ca.Bundle([]byte("extra\n\n")), append([]byte("extra\n"), ca.CertPEM...); !bytes.Equal(got, want) {
+		t.Errorf("got bundle %q, want %q", got, want)
+	}
+}
+
+func TestApplyInternalCA(t *testing.T) {
+	t.Run("disabled", func(t *testing.T) {
+		c := &EtcdConfiguration{InternalCA: &InternalCAConfig{}, ClientTransportSecurity: SecurityConfig{AutoTLS: true}}
+		c.ApplyInternalCA()
+		if !c.ClientTransportSecurity.AutoTLS || c.InternalCA.Dir != "" {
+			t.Error("disabled internal CA has been applied")
+		}
+	})
+
+	t.Run("defaults", func(t *testing.T) {
+		c := &EtcdConfiguration{InternalCA: &InternalCAConfig{Enabled: true}, ClientTransportSecurity: SecurityConfig{AutoTLS: true}}
+		c.ApplyInternalCA()
+
+		ca := c.InternalCA
+		if ca.Store != InternalCAStoreFile || ca.Dir != defaultInternalCADir || ca.ClientCommonName != defaultInternalCACommonName ||
+			ca.Validity != defaultInternalCAValidity || ca.RenewBefore != defaultInternalCARenewBefore {
+			t.Errorf("got config %+v, want the defaults", ca)
+		}
+
+		want := SecurityConfig{
+			CertFile:      ca.ServerCertFile(),
+			KeyFile:       ca.ServerKeyFile(),
+			TrustedCAFile: ca.CAFile(),
+			VerifyServer:  true,
+		}
+		if c.ClientTransportSecurity != want {
+			t.Errorf("got client transport security %+v, want %+v", c.ClientTransportSecurity, want)
+		}
+		want = SecurityConfig{
+			CertFile:      ca.PeerCertFile(),
+			KeyFile:       ca.PeerKeyFile(),
+			CertAuth:      true,
+			TrustedCAFile: ca.CAFile(),
+			VerifyServer:  true,
+		}
+		if c.PeerTransportSecurity != want {
+			t.Errorf("got peer transport security %+v, want %+v", c.PeerTransportSecurity, want)
+		}
+	})
+
+	t.Run("short validity", func(t *testing.T) {
+		c := &EtcdConfiguration{InternalCA: &InternalCAConfig{Enabled: true, Validity: 24 * time.Hour}}
+		c.ApplyInternalCA()
+		if c.InternalCA.RenewBefore != 8*time.Hour {
+			t.Errorf("got renew-before %v, want 8h", c.InternalCA.RenewBefore)
+		}
+	})
+
+	t.Run("extra client CA", func(t *testing.T) {
+		c := &EtcdConfiguration{
+			InternalCA:              &InternalCAConfig{Enabled: true, Dir: "/pki"},
+			ClientTransportSecurity: SecurityConfig{TrustedCAFile: "/etc/clients-ca.crt"},
+		}
+
+		// Applying the config again, as on a reload, keeps the original trusted CA file.
+		c.ApplyInternalCA()
+		c.ApplyInternalCA()
+
+		if c.InternalCA.ExtraClientCAFile != "/etc/clients-ca.crt" {
+			t.Errorf("got extra client CA file %q, want /etc/clients-ca.crt", c.InternalCA.ExtraClientCAFile)
+		}
+		if got := c.ClientTransportSecurity.TrustedCAFile; got != "/pki/client-ca.crt" {
+			t.Errorf("got trusted CA file %q, want /pki/client-ca.crt", got)
+		}
+	})
+}
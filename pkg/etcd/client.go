@@ -33,6 +33,24 @@ import (
 	"github.com/quentin-m/etcd-cloud-operator/pkg/logger"
 )
 
+// MemberStatus describes the health and progress of a single etcd member.
+type MemberStatus struct {
+	id uint64
+
+	ID               string   `json:"id"`
+	Name             string   `json:"name"`
+	PeerURLs         []string `json:"peerURLs"`
+	ClientURLs       []string `json:"clientURLs"`
+	IsLearner        bool     `json:"isLearner"`
+	IsLeader         bool     `json:"isLeader"`
+	Healthy          bool     `json:"healthy"`
+	Revision         int64    `json:"revision"`
+	RaftIndex        uint64   `json:"raftIndex"`
+	RaftAppliedIndex uint64   `json:"raftAppliedIndex"`
+	DBSize           int64    `json:"dbSize"`
+	Error            string   `json:"error,omitempty"`
+}
+
 type Client struct {
 	*clientv3.Client
 
@@ -101,7 +119,14 @@ func (c *Client) ForEachMember(f func(*Client, *etcdserverpb.Member) error) erro
 	errChan := make(chan string, len(members))
 	for _, member := range members {
 		go func(member *etcdserverpb.Member) {
-			client, err := NewClient([]string{URL2Address(member.PeerURLs[0])}, c.SC, false)
+			// Members that have not started yet can not be reached.
+			endpoint := MemberEndpoint(member.PeerURLs, member.ClientURLs)
+			if endpoint == "" {
+				errChan <- ""
+				return
+			}
+
+			client, err := NewClient([]string{endpoint}, c.SC, false)
 			if err != nil {
 				errChan <- fmt.Sprintf("[%s]: %s", member.Name, err)
 				return
@@ -129,6 +154,15 @@ func (c *Client) ForEachMember(f func(*Client, *etcdserverpb.Member) error) erro
 }
 
 func (c *Client) AddMember(name string, pURLs []string) (uint64, func(), error) {
+	return c.addMember(name, pURLs, false)
+}
+
+// AddLearner adds a non-voting member to the cluster, which must later be promoted with PromoteLearner.
+func (c *Client) AddLearner(name string, pURLs []string) (uint64, func(), error) {
+	return c.addMember(name, pURLs, true)
+}
+
+func (c *Client) addMember(name string, pURLs []string, asLearner bool) (uint64, func(), error) {
 	unlock, err := c.Lock("/eco/"+name+"/join", defaultRequestTimeout)
 	if err != nil {
 		return 0, nil, err
@@ -137,7 +171,12 @@ func (c *Client) AddMember(name string, pURLs []string) (uint64, func(), error)
 	ctx, cancel := context.WithTimeout(context.Background(), defaultRequestTimeout)
 	defer cancel()
 
-	resp, err := c.MemberAdd(ctx, pURLs)
+	var resp *clientv3.MemberAddResponse
+	if asLearner {
+		resp, err = c.MemberAddAsLearner(ctx, pURLs)
+	} else {
+		resp, err = c.MemberAdd(ctx, pURLs)
+	}
 	if err != nil {
 		unlock()
 		return 0, nil, err
@@ -146,6 +185,74 @@ func (c *Client) AddMember(name string, pURLs []string) (uint64, func(), error)
 	return resp.Member.ID, unlock, nil
 }
 
+// PromoteLearner waits for the learner member reachable at the given address to catch up with the leader, and
+// promotes it to a voting member.
+func (c *Client) PromoteLearner(id uint64, address string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	t := time.NewTicker(defaultLearnerPollInterval)
+	defer t.Stop()
+
+	for {
+		caughtUp, err := c.learnerCaughtUp(ctx, address)
+		if err != nil {
+			zap.S().With(zap.Error(err)).Debug("failed to determine learner progress")
+		}
+		if caughtUp {
+			reqCtx, reqCancel := context.WithTimeout(ctx, defaultRequestTimeout)
+			_, err := c.MemberPromote(reqCtx, id)
+			reqCancel()
+
+			if err == nil || err == rpctypes.ErrMemberNotLearner {
+				return nil
+			}
+			if err != rpctypes.ErrMemberLearnerNotReady {
+				zap.S().With(zap.Error(err)).Warn("failed to promote learner")
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("learner has not caught up with the leader within %v", timeout)
+		case <-t.C:
+		}
+	}
+}
+
+// learnerCaughtUp determines whether the learner reachable at the given address has applied the leader's log, within
+// defaultLearnerMaxLag entries.
+func (c *Client) learnerCaughtUp(ctx context.Context, address string) (bool, error) {
+	reqCtx, cancel := context.WithTimeout(ctx, defaultRequestTimeout)
+	defer cancel()
+
+	learnerStatus, err := c.Status(reqCtx, ClientURL(address, c.SC.TLSEnabled()))
+	if err != nil {
+		return false, fmt.Errorf("failed to get learner status: %v", err)
+	}
+
+	members, err := c.MemberList(reqCtx)
+	if err != nil {
+		return false, fmt.Errorf("failed to list members: %v", err)
+	}
+	for _, member := range members.Members {
+		if member.ID != learnerStatus.Leader || len(member.PeerURLs) == 0 {
+			continue
+		}
+
+		endpoint := MemberEndpoint(member.PeerURLs, member.ClientURLs)
+		if endpoint == "" {
+			return false, errors.New("leader has no client URL")
+		}
+		leaderStatus, err := c.Status(reqCtx, ClientURL(endpoint, c.SC.TLSEnabled()))
+		if err != nil {
+			return false, fmt.Errorf("failed to get leader status: %v", err)
+		}
+		return learnerStatus.RaftAppliedIndex+defaultLearnerMaxLag >= leaderStatus.RaftIndex, nil
+	}
+	return false, errors.New("leader not found")
+}
+
 func (c *Client) RemoveMember(name string, id uint64) error {
 	unlock, err := c.Lock("/eco/"+name+"/join", defaultRequestTimeout)
 	if err != nil {
@@ -153,10 +260,15 @@ func (c *Client) RemoveMember(name string, id uint64) error {
 	}
 	defer unlock()
 
+	return c.removeMember(id)
+}
+
+// removeMember removes a member without acquiring its join lock, for callers that already hold it.
+func (c *Client) removeMember(id uint64) error {
 	ctx, cancel := context.WithTimeout(context.Background(), defaultRequestTimeout)
 	defer cancel()
 
-	_, err = c.MemberRemove(ctx, id)
+	_, err := c.MemberRemove(ctx, id)
 	if err != nil && err != rpctypes.ErrMemberNotFound {
 		return err
 	}
@@ -256,7 +368,7 @@ func (c *Client) GetRevisionsHashes() (map[string]int64, map[string]int64, error
 	defer cancel()
 
 	f := func(c *Client, m *etcdserverpb.Member) error {
-		cURL := ClientURL(URL2Address(m.PeerURLs[0]), c.SC.TLSEnabled())
+		cURL := ClientURL(MemberEndpoint(m.PeerURLs, m.ClientURLs), c.SC.TLSEnabled())
 
 		s, err := c.Status(ctx, cURL)
 		if err != nil {
@@ -279,6 +391,72 @@ func (c *Client) GetRevisionsHashes() (map[string]int64, map[string]int64, error
 	return revs, hashes, c.ForEachMember(f)
 }
 
+// MembersStatus returns the status of every member of the cluster, as reported by the members themselves.
+//
+// Members that can not be reached are still listed, but are reported unhealthy, with the encountered error.
+func (c *Client) MembersStatus() ([]*MemberStatus, error) {
+	members, err := c.Members()
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]*MemberStatus, len(members))
+	var wg sync.WaitGroup
+	wg.Add(len(members))
+	for i, member := range members {
+		statuses[i] = &MemberStatus{
+			id:         member.ID,
+			ID:         fmt.Sprintf("%x", member.ID),
+			Name:       member.Name,
+			PeerURLs:   member.PeerURLs,
+			ClientURLs: member.ClientURLs,
+			IsLearner:  member.IsLearner,
+		}
+
+		go func(st *MemberStatus, member *etcdserverpb.Member) {
+			defer wg.Done()
+
+			if len(member.PeerURLs) == 0 {
+				st.Error = "member has no peer URL"
+				return
+			}
+			address := MemberEndpoint(member.PeerURLs, member.ClientURLs)
+			if address == "" {
+				st.Error = "member has not started yet"
+				return
+			}
+
+			client, err := NewClient([]string{address}, c.SC, false)
+			if err != nil {
+				st.Error = err.Error()
+				return
+			}
+			defer client.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), defaultRequestTimeout)
+			defer cancel()
+
+			s, err := client.Status(ctx, ClientURL(address, c.SC.TLSEnabled()))
+			if err != nil {
+				st.Error = err.Error()
+				return
+			}
+			st.Healthy = len(s.Errors) == 0
+			st.IsLeader = s.Leader == member.ID
+			st.Revision = s.Header.Revision
+			st.RaftIndex = s.RaftIndex
+			st.RaftAppliedIndex = s.RaftAppliedIndex
+			st.DBSize = s.DbSize
+			if len(s.Errors) > 0 {
+				st.Error = strings.Join(s.Errors, ", ")
+			}
+		}(statuses[i], member)
+	}
+	wg.Wait()
+
+	return statuses, nil
+}
+
 func (c *Client) Cleanup() error {
 	// Get the current revision of the cluster.
 	rev, err := c.GetHighestRevision()
@@ -300,7 +478,7 @@ func (c *Client) Cleanup() error {
 		mu.Lock()
 		defer mu.Unlock()
 
-		if _, err := c.Defragment(ctx, ClientURL(URL2Address(m.PeerURLs[0]), c.SC.TLSEnabled())); err != nil {
+		if _, err := c.Defragment(ctx, ClientURL(MemberEndpoint(m.PeerURLs, m.ClientURLs), c.SC.TLSEnabled())); err != nil {
 			return fmt.Errorf("failed to defragment: %v", err)
 		}
 		return nil
@@ -0,0 +1,141 @@
+// Copyright 2017 Quentin Machu & eco authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcd
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	promNamespace = "eco"
+
+	promResultSuccess = "success"
+	promResultSkipped = "skipped"
+	promResultFailure = "failure"
+)
+
+var (
+	promRegisterOnce sync.Once
+
+	promSnapshotsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: promNamespace,
+			Name:      "snapshots_total",
+			Help:      "Number of snapshots attempted, by provider and result (success, skipped, failure)",
+		},
+		[]string{"provider", "result"},
+	)
+	promSnapshotDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: promNamespace,
+			Name:      "snapshot_duration_seconds",
+			Help:      "Time taken to take and upload a snapshot",
+			Buckets:   prometheus.ExponentialBuckets(0.1, 2, 14),
+		},
+		[]string{"provider"},
+	)
+	promSnapshotSize = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: promNamespace,
+			Name:      "snapshot_size_bytes",
+			Help:      "Size of the last successfully uploaded snapshot",
+		},
+		[]string{"provider"},
+	)
+	promSnapshotRevision = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: promNamespace,
+			Name:      "snapshot_revision",
+			Help:      "Revision of the last successfully uploaded snapshot",
+		},
+		[]string{"provider"},
+	)
+	promSnapshotLastSuccess = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: promNamespace,
+			Name:      "snapshot_last_success_timestamp_seconds",
+			Help:      "Unix timestamp of the last successfully uploaded snapshot",
+		},
+		[]string{"provider"},
+	)
+	promSnapshotsPurgedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: promNamespace,
+			Name:      "snapshots_purged_total",
+			Help:      "Number of snapshots purged because they exceeded the snapshot TTL",
+		},
+		[]string{"provider"},
+	)
+	promSnapshotPurgeFailuresTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: promNamespace,
+			Name:      "snapshot_purge_failures_total",
+			Help:      "Number of times purging old snapshots failed",
+		},
+		[]string{"provider"},
+	)
+
+	promLearnerPromotionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: promNamespace,
+			Name:      "learner_promotions_total",
+			Help:      "Number of attempts to promote the local learner to a voting member, by result (success, failure)",
+		},
+		[]string{"result"},
+	)
+	promLearnerPromotionDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: promNamespace,
+			Name:      "learner_promotion_duration_seconds",
+			Help:      "Time taken by the local learner to catch up with the leader and be promoted",
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+		},
+	)
+
+	promLeadershipTransfersTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: promNamespace,
+			Name:      "leadership_transfers_total",
+			Help:      "Number of leadership transfers attempted before stopping, by result (success, skipped, failure)",
+		},
+		[]string{"result"},
+	)
+)
+
+func promRegister() {
+	promRegisterOnce.Do(func() {
+		prometheus.MustRegister(promSnapshotsTotal)
+		prometheus.MustRegister(promSnapshotDuration)
+		prometheus.MustRegister(promSnapshotSize)
+		prometheus.MustRegister(promSnapshotRevision)
+		prometheus.MustRegister(promSnapshotLastSuccess)
+		prometheus.MustRegister(promSnapshotsPurgedTotal)
+		prometheus.MustRegister(promSnapshotPurgeFailuresTotal)
+		prometheus.MustRegister(promLearnerPromotionsTotal)
+		prometheus.MustRegister(promLearnerPromotionDuration)
+		prometheus.MustRegister(promLeadershipTransfersTotal)
+	})
+}
+
+func promSnapshotSaved(provider string, revision, size int64, t time.Time) {
+	promSnapshotsTotal.WithLabelValues(provider, promResultSuccess).Inc()
+	promSnapshotDuration.WithLabelValues(provider).Observe(time.Since(t).Seconds())
+	promSnapshotSize.WithLabelValues(provider).Set(float64(size))
+	promSnapshotRevision.WithLabelValues(provider).Set(float64(revision))
+	promSnapshotLastSuccess.WithLabelValues(provider).SetToCurrentTime()
+}
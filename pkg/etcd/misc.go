@@ -17,6 +17,7 @@ package etcd
 import (
 	"crypto/tls"
 	"fmt"
+	"net"
 	"net/url"
 	"reflect"
 	"strconv"
@@ -28,13 +29,16 @@ import (
 )
 
 const (
-	defaultClientPort  = 2379
-	defaultPeerPort    = 2380
-	defaultMetricsPort = 2381
+	DefaultClientPort  = 2379
+	DefaultPeerPort    = 2380
+	DefaultMetricsPort = 2381
 
 	defaultDialTimeout    = 5 * time.Second
 	defaultRequestTimeout = 5 * time.Second
 	defaultAutoSync       = 1 * time.Second
+
+	defaultLearnerPollInterval = 1 * time.Second
+	defaultLearnerMaxLag       = 1000
 )
 
 // EtcdConfiguration contains the configuration related to the underlying etcd
@@ -48,8 +52,10 @@ type EtcdConfiguration struct {
 	AutoCompactionMode      string              `yaml:"auto-compaction-mode"`
 	AutoCompactionRetention string              `yaml:"auto-compaction-retention"`
 	InitACL                 *ACLConfig          `yaml:"init-acl,omitempty"`
+	InternalCA              *InternalCAConfig   `yaml:"internal-ca,omitempty"`
 	JWTAuthTokenConfig      *JWTAuthTokenConfig `yaml:"jwt-auth-token-config,omitempty"`
 	MaxRequestBytes         uint                `yaml:"max-request-bytes,omitempty"`
+	LearnerPromotionTimeout time.Duration       `yaml:"learner-promotion-timeout,omitempty"`
 }
 
 type SecurityConfig struct {
@@ -58,13 +64,17 @@ type SecurityConfig struct {
 	CertAuth      bool   `yaml:"client-cert-auth"`
 	TrustedCAFile string `yaml:"trusted-ca-file"`
 	AutoTLS       bool   `yaml:"auto-tls"`
+
+	// VerifyServer makes the clients verify that the certificates presented by the servers match their addresses,
+	// which requires certificates issued for every instance, such as the ones of the internal CA.
+	VerifyServer bool `yaml:"verify-server"`
 }
 
 // ACLConfig defines the acl configuration for etcd,
 // which will be applied to the etcd during provisioning.
 // --client-cert-auth must be set to true.
 type ACLConfig struct {
-	RootPassword *string `yaml:"rootPassword,omitempty"`
+	RootPassword *Secret `yaml:"rootPassword,omitempty"`
 	Roles        []Role  `yaml:"roles"`
 	Users        []User  `yaml:"users"`
 }
@@ -86,16 +96,16 @@ type Role struct {
 // Users defines an etcd ACL user with its password(optional) and binding roles.
 type User struct {
 	Name     string   `yaml:"name"`
-	Password string   `yaml:"password"`
+	Password *Secret  `yaml:"password,omitempty"`
 	Roles    []string `yaml:"roles"`
 }
 
 // Permission defines the permission.
 type Permission struct {
-	Mode     string `yaml:"mode"`
-	Key      string `yaml:"key"`
-	RangeEnd string `yaml:"rangeEnd"`
-	Prefix   bool   `yaml:"prefix"`
+	Mode     string `yaml:"mode" json:"mode"`
+	Key      string `yaml:"key" json:"key"`
+	RangeEnd string `yaml:"rangeEnd" json:"rangeEnd,omitempty"`
+	Prefix   bool   `yaml:"prefix" json:"prefix,omitempty"`
 }
 
 func (sc SecurityConfig) TLSInfo() transport.TLSInfo {
@@ -112,13 +122,13 @@ func (sc SecurityConfig) ClientConfig() (*tls.Config, error) {
 	// it is inconvenient (at best) to generate certificates that will match the
 	// instances. Therefore, we also use InsecureSkipVerify and make the
 	// assumption that the instances present in the auto-scaling group can be
-	// trusted.
+	// trusted, unless the certificates are known to match (VerifyServer).
 	if !sc.TLSInfo().Empty() {
 		tc, err := sc.TLSInfo().ClientConfig()
 		if err != nil {
 			return nil, err
 		}
-		tc.InsecureSkipVerify = true
+		tc.InsecureSkipVerify = !sc.VerifyServer
 		return tc, nil
 	}
 	return &tls.Config{InsecureSkipVerify: true}, nil
@@ -135,24 +145,55 @@ func ClientsURLs(addresses []string, tlsEnabled bool) (cURLs []string) {
 	return
 }
 
+// ClientURL returns the URL of the client endpoint at the given address, which is either a host:port, or a host that
+// serves its clients on the default port.
 func ClientURL(address string, tlsEnabled bool) string {
-	return fmt.Sprintf("%s://%s:%d", scheme(tlsEnabled), address, defaultClientPort)
+	return fmt.Sprintf("%s://%s", scheme(tlsEnabled), withDefaultPort(address, DefaultClientPort))
 }
 
-func peerURL(address string, tlsEnabled bool) string {
-	return fmt.Sprintf("%s://%s:%d", scheme(tlsEnabled), address, defaultPeerPort)
+func peerURL(address string, port int, tlsEnabled bool) string {
+	return fmt.Sprintf("%s://%s", scheme(tlsEnabled), JoinHostPort(address, port))
 }
 
+// URL2Address returns the host of the given URL, without port nor brackets around IPv6 addresses.
 func URL2Address(pURL string) string {
-	pURLu, _ := url.Parse(pURL)
-	if i := strings.Index(pURLu.Host, ":"); i > 0 {
-		return pURLu.Host[:i]
+	pURLu, err := url.Parse(pURL)
+	if err != nil {
+		return ""
+	}
+	return pURLu.Hostname()
+}
+
+// MemberEndpoint returns the host:port at which a member serves its clients. The host is taken from its peer URL, as
+// its client URL may advertise a load balancer, and the port from its client URL. Members that have not started yet
+// have no client URL, and the port they will serve on is unknown: an empty string is returned for them, as well as for
+// the members without peer URL.
+func MemberEndpoint(peerURLs, clientURLs []string) string {
+	if len(peerURLs) == 0 || len(clientURLs) == 0 {
+		return ""
+	}
+	port := strconv.Itoa(DefaultClientPort)
+	if u, err := url.Parse(clientURLs[0]); err == nil && u.Port() != "" {
+		port = u.Port()
+	}
+	return net.JoinHostPort(URL2Address(peerURLs[0]), port)
+}
+
+// JoinHostPort combines the host, which may be an IPv6 address, with or without brackets, and the port.
+func JoinHostPort(host string, port int) string {
+	return net.JoinHostPort(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"), strconv.Itoa(port))
+}
+
+// withDefaultPort returns the given address as a host:port, using the default port if it has none.
+func withDefaultPort(address string, port int) string {
+	if host, p, err := net.SplitHostPort(address); err == nil {
+		return net.JoinHostPort(host, p)
 	}
-	return pURLu.Host
+	return JoinHostPort(address, port)
 }
 
-func metricsURLs(address string) []url.URL {
-	u, _ := url.Parse(fmt.Sprintf("http://%s:%d", address, defaultMetricsPort))
+func metricsURLs(address string, port int) []url.URL {
+	u, _ := url.Parse(fmt.Sprintf("http://%s", JoinHostPort(address, port)))
 	return []url.URL{*u}
 }
 
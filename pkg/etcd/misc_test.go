@@ -0,0 +1,61 @@
+// Copyright 2017 Quentin Machu & eco authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcd
+
+import "testing"
+
+func TestMemberEndpoint(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		peerURLs   []string
+		clientURLs []string
+		expected   string
+	}{
+		{
+			name:       "started",
+			peerURLs:   []string{"https://10.0.0.1:2380"},
+			clientURLs: []string{"https://10.0.0.1:12379"},
+			expected:   "10.0.0.1:12379",
+		},
+		{
+			name:       "client url advertising a load balancer",
+			peerURLs:   []string{"https://10.0.0.1:2380"},
+			clientURLs: []string{"https://etcd.example.com:12379"},
+			expected:   "10.0.0.1:12379",
+		},
+		{
+			name:       "ipv6",
+			peerURLs:   []string{"https://[fd00::1]:2380"},
+			clientURLs: []string{"https://[fd00::1]:12379"},
+			expected:   "[fd00::1]:12379",
+		},
+		{
+			name:     "not started yet",
+			peerURLs: []string{"https://10.0.0.1:2380"},
+			expected: "",
+		},
+		{
+			name:       "no peer url",
+			clientURLs: []string{"https://10.0.0.1:12379"},
+			expected:   "",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := MemberEndpoint(tc.peerURLs, tc.clientURLs); got != tc.expected {
+				t.Errorf("got %q, want %q", got, tc.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,305 @@
+// Copyright 2017 Quentin Machu & eco authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcd
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+)
+
+const defaultSecretExecTimeout = 10 * time.Second
+
+// Secret is a sensitive value, such as a password. In the configuration, it is either given inline as a plain string,
+// or as a reference to a file, an environment variable, or a command printing it on its standard output:
+//
+//   password: foo
+//   password: {file: /etc/eco/secrets/foo}
+//   password: {env: FOO_PASSWORD}
+//   password: {exec: [vault, kv, get, -field=password, secret/etcd/foo]}
+//
+// References are resolved with Resolve. When persisted with Fingerprint, only a bcrypt hash of the value is kept,
+// which is enough to detect changes. As bcrypt ignores anything past 72 bytes, the value is hashed with SHA-256 first. Unknown marks the persisted passwords of the users that were adopted without
+// one, and that therefore may or may not authenticate with a password in etcd.
+type Secret struct {
+	File    string   `yaml:"file,omitempty"`
+	Env     string   `yaml:"env,omitempty"`
+	Exec    []string `yaml:"exec,omitempty"`
+	Hash    string   `yaml:"hash,omitempty"`
+	Unknown bool     `yaml:"unknown,omitempty"`
+
+	value string
+}
+
+type secretReference struct {
+	File    string   `yaml:"file,omitempty"`
+	Env     string   `yaml:"env,omitempty"`
+	Exec    []string `yaml:"exec,omitempty"`
+	Hash    string   `yaml:"hash,omitempty"`
+	Unknown bool     `yaml:"unknown,omitempty"`
+}
+
+// NewSecret returns a secret holding the given value.
+func NewSecret(value string) *Secret {
+	return &Secret{value: value}
+}
+
+func (s *Secret) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value string
+	if err := unmarshal(&value); err == nil {
+		*s = Secret{value: value}
+		return nil
+	}
+
+	var ref secretReference
+	if err := unmarshal(&ref); err != nil {
+		return err
+	}
+	*s = Secret{File: ref.File, Env: ref.Env, Exec: ref.Exec, Hash: ref.Hash, Unknown: ref.Unknown}
+	return nil
+}
+
+func (s Secret) MarshalYAML() (interface{}, error) {
+	if !s.isReference() && s.Hash == "" && !s.Unknown {
+		return s.value, nil
+	}
+	return secretReference{File: s.File, Env: s.Env, Exec: s.Exec, Hash: s.Hash, Unknown: s.Unknown}, nil
+}
+
+func (s *Secret) isReference() bool {
+	return s.File != "" || s.Env != "" || len(s.Exec) > 0
+}
+
+// Value returns the value of the secret, which must have been resolved if it is a reference.
+func (s *Secret) Value() string {
+	if s == nil {
+		return ""
+	}
+	return s.value
+}
+
+// IsEmpty returns whether the secret holds neither a value nor a hash.
+func (s *Secret) IsEmpty() bool {
+	return s == nil || (s.value == "" && s.Hash == "")
+}
+
+// IsUnknown returns whether the secret is the persisted password of a user that was adopted without one.
+func (s *Secret) IsUnknown() bool {
+	return s != nil && s.Unknown
+}
+
+// IsPlaintext returns whether the secret holds a value that is not a reference.
+func (s *Secret) IsPlaintext() bool {
+	return s != nil && !s.isReference() && s.value != ""
+}
+
+// Resolve reads the value of the secret if it is a reference.
+func (s *Secret) Resolve() error {
+	if s == nil {
+		return nil
+	}
+
+	var n int
+	for _, set := range []bool{s.File != "", s.Env != "", len(s.Exec) > 0} {
+		if set {
+			n++
+		}
+	}
+	switch {
+	case n == 0:
+		return nil
+	case n > 1:
+		return errors.New("a secret can only reference one of file, env or exec")
+	case s.File != "":
+		b, err := ioutil.ReadFile(s.File)
+		if err != nil {
+			return fmt.Errorf("failed to read secret file: %v", err)
+		}
+		s.value = strings.TrimRight(string(b), "\r\n")
+	case s.Env != "":
+		v, ok := os.LookupEnv(s.Env)
+		if !ok {
+			return fmt.Errorf("secret environment variable %q is not set", s.Env)
+		}
+		s.value = v
+	default:
+		ctx, cancel := context.WithTimeout(context.Background(), defaultSecretExecTimeout)
+		defer cancel()
+
+		out, err := exec.CommandContext(ctx, s.Exec[0], s.Exec[1:]...).Output()
+		if err != nil {
+			return fmt.Errorf("failed to execute secret command %q: %v", s.Exec[0], err)
+		}
+		s.value = strings.TrimRight(string(out), "\r\n")
+	}
+	return nil
+}
+
+// Matches returns whether the secret holds the same value as the given one, which may only hold a hash.
+func (s *Secret) Matches(o *Secret) bool {
+	if o != nil && o.Hash != "" {
+		return s.Value() != "" && bcrypt.CompareHashAndPassword([]byte(o.Hash), prehash(s.Value())) == nil
+	}
+	return s.Value() == o.Value()
+}
+
+// Fingerprint returns a copy of the secret that only keeps its references and a hash of its value.
+func (s *Secret) Fingerprint() (*Secret, error) {
+	if s == nil {
+		return nil, nil
+	}
+
+	f := &Secret{File: s.File, Env: s.Env, Exec: s.Exec}
+	if s.value != "" {
+		hash, err := bcrypt.GenerateFromPassword(prehash(s.value), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+		f.Hash = string(hash)
+	}
+	return f, nil
+}
+
+// prehash reduces the given value to the 44 bytes of its base64-encoded SHA-256 digest, which bcrypt takes in full.
+func prehash(value string) []byte {
+	sum := sha256.Sum256([]byte(value))
+	return []byte(base64.StdEncoding.EncodeToString(sum[:]))
+}
+
+// ResolveSecrets resolves the root and users' passwords that are given as references.
+func (a *ACLConfig) ResolveSecrets() error {
+	if a == nil {
+		return nil
+	}
+
+	if err := a.RootPassword.Resolve(); err != nil {
+		return fmt.Errorf("failed to resolve root password: %v", err)
+	}
+	for i := range a.Users {
+		if err := a.Users[i].Password.Resolve(); err != nil {
+			return fmt.Errorf("failed to resolve password of user %q: %v", a.Users[i].Name, err)
+		}
+	}
+	return nil
+}
+
+// Fingerprint returns a copy of the config that only keeps hashes of the passwords, suitable to be persisted.
+func (a *ACLConfig) Fingerprint() (*ACLConfig, error) {
+	f := *a
+	f.Users = make([]User, len(a.Users))
+
+	var err error
+	if f.RootPassword, err = a.RootPassword.Fingerprint(); err != nil {
+		return nil, err
+	}
+	for i, user := range a.Users {
+		f.Users[i] = user
+		if f.Users[i].Password, err = user.Password.Fingerprint(); err != nil {
+			return nil, err
+		}
+	}
+	return &f, nil
+}
+
+// MarkUnknownPasswords marks the passwords of the given users as unknown, see ACLDiff.UnknownPasswords.
+func (a *ACLConfig) MarkUnknownPasswords(users []string) {
+	for _, name := range users {
+		for i := range a.Users {
+			if a.Users[i].Name != name {
+				continue
+			}
+			if a.Users[i].Password == nil {
+				a.Users[i].Password = &Secret{}
+			}
+			a.Users[i].Password.Unknown = true
+		}
+	}
+}
+
+// KeepPasswords replaces the passwords of the given users by their previous ones, so that the changes of password that
+// have not been applied are still detected against the persisted config, see UserDiff.SwitchAuthentication.
+func (a *ACLConfig) KeepPasswords(previous *ACLConfig, users []string) {
+	for _, name := range users {
+		previousUser := findUser(previous, name)
+		if previousUser == nil {
+			continue
+		}
+		for i := range a.Users {
+			if a.Users[i].Name == name {
+				a.Users[i].Password = previousUser.Password
+			}
+		}
+	}
+}
+
+// HasPlaintext returns whether any of the passwords of the config is held in plaintext.
+func (a *ACLConfig) HasPlaintext() bool {
+	if a == nil {
+		return false
+	}
+	if a.RootPassword.IsPlaintext() {
+		return true
+	}
+	for _, user := range a.Users {
+		if user.Password.IsPlaintext() {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches returns whether the config is identical to the given one, which may only hold hashes of the passwords.
+func (a *ACLConfig) Matches(b *ACLConfig) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if !a.RootPassword.Matches(b.RootPassword) || len(a.Users) != len(b.Users) {
+		return false
+	}
+	for i := range a.Users {
+		if !a.Users[i].Password.Matches(b.Users[i].Password) {
+			return false
+		}
+	}
+
+	// Compare everything but the passwords, in their serialized form as the config may have been read from YAML.
+	ac, bc := *a, *b
+	ac.RootPassword, bc.RootPassword = nil, nil
+	ac.Users, bc.Users = withoutPasswords(a.Users), withoutPasswords(b.Users)
+
+	ay, aErr := yaml.Marshal(&ac)
+	by, bErr := yaml.Marshal(&bc)
+	return aErr == nil && bErr == nil && bytes.Equal(ay, by)
+}
+
+func withoutPasswords(users []User) []User {
+	stripped := make([]User, len(users))
+	for i, user := range users {
+		stripped[i] = user
+		stripped[i].Password = nil
+	}
+	return stripped
+}
@@ -0,0 +1,51 @@
+// Copyright 2017 Quentin Machu & eco authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSecretFingerprint(t *testing.T) {
+	// Tokens printed by secret commands are often longer than the 72 bytes bcrypt takes into account.
+	long := strings.Repeat("a", 100)
+
+	for _, tc := range []struct {
+		name     string
+		value    string
+		other    string
+		expected bool
+	}{
+		{name: "same", value: "foo", other: "foo", expected: true},
+		{name: "different", value: "foo", other: "bar", expected: false},
+		{name: "long, same", value: long, other: long, expected: true},
+		{name: "long, different past 72 bytes", value: long, other: long[:99] + "b", expected: false},
+		{name: "long, truncated", value: long, other: long[:72], expected: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := (&Secret{value: tc.value}).Fingerprint()
+			if err != nil {
+				t.Fatalf("failed to fingerprint secret: %v", err)
+			}
+			if f.Value() != "" || f.Hash == "" {
+				t.Fatalf("got fingerprint %+v, want a hash only", f)
+			}
+			if got := (&Secret{value: tc.other}).Matches(f); got != tc.expected {
+				t.Errorf("got match %v, want %v", got, tc.expected)
+			}
+		})
+	}
+}
@@ -20,6 +20,8 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.etcd.io/etcd/client/pkg/v3/transport"
@@ -39,12 +41,22 @@ const (
 	defaultStartTimeout          = 1800 * time.Second
 	defaultStartRejoinTimeout    = 300 * time.Second
 	defaultMemberCleanerInterval = 15 * time.Second
+	defaultDefragmentTimeout     = 300 * time.Second
+	defaultPromotionTimeout      = 600 * time.Second
+	defaultTransferTimeout       = 30 * time.Second
+	defaultTransferPollInterval  = 500 * time.Millisecond
 )
 
 type Server struct {
 	server    *embed.Etcd
 	isRunning bool
 	cfg       ServerConfig
+
+	// paused prevents the member cleaner from removing members, accessed atomically.
+	paused int32
+
+	// mu guards the settings of cfg that can be changed with Reconfigure.
+	mu sync.RWMutex
 }
 
 type ServerConfig struct {
@@ -54,17 +66,22 @@ type ServerConfig struct {
 	BindAddress             string
 	PublicAddress           string
 	PrivateAddress          string
+	ClientPort              int
+	PeerPort                int
+	MetricsPort             int
 	ClientSC                SecurityConfig
 	PeerSC                  SecurityConfig
 	UnhealthyMemberTTL      time.Duration
 	AutoCompactionMode      string
 	AutoCompactionRetention string
 	MaxRequestBytes         uint
+	LearnerPromotionTimeout time.Duration
 
 	// Optional, used in {Seed, Join} to periodically save snapshots.
-	SnapshotProvider snapshot.Provider
-	SnapshotInterval time.Duration
-	SnapshotTTL      time.Duration
+	SnapshotProvider     snapshot.Provider
+	SnapshotProviderName string
+	SnapshotInterval     time.Duration
+	SnapshotTTL          time.Duration
 
 	// Internal, used in startServer.
 	clusterState string
@@ -75,6 +92,18 @@ type ServerConfig struct {
 }
 
 func NewServer(cfg ServerConfig) *Server {
+	promRegister()
+
+	if cfg.ClientPort == 0 {
+		cfg.ClientPort = DefaultClientPort
+	}
+	if cfg.PeerPort == 0 {
+		cfg.PeerPort = DefaultPeerPort
+	}
+	if cfg.MetricsPort == 0 {
+		cfg.MetricsPort = DefaultMetricsPort
+	}
+
 	return &Server{
 		cfg: cfg,
 	}
@@ -95,7 +124,7 @@ func (c *Server) Seed(snapshot *snapshot.Metadata) error {
 
 	// Set the internal configuration.
 	c.cfg.clusterState = embed.ClusterStateFlagNew
-	c.cfg.initialPURLs = map[string]string{c.cfg.Name: peerURL(c.cfg.PrivateAddress, c.cfg.PeerSC.TLSEnabled())}
+	c.cfg.initialPURLs = map[string]string{c.cfg.Name: peerURL(c.cfg.PrivateAddress, c.cfg.PeerPort, c.cfg.PeerSC.TLSEnabled())}
 
 	// Start the server.
 	ctx, cancel := context.WithTimeout(context.Background(), defaultStartTimeout)
@@ -114,7 +143,7 @@ func (c *Server) Join(cluster *Client) error {
 	}
 
 	// Set the internal configuration.
-	c.cfg.initialPURLs = map[string]string{c.cfg.Name: peerURL(c.cfg.PrivateAddress, c.cfg.PeerSC.TLSEnabled())}
+	c.cfg.initialPURLs = map[string]string{c.cfg.Name: peerURL(c.cfg.PrivateAddress, c.cfg.PeerPort, c.cfg.PeerSC.TLSEnabled())}
 	for _, member := range members.Members {
 		if member.Name == "" {
 			continue
@@ -125,9 +154,10 @@ func (c *Server) Join(cluster *Client) error {
 
 	// Check if we are listed as a member, and save the member ID if so.
 	var memberID uint64
+	var isLearner bool
 	for _, member := range members.Members {
 		if c.cfg.Name == member.Name {
-			memberID = member.ID
+			memberID, isLearner = member.ID, member.IsLearner
 			break
 		}
 	}
@@ -141,6 +171,10 @@ func (c *Server) Join(cluster *Client) error {
 		ctx, cancel := context.WithTimeout(context.Background(), defaultStartRejoinTimeout)
 		defer cancel()
 		if err := c.startServer(ctx); err == nil {
+			// We may have been stopped before being promoted.
+			if isLearner {
+				return c.promote(cluster, memberID)
+			}
 			return nil
 		}
 
@@ -151,10 +185,10 @@ func (c *Server) Join(cluster *Client) error {
 	}
 	os.RemoveAll(c.cfg.DataDir)
 
-	// Add ourselves as a member.
-	memberID, unlock, err := cluster.AddMember(c.cfg.Name, []string{peerURL(c.cfg.PrivateAddress, c.cfg.PeerSC.TLSEnabled())})
+	// Add ourselves as a learner, so that the quorum size is not increased until we have caught up with the leader.
+	memberID, unlock, err := cluster.AddLearner(c.cfg.Name, []string{peerURL(c.cfg.PrivateAddress, c.cfg.PeerPort, c.cfg.PeerSC.TLSEnabled())})
 	if err != nil {
-		return fmt.Errorf("failed to add ourselves as a member of the cluster: %v", err)
+		return fmt.Errorf("failed to add ourselves as a learner of the cluster: %v", err)
 	}
 	defer unlock()
 
@@ -162,9 +196,38 @@ func (c *Server) Join(cluster *Client) error {
 	ctx, cancel = context.WithTimeout(context.Background(), defaultStartTimeout)
 	defer cancel()
 	if err := c.startServer(ctx); err != nil {
-		cluster.RemoveMember(c.cfg.Name, memberID)
+		cluster.removeMember(memberID)
 		return err
 	}
+
+	// Promote ourselves to a voting member once we have caught up.
+	return c.promote(cluster, memberID)
+}
+
+// promote waits for the local learner to catch up with the leader and promotes it. If the promotion does not succeed
+// in time, the server is stopped and the learner removed from the cluster, so that joining can be attempted again.
+func (c *Server) promote(cluster *Client, memberID uint64) error {
+	t := time.Now()
+
+	timeout := c.cfg.LearnerPromotionTimeout
+	if timeout == 0 {
+		timeout = defaultPromotionTimeout
+	}
+	zap.S().Infof("waiting for learner to catch up with the leader before being promoted (timeout: %v)", timeout)
+
+	if err := cluster.PromoteLearner(memberID, c.clientEndpoint(), timeout); err != nil {
+		promLearnerPromotionsTotal.WithLabelValues(promResultFailure).Inc()
+
+		c.Stop(false, false)
+		if err := cluster.removeMember(memberID); err != nil {
+			zap.S().With(zap.Error(err)).Warn("failed to remove ourselves from the cluster's member list")
+		}
+		return fmt.Errorf("failed to promote learner: %v", err)
+	}
+	promLearnerPromotionsTotal.WithLabelValues(promResultSuccess).Inc()
+	promLearnerPromotionDuration.Observe(time.Since(t).Seconds())
+
+	zap.S().Infof("learner promoted to voting member in %v", time.Since(t))
 	return nil
 }
 
@@ -185,7 +248,7 @@ func (c *Server) Restore(metadata *snapshot.Metadata) error {
 	// directly from the data directory, to a temporary file when Get is called.
 	os.RemoveAll(c.cfg.DataDir)
 
-	restorePeerURL := peerURL(c.cfg.PrivateAddress, c.cfg.PeerSC.TLSEnabled())
+	restorePeerURL := peerURL(c.cfg.PrivateAddress, c.cfg.PeerPort, c.cfg.PeerSC.TLSEnabled())
 	restoreCfg := etcdsnap.RestoreConfig{
 		SnapshotPath:        path,
 		Name:                c.cfg.Name,
@@ -207,7 +270,7 @@ func (c *Server) Snapshot() error {
 	t := time.Now()
 
 	// Purge old snapshots in the background.
-	go c.cfg.SnapshotProvider.Purge(c.cfg.SnapshotTTL)
+	go c.purgeSnapshots()
 
 	// Get the latest snapshotted revision.
 	var minRev int64
@@ -223,9 +286,11 @@ func (c *Server) Snapshot() error {
 	rc, rev, err := c.snapshot(minRev)
 	if err == ErrMemberRevisionTooOld {
 		zap.S().Infof("skipping snapshot: current revision %016x <= latest snapshot %016x", rev, minRev)
+		promSnapshotsTotal.WithLabelValues(c.cfg.SnapshotProviderName, promResultSkipped).Inc()
 		return nil
 	}
 	if err != nil {
+		promSnapshotsTotal.WithLabelValues(c.cfg.SnapshotProviderName, promResultFailure).Inc()
 		return fmt.Errorf("failed to initiate snapshot: %v", err)
 	}
 	defer rc.Close()
@@ -233,13 +298,28 @@ func (c *Server) Snapshot() error {
 	// Save the incoming snapshot.
 	metadata, _ := snapshot.NewMetadata(c.cfg.Name, rev, -1, c.cfg.SnapshotProvider)
 	if err := c.cfg.SnapshotProvider.Save(rc, metadata); err != nil {
+		promSnapshotsTotal.WithLabelValues(c.cfg.SnapshotProviderName, promResultFailure).Inc()
 		return fmt.Errorf("failed to save snapshot: %v", err)
 	}
+	promSnapshotSaved(c.cfg.SnapshotProviderName, metadata.Revision, metadata.Size, t)
 
 	zap.S().Infof("snapshot %q saved successfully in %v (%.2f MB)", metadata.Filename(), time.Since(t), toMB(metadata.Size))
 	return nil
 }
 
+func (c *Server) purgeSnapshots() {
+	c.mu.RLock()
+	ttl := c.cfg.SnapshotTTL
+	c.mu.RUnlock()
+
+	n, err := c.cfg.SnapshotProvider.Purge(ttl)
+	if err != nil {
+		zap.S().With(zap.Error(err)).Warn("failed to purge old snapshots")
+		promSnapshotPurgeFailuresTotal.WithLabelValues(c.cfg.SnapshotProviderName).Inc()
+	}
+	promSnapshotsPurgedTotal.WithLabelValues(c.cfg.SnapshotProviderName).Add(float64(n))
+}
+
 func (c *Server) SnapshotInfo() (*snapshot.Metadata, error) {
 	var localSnap, cfgSnap *snapshot.Metadata
 	var localErr, cfgErr error
@@ -298,6 +378,168 @@ func (c *Server) snapshot(minRevision int64) (io.ReadCloser, int64, error) {
 	return pr, revision, nil
 }
 
+// TransferLeadership moves the leadership to the most up-to-date healthy voting member if the local member is the
+// leader, and waits for the transfer to be confirmed, so that stopping the local member does not force an election.
+func (c *Server) TransferLeadership() error {
+	if !c.isRunning || c.server.Server.Leader() != c.server.Server.ID() {
+		return nil
+	}
+	t := time.Now()
+
+	client, err := NewClient([]string{c.clientEndpoint()}, c.cfg.ClientSC, false)
+	if err != nil {
+		return fmt.Errorf("failed to create etcd client: %v", err)
+	}
+	defer client.Close()
+
+	// Select the healthy voting member that has applied the most entries.
+	members, err := client.MembersStatus()
+	if err != nil {
+		return fmt.Errorf("failed to get members status: %v", err)
+	}
+	var transferee *MemberStatus
+	for _, member := range members {
+		if member.id == uint64(c.server.Server.ID()) || member.IsLearner || !member.Healthy {
+			continue
+		}
+		if transferee == nil || member.RaftAppliedIndex > transferee.RaftAppliedIndex {
+			transferee = member
+		}
+	}
+	if transferee == nil {
+		promLeadershipTransfersTotal.WithLabelValues(promResultSkipped).Inc()
+		return errors.New("no healthy voting member to transfer the leadership to")
+	}
+	zap.S().Infof("transferring leadership to %q", transferee.Name)
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTransferTimeout)
+	defer cancel()
+
+	if _, err := client.MoveLeader(ctx, transferee.id); err != nil {
+		promLeadershipTransfersTotal.WithLabelValues(promResultFailure).Inc()
+		return fmt.Errorf("failed to move leader: %v", err)
+	}
+
+	// Wait for the local member to acknowledge the new leader.
+	tk := time.NewTicker(defaultTransferPollInterval)
+	defer tk.Stop()
+	for uint64(c.server.Server.Leader()) != transferee.id {
+		select {
+		case <-ctx.Done():
+			promLeadershipTransfersTotal.WithLabelValues(promResultFailure).Inc()
+			return fmt.Errorf("leadership transfer to %q not confirmed within %v", transferee.Name, defaultTransferTimeout)
+		case <-tk.C:
+		}
+	}
+	promLeadershipTransfersTotal.WithLabelValues(promResultSuccess).Inc()
+
+	zap.S().Infof("leadership transferred to %q in %v", transferee.Name, time.Since(t))
+	return nil
+}
+
+// Leave removes the local member from the cluster when the cluster has more voting members than desired (i.e. the
+// auto-scaling group has been scaled in), and when the remaining healthy voting members are enough to maintain quorum.
+//
+// It returns whether the member has been removed.
+func (c *Server) Leave(cluster *Client, desiredSize int) (bool, error) {
+	members, err := cluster.MembersStatus()
+	if err != nil {
+		return false, fmt.Errorf("failed to get members status: %v", err)
+	}
+
+	var self *MemberStatus
+	var voters, healthyPeers int
+	for _, member := range members {
+		if member.IsLearner {
+			continue
+		}
+		voters++
+
+		if member.Name == c.cfg.Name {
+			self = member
+			continue
+		}
+		if member.Healthy {
+			healthyPeers++
+		}
+	}
+
+	if self == nil || voters <= desiredSize {
+		return false, nil
+	}
+	if healthyPeers < (voters-1)/2+1 {
+		return false, fmt.Errorf("only %d healthy voting members would remain out of %d, which is not enough to maintain quorum", healthyPeers, voters-1)
+	}
+
+	zap.S().Infof("removing ourselves from the cluster, as it has %d voting members while %d are desired", voters, desiredSize)
+	if err := cluster.RemoveMember(c.cfg.Name, self.id); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Defragment defragments the local member's backend.
+func (c *Server) Defragment() error {
+	if !c.isRunning {
+		return errors.New("etcd is not running")
+	}
+
+	client, err := NewClient([]string{c.clientEndpoint()}, c.cfg.ClientSC, false)
+	if err != nil {
+		return fmt.Errorf("failed to create etcd client: %v", err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultDefragmentTimeout)
+	defer cancel()
+
+	if _, err := client.Defragment(ctx, ClientURL(c.clientEndpoint(), c.cfg.ClientSC.TLSEnabled())); err != nil {
+		return fmt.Errorf("failed to defragment: %v", err)
+	}
+	return nil
+}
+
+// SetPaused prevents (or allows again) the removal of unhealthy members by the member cleaner.
+func (c *Server) SetPaused(paused bool) {
+	var v int32
+	if paused {
+		v = 1
+	}
+	atomic.StoreInt32(&c.paused, v)
+}
+
+func (c *Server) isPaused() bool {
+	return atomic.LoadInt32(&c.paused) == 1
+}
+
+// Reconfigure updates the settings that can be changed while etcd is running. They are picked up by the member
+// cleaner and the snapshotter on their next iteration.
+func (c *Server) Reconfigure(unhealthyMemberTTL, snapshotInterval, snapshotTTL time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.cfg.UnhealthyMemberTTL = unhealthyMemberTTL
+	c.cfg.SnapshotInterval = snapshotInterval
+	c.cfg.SnapshotTTL = snapshotTTL
+}
+
+func (c *Server) unhealthyMemberTTL() time.Duration {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cfg.UnhealthyMemberTTL
+}
+
+func (c *Server) snapshotInterval() time.Duration {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cfg.SnapshotInterval
+}
+
+// clientEndpoint returns the host:port at which the local member serves its clients.
+func (c *Server) clientEndpoint() string {
+	return JoinHostPort(c.cfg.PrivateAddress, c.cfg.ClientPort)
+}
+
 func (c *Server) IsRunning() bool {
 	return c.isRunning
 }
@@ -334,11 +576,11 @@ func (c *Server) startServer(ctx context.Context) error {
 	etcdCfg.ClientTLSInfo = c.cfg.ClientSC.TLSInfo()
 	etcdCfg.SelfSignedCertValidity = 5
 	etcdCfg.InitialCluster = initialCluster(c.cfg.initialPURLs)
-	etcdCfg.LPUrls, _ = types.NewURLs([]string{peerURL(c.cfg.BindAddress, c.cfg.PeerSC.TLSEnabled())})
-	etcdCfg.APUrls, _ = types.NewURLs([]string{peerURL(c.cfg.PrivateAddress, c.cfg.PeerSC.TLSEnabled())})
-	etcdCfg.LCUrls, _ = types.NewURLs([]string{ClientURL(c.cfg.BindAddress, c.cfg.ClientSC.TLSEnabled())})
-	etcdCfg.ACUrls, _ = types.NewURLs([]string{ClientURL(c.cfg.PublicAddress, c.cfg.ClientSC.TLSEnabled())})
-	etcdCfg.ListenMetricsUrls = append(metricsURLs(c.cfg.BindAddress), metricsURLs("127.0.0.1")...)
+	etcdCfg.LPUrls, _ = types.NewURLs([]string{peerURL(c.cfg.BindAddress, c.cfg.PeerPort, c.cfg.PeerSC.TLSEnabled())})
+	etcdCfg.APUrls, _ = types.NewURLs([]string{peerURL(c.cfg.PrivateAddress, c.cfg.PeerPort, c.cfg.PeerSC.TLSEnabled())})
+	etcdCfg.LCUrls, _ = types.NewURLs([]string{ClientURL(JoinHostPort(c.cfg.BindAddress, c.cfg.ClientPort), c.cfg.ClientSC.TLSEnabled())})
+	etcdCfg.ACUrls, _ = types.NewURLs([]string{ClientURL(JoinHostPort(c.cfg.PublicAddress, c.cfg.ClientPort), c.cfg.ClientSC.TLSEnabled())})
+	etcdCfg.ListenMetricsUrls = append(metricsURLs(c.cfg.BindAddress, c.cfg.MetricsPort), metricsURLs("127.0.0.1", c.cfg.MetricsPort)...)
 	etcdCfg.Metrics = "extensive"
 	etcdCfg.QuotaBackendBytes = c.cfg.DataQuota
 	etcdCfg.AutoCompactionMode = c.cfg.AutoCompactionMode
@@ -425,7 +667,8 @@ func (c *Server) runMemberCleaner() {
 		}
 
 		for _, member := range c.server.Server.Cluster().Members() {
-			if !member.IsStarted() {
+			endpoint := MemberEndpoint(member.PeerURLs, member.ClientURLs)
+			if !member.IsStarted() || endpoint == "" {
 				continue
 			}
 
@@ -435,7 +678,7 @@ func (c *Server) runMemberCleaner() {
 			}
 
 			// Determine if the member is healthy and set the last time the member has been seen healthy.
-			if c, err := NewClient([]string{URL2Address(member.PeerURLs[0])}, c.cfg.ClientSC, false); err == nil {
+			if c, err := NewClient([]string{endpoint}, c.cfg.ClientSC, false); err == nil {
 				if c.IsHealthy(5, 5*time.Second) {
 					members[member.ID].lastSeenHealthy = time.Now()
 				}
@@ -443,18 +686,23 @@ func (c *Server) runMemberCleaner() {
 			}
 		}
 
+		unhealthyMemberTTL := c.unhealthyMemberTTL()
 		for id, member := range members {
 			// Give the member time to start if it's a new one.
 			if time.Since(member.firstSeen) < defaultStartTimeout && (member.lastSeenHealthy == time.Time{}) {
 				continue
 			}
 			// Allow the member a graceful period.
-			if time.Since(member.lastSeenHealthy) < c.cfg.UnhealthyMemberTTL {
+			if time.Since(member.lastSeenHealthy) < unhealthyMemberTTL {
+				continue
+			}
+			if c.isPaused() {
+				zap.S().Infof("not removing member %q that's been unhealthy for %v, as the operator is paused", member.name, unhealthyMemberTTL)
 				continue
 			}
-			zap.S().Infof("removing member %q that's been unhealthy for %v", member.name, c.cfg.UnhealthyMemberTTL)
+			zap.S().Infof("removing member %q that's been unhealthy for %v", member.name, unhealthyMemberTTL)
 
-			cl, err := NewClient([]string{c.cfg.PrivateAddress}, c.cfg.ClientSC, false)
+			cl, err := NewClient([]string{c.clientEndpoint()}, c.cfg.ClientSC, false)
 			if err != nil {
 				zap.S().With(zap.Error(err)).Warn("failed to create etcd cluster client")
 				continue
@@ -473,12 +721,13 @@ func (c *Server) runMemberCleaner() {
 }
 
 func (c *Server) runSnapshotter() {
-	if c.cfg.SnapshotProvider == nil || c.cfg.SnapshotInterval == 0 {
+	interval := c.snapshotInterval()
+	if c.cfg.SnapshotProvider == nil || interval == 0 {
 		zap.S().Warn("periodic snapshots are disabled")
 		return
 	}
 
-	t := time.NewTicker(c.cfg.SnapshotInterval)
+	t := time.NewTicker(interval)
 	defer t.Stop()
 
 	for {
@@ -487,6 +736,12 @@ func (c *Server) runSnapshotter() {
 			return
 		}
 
+		// Pick up the interval that might have been changed with Reconfigure.
+		if i := c.snapshotInterval(); i != interval && i > 0 {
+			t.Reset(i)
+			interval = i
+		}
+
 		if err := c.Snapshot(); err != nil {
 			zap.S().With(zap.Error(err)).Error("failed to snapshot")
 		}
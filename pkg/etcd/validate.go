@@ -35,13 +35,26 @@ func (c *EtcdConfiguration) Validate() error {
 				return fmt.Errorf("empty permissions for role %q", role.Name)
 			}
 
+			ranges := make(map[[2]string]struct{})
 			for _, perm := range role.Permissions {
 				if perm.Mode == "" {
 					return fmt.Errorf("empty permission 'mode' for role %q", role.Name)
 				}
+				if _, err := perm.Type(); err != nil {
+					return fmt.Errorf("%v for role %q", err, role.Name)
+				}
 				if perm.Key == "" {
 					return fmt.Errorf("empty permission 'key' for role %q", role.Name)
 				}
+				if perm.Prefix && perm.RangeEnd != "" {
+					return fmt.Errorf("permission on %q for role %q can not have both 'prefix' and 'rangeEnd'", perm.Key, role.Name)
+				}
+
+				key, rangeEnd := perm.Range()
+				if _, ok := ranges[[2]string{key, rangeEnd}]; ok {
+					return fmt.Errorf("duplicated permission on %q for role %q", perm.Key, role.Name)
+				}
+				ranges[[2]string{key, rangeEnd}] = struct{}{}
 			}
 
 			if _, ok := roleNames[role.Name]; ok {
@@ -68,5 +81,25 @@ func (c *EtcdConfiguration) Validate() error {
 		}
 	}
 
+	if c.InternalCA != nil && c.InternalCA.Enabled {
+		switch c.InternalCA.Store {
+		case "", InternalCAStoreFile:
+			if c.InternalCA.CertFile == "" || c.InternalCA.KeyFile == "" {
+				return fmt.Errorf("the internal CA's cert-file and key-file must be set with the %q store", InternalCAStoreFile)
+			}
+		case InternalCAStoreSnapshot:
+		default:
+			return fmt.Errorf("invalid internal CA store %q", c.InternalCA.Store)
+		}
+
+		// The config may already have been pointed to the issued certificates by ApplyInternalCA.
+		if sc := c.ClientTransportSecurity; (sc.CertFile != "" || sc.KeyFile != "") && sc.CertFile != c.InternalCA.ServerCertFile() {
+			return fmt.Errorf("client-transport-security's cert-file and key-file can not be set with the internal CA")
+		}
+		if c.InternalCA.Validity < 0 || c.InternalCA.RenewBefore < 0 || (c.InternalCA.Validity > 0 && c.InternalCA.RenewBefore >= c.InternalCA.Validity) {
+			return fmt.Errorf("the internal CA's renew-before must be shorter than its validity")
+		}
+	}
+
 	return nil
 }
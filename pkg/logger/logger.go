@@ -15,6 +15,7 @@
 package logger
 
 import (
+	"errors"
 	"go.etcd.io/etcd/client/pkg/v3/logutil"
 	"go.uber.org/zap/zapgrpc"
 	"google.golang.org/grpc"
@@ -36,8 +37,14 @@ var Config *zap.Config
 var Logger *zap.Logger
 
 func Configure(lvl string) {
+	ConfigureOutput(lvl, "stdout")
+}
+
+// ConfigureOutput is like Configure, but logs to the given output (e.g. "stderr" for the commands that write their
+// result to the standard output).
+func ConfigureOutput(lvl, output string) {
 	// Build logger configuration
-	buildZapLogger(lvl)
+	buildZapLogger(lvl, output)
 
 	zap.ReplaceGlobals(Logger)
 	if lvl != "debug" {
@@ -48,10 +55,10 @@ func Configure(lvl string) {
 	}
 }
 
-// buildZapLogger builds a *zap.Logger end-to-end based on the specified logging level, and stores the logger alongside
+// buildZapLogger builds a *zap.Logger end-to-end based on the specified logging level and output, and stores the logger alongside
 // his configuration in global variables, so they can be referred to from other libs who configure logging
 // independently.
-func buildZapLogger(lvl string) {
+func buildZapLogger(lvl, output string) {
 	if Logger != nil {
 		return
 	}
@@ -59,8 +66,8 @@ func buildZapLogger(lvl string) {
 	// Build configuration, the same way etcd's embed package does it; as it is currently not possible to set a
 	// *zap.Logger directly into embed, and we'd like to be consistent. https://github.com/etcd-io/etcd/issues/12326
 	zlCfg := logutil.DefaultZapLoggerConfig
-	zlCfg.ErrorOutputPaths = []string{"stdout"}
-	zlCfg.OutputPaths = []string{"stdout"}
+	zlCfg.ErrorOutputPaths = []string{output}
+	zlCfg.OutputPaths = []string{output}
 	zlCfg.Level = zap.NewAtomicLevelAt(logutil.ConvertToZapLevel(lvl))
 	zlCfg.Development = lvl == "debug"
 	zlCfg.Sampling = nil
@@ -80,6 +87,13 @@ func buildZapLogger(lvl string) {
 	Logger = zl
 }
 
+// SetLevel changes the logging level of the global logger, without having to rebuild it.
+func SetLevel(lvl string) error {
+	if Config == nil {
+		return errors.New("logger is not configured")
+	}
+	return Config.Level.UnmarshalText([]byte(lvl))
+}
 
 // BuildZapConfigBuilder returns a configuration builder for the etcd server.
 //
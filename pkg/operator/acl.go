@@ -21,7 +21,6 @@ import (
 	"fmt"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
-	"strings"
 	"time"
 
 	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
@@ -36,134 +35,108 @@ const (
 	initACLConfigKeyPath  = "/etcd-cloud-operator/init-acl-config"
 )
 
-func (s *Operator) applyACLConfig(ctx context.Context, config *etcd.ACLConfig) error {
-	var err error
-	for _, role := range config.Roles {
-		resp, err := s.etcdClient.RoleGet(ctx, role.Name)
-		if err == nil && resp != nil {
-			if _, err := s.etcdClient.RoleDelete(ctx, role.Name); err != nil {
-				return err
-			}
-		}
-		if _, err := s.etcdClient.RoleAdd(ctx, role.Name); err != nil {
-			return err
-		}
-
-		for _, perm := range role.Permissions {
-			var rangeEnd string
-			var mode clientv3.PermissionType
-
-			if perm.Prefix {
-				rangeEnd = clientv3.GetPrefixRangeEnd(perm.Key)
-			}
-
-			switch strings.ToLower(perm.Mode) {
-			case "read":
-				mode = clientv3.PermissionType(clientv3.PermRead)
-			case "write":
-				mode = clientv3.PermissionType(clientv3.PermWrite)
-			case "readwrite":
-				mode = clientv3.PermissionType(clientv3.PermReadWrite)
-			default:
-				return fmt.Errorf("invalid permission mode %q", perm.Mode)
-			}
-
-			_, err = s.etcdClient.RoleGrantPermission(ctx, role.Name, perm.Key, rangeEnd, mode)
-			if err != nil {
-				return err
-			}
-		}
-	}
-
-	for _, user := range config.Users {
-		var opt clientv3.UserAddOptions
-
-		if user.Password == "" {
-			opt.NoPassword = true
-		}
-
-		resp, err := s.etcdClient.UserGet(ctx, user.Name)
-		if err == nil && resp != nil {
-			if _, err := s.etcdClient.UserDelete(ctx, user.Name); err != nil {
-				return err
-			}
-		}
-		if _, err := s.etcdClient.UserAddWithOptions(ctx, user.Name, user.Password, &opt); err != nil {
-			return err
-		}
-
-		for _, role := range user.Roles {
-			_, err = s.etcdClient.UserGrantRole(ctx, user.Name, role)
-			if err != nil {
-				return err
-			}
-		}
-	}
-
-	configBytes, err := yaml.Marshal(config)
+// storeACLConfig persists the given config as the last applied one, to detect the changes made to it later on. Only
+// hashes of the passwords are persisted, the passwords of the adopted users are marked as unknown, and the users whose
+// authentication method was not switched keep their previous password. It returns the revision of the stored config.
+func (s *Operator) storeACLConfig(ctx context.Context, config, previous *etcd.ACLConfig, diff etcd.ACLDiff) (int64, error) {
+	fingerprint, err := config.Fingerprint()
 	if err != nil {
-		return err
-	}
-
-	if _, err := s.etcdClient.Put(ctx, initACLConfigKeyPath, string(configBytes)); err != nil {
-		return err
+		return 0, err
 	}
+	fingerprint.MarkUnknownPasswords(diff.UnknownPasswords)
+	fingerprint.KeepPasswords(previous, diff.RefusedSwitches())
 
-	return nil
-}
-
-func (s *Operator) removeACLConfig(ctx context.Context, config *etcd.ACLConfig) error {
-	for _, user := range config.Users {
-		_, err := s.etcdClient.UserDelete(ctx, user.Name)
-		if err != nil && err != rpctypes.ErrUserNotFound {
-			return err
-		}
+	configBytes, err := yaml.Marshal(fingerprint)
+	if err != nil {
+		return 0, err
 	}
 
-	for _, role := range config.Roles {
-		if _, err := s.etcdClient.RoleDelete(ctx, role.Name); err != nil {
-			if err == rpctypes.ErrRoleNotFound {
-				continue
-			}
-			return err
-		}
+	var resp *clientv3.PutResponse
+	err = etcd.WithRequestTimeout(ctx, func(ctx context.Context) (err error) {
+		resp, err = s.etcdClient.Put(ctx, initACLConfigKeyPath, string(configBytes))
+		return
+	})
+	if err != nil {
+		return 0, err
 	}
 
-	_, err := s.etcdClient.Delete(ctx, initACLConfigKeyPath)
-	if err != nil && err != rpctypes.ErrKeyNotFound {
-		return err
-	}
-	return nil
+	return resp.Header.Revision, nil
 }
 
+// reconcileInitACLConfig applies the changes made to the given config since it was last applied.
+//
+// Rather than re-creating every role and user, the config is compared with the actual auth state of etcd, and only the
+// missing grants, the extra permissions and the password changes are applied, so that the clients never lose access.
+//
+// Comparing the passwords with their hashes takes a while for each user, therefore each request has its own timeout
+// rather than sharing a deadline with the comparisons.
 func (s *Operator) reconcileInitACLConfig(config *etcd.ACLConfig) error {
-	ctx, cancel := context.WithTimeout(context.Background(), defaultRequestTimeout)
-	defer cancel()
+	ctx := context.Background()
 
 	if err := s.enableACL(ctx, config); err != nil {
 		zap.S().With(zap.Error(err)).Error("failed to enable ACL")
 		return err
 	}
 
-	oldACLConfig, err := s.getOldACLConfig(ctx)
+	oldACLConfig, revision, err := s.getOldACLConfig(ctx)
 	if err != nil {
 		zap.S().With(zap.Error(err)).Error("failed to get old ACL config")
 		return err
 	}
 
-	if !oldACLConfig.Equal(config) {
-		if oldACLConfig != nil {
-			if err := s.removeACLConfig(ctx, oldACLConfig); err != nil {
-				zap.S().With(zap.Error(err)).Error("failed to remove ACL config")
+	// Comparing the passwords with their hashes is expensive, skip it if this very config has been found to be
+	// applied already, and nobody has stored another one since.
+	if revision != 0 && revision == s.appliedACLRevision && s.appliedACL.Equal(config) {
+		return nil
+	}
+
+	var (
+		reconciled bool
+		diff       etcd.ACLDiff
+	)
+	if !config.Matches(oldACLConfig) {
+		changeRootPassword := oldACLConfig != nil && config.RootPassword.Value() != "" && !config.RootPassword.Matches(oldACLConfig.RootPassword)
+
+		actual, err := s.etcdClient.AuthState(ctx)
+		if err != nil {
+			zap.S().With(zap.Error(err)).Error("failed to read the auth state")
+			return err
+		}
+
+		diff, err = etcd.DiffACL(actual, oldACLConfig, config)
+		if err != nil {
+			return err
+		}
+
+		if changeRootPassword {
+			zap.S().Info("changing password of user \"root\"")
+			err := etcd.WithRequestTimeout(ctx, func(ctx context.Context) error {
+				_, err := s.etcdClient.UserChangePassword(ctx, "root", config.RootPassword.Value())
+				return err
+			})
+			if err != nil {
+				zap.S().With(zap.Error(err)).Error("failed to change root password")
 				return err
 			}
 		}
-		if err := s.applyACLConfig(ctx, config); err != nil {
+		if err := s.etcdClient.ApplyACLDiff(ctx, diff, config); err != nil {
 			zap.S().With(zap.Error(err)).Error("failed to apply ACL config")
 			return err
 		}
+
+		zap.S().Infof("ACL config reconciled (%d roles and %d users changed)", len(diff.Roles), len(diff.Users))
+		reconciled = true
 	}
 
+	// Configs stored by former versions hold the passwords in plaintext, replace them.
+	if reconciled || oldACLConfig.HasPlaintext() {
+		if revision, err = s.storeACLConfig(ctx, config, oldACLConfig, diff); err != nil {
+			zap.S().With(zap.Error(err)).Error("failed to store ACL config")
+			return err
+		}
+	}
+
+	s.appliedACL, s.appliedACLRevision = config, revision
 	return nil
 }
 
@@ -173,81 +146,92 @@ func (s *Operator) enableACL(ctx context.Context, config *etcd.ACLConfig) error
 		return err
 	}
 
-	resp, err := s.etcdClient.UserGet(ctx, commonName)
+	var resp *clientv3.AuthUserGetResponse
+	err = etcd.WithRequestTimeout(ctx, func(ctx context.Context) (err error) {
+		resp, err = s.etcdClient.UserGet(ctx, commonName)
+		return
+	})
 	if err == nil && resp != nil {
 		for _, role := range resp.Roles {
 			if role == "root" {
 				return nil
 			}
 		}
-		if _, err := s.etcdClient.UserDelete(ctx, commonName); err != nil {
+		err := etcd.WithRequestTimeout(ctx, func(ctx context.Context) error {
+			_, err := s.etcdClient.UserDelete(ctx, commonName)
+			return err
+		})
+		if err != nil {
 			return err
 		}
 	}
 
-	_, err = s.etcdClient.RoleAdd(ctx, "root")
+	err = etcd.WithRequestTimeout(ctx, func(ctx context.Context) error {
+		_, err := s.etcdClient.RoleAdd(ctx, "root")
+		return err
+	})
 	if err != nil && err != rpctypes.ErrRoleAlreadyExist {
 		return err
 	}
 
-	if config.RootPassword == nil || *config.RootPassword == "" {
-		_, err = s.etcdClient.UserAddWithOptions(ctx, "root", "", &clientv3.UserAddOptions{NoPassword: true})
-		if err != nil && err != rpctypes.ErrUserAlreadyExist {
-			return err
-		}
-	} else {
-		_, err = s.etcdClient.UserAdd(ctx, "root", *config.RootPassword)
-		if err != nil && err != rpctypes.ErrUserAlreadyExist {
-			return err
-		}
-	}
-
-	if _, err := s.etcdClient.UserGrantRole(ctx, "root", "root"); err != nil {
+	err = etcd.WithRequestTimeout(ctx, func(ctx context.Context) error {
+		opt := &clientv3.UserAddOptions{NoPassword: config.RootPassword.Value() == ""}
+		_, err := s.etcdClient.UserAddWithOptions(ctx, "root", config.RootPassword.Value(), opt)
 		return err
-	}
-
-	if _, err := s.etcdClient.UserAddWithOptions(ctx, commonName, "", &clientv3.UserAddOptions{NoPassword: true}); err != nil {
+	})
+	if err != nil && err != rpctypes.ErrUserAlreadyExist {
 		return err
 	}
 
-	if _, err := s.etcdClient.UserGrantRole(ctx, commonName, "root"); err != nil {
-		return err
-	}
+	for _, user := range []string{"root", commonName, "etcd"} {
+		if user != "root" {
+			err := etcd.WithRequestTimeout(ctx, func(ctx context.Context) error {
+				_, err := s.etcdClient.UserAddWithOptions(ctx, user, "", &clientv3.UserAddOptions{NoPassword: true})
+				return err
+			})
+			if err != nil {
+				return err
+			}
+		}
 
-	if _, err := s.etcdClient.UserAddWithOptions(ctx, "etcd", "", &clientv3.UserAddOptions{NoPassword: true}); err != nil {
+		err := etcd.WithRequestTimeout(ctx, func(ctx context.Context) error {
+			_, err := s.etcdClient.UserGrantRole(ctx, user, "root")
 			return err
-	}
-
-	if _, err := s.etcdClient.UserGrantRole(ctx, "etcd", "root"); err != nil {
+		})
+		if err != nil {
 			return err
+		}
 	}
 
-	if _, err := s.etcdClient.AuthEnable(ctx); err != nil {
+	return etcd.WithRequestTimeout(ctx, func(ctx context.Context) error {
+		_, err := s.etcdClient.AuthEnable(ctx)
 		return err
-	}
-
-	return nil
+	})
 }
 
-func (s *Operator) getOldACLConfig(ctx context.Context) (*etcd.ACLConfig, error) {
-	resp, err := s.etcdClient.Get(ctx, initACLConfigKeyPath)
+func (s *Operator) getOldACLConfig(ctx context.Context) (*etcd.ACLConfig, int64, error) {
+	var resp *clientv3.GetResponse
+	err := etcd.WithRequestTimeout(ctx, func(ctx context.Context) (err error) {
+		resp, err = s.etcdClient.Get(ctx, initACLConfigKeyPath)
+		return
+	})
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	if len(resp.Kvs) == 0 {
-		return nil, nil
+		return nil, 0, nil
 	}
 
 	if len(resp.Kvs) != 1 {
-		return nil, fmt.Errorf("expect one kv for %q, got %v", initACLConfigKeyPath, len(resp.Kvs))
+		return nil, 0, fmt.Errorf("expect one kv for %q, got %v", initACLConfigKeyPath, len(resp.Kvs))
 	}
 
 	var oldACLConfig etcd.ACLConfig
 	if err := yaml.Unmarshal(resp.Kvs[0].Value, &oldACLConfig); err != nil {
-		return nil, err
+		return nil, 0, err
 	}
-	return &oldACLConfig, nil
+	return &oldACLConfig, resp.Kvs[0].ModRevision, nil
 }
 
 func (s *Operator) getCertCommonName() (string, error) {
@@ -0,0 +1,234 @@
+// Copyright 2017 Quentin Machu & eco authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package operator
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/quentin-m/etcd-cloud-operator/pkg/etcd"
+	"github.com/quentin-m/etcd-cloud-operator/pkg/providers/asg"
+)
+
+const apiPrefix = "/v1"
+
+// evaluation captures the inputs gathered by the last call to evaluate().
+type evaluation struct {
+	Time        time.Time      `json:"time"`
+	Self        instanceInfo   `json:"self"`
+	Instances   []instanceInfo `json:"instances"`
+	ClusterSize int            `json:"clusterSize"`
+	EtcdHealthy bool           `json:"etcdHealthy"`
+	EtcdRunning bool           `json:"etcdRunning"`
+	IsSeeder    bool           `json:"isSeeder"`
+	States      map[string]int `json:"states"`
+	Pause       pauseStatus    `json:"pause"`
+}
+
+type instanceInfo struct {
+	Name    string    `json:"name"`
+	Address string    `json:"address"`
+	Ports   asg.Ports `json:"ports"`
+}
+
+type snapshotInfo struct {
+	Name     string `json:"name"`
+	Revision int64  `json:"revision"`
+	Size     int64  `json:"size"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func newInstanceInfo(instance asg.Instance, clusterPorts asg.Ports) instanceInfo {
+	if instance == nil {
+		return instanceInfo{}
+	}
+	return instanceInfo{Name: instance.Name(), Address: instance.Address(), Ports: asg.InstancePorts(instance, clusterPorts)}
+}
+
+func (s *Operator) registerAPI() {
+	http.HandleFunc(apiPrefix+"/members", apiHandler(http.MethodGet, s.apiMembers))
+	http.HandleFunc(apiPrefix+"/evaluation", apiHandler(http.MethodGet, s.apiEvaluation))
+	http.HandleFunc(apiPrefix+"/decisions", apiHandler(http.MethodGet, s.apiDecisions))
+	http.HandleFunc(apiPrefix+"/snapshots", apiHandler(http.MethodGet, s.apiSnapshots))
+	http.HandleFunc(apiPrefix+"/snapshot", requireClientCert(apiHandler(http.MethodPost, s.apiSnapshot)))
+	http.HandleFunc(apiPrefix+"/defrag", requireClientCert(apiHandler(http.MethodPost, s.apiDefrag)))
+	http.HandleFunc(apiPrefix+"/pause", requireClientCert(apiHandler(http.MethodPost, s.apiPause)))
+	http.HandleFunc(apiPrefix+"/resume", requireClientCert(apiHandler(http.MethodPost, s.apiResume)))
+	http.HandleFunc(apiPrefix+"/reload", apiHandler(http.MethodGet, s.apiReload))
+	http.HandleFunc(apiPrefix+"/acl/drift", apiHandler(http.MethodGet, s.apiACLDrift))
+}
+
+// apiMembers lists the members of the etcd cluster, along with their health and revision.
+func (s *Operator) apiMembers(_ *http.Request) (int, interface{}) {
+	client, code, err := s.apiClusterClient()
+	if err != nil {
+		return code, err
+	}
+	defer client.Close()
+
+	members, err := client.MembersStatus()
+	if err != nil {
+		return http.StatusBadGateway, err
+	}
+	return http.StatusOK, members
+}
+
+// apiEvaluation returns the inputs gathered during the last evaluation of the cluster.
+func (s *Operator) apiEvaluation(_ *http.Request) (int, interface{}) {
+	ev := s.lastEvaluation()
+	if ev == nil {
+		return http.StatusServiceUnavailable, errors.New("cluster has not been evaluated yet")
+	}
+	return http.StatusOK, ev
+}
+
+// apiDecisions returns the history of the decisions taken by the operator, from oldest to newest.
+func (s *Operator) apiDecisions(_ *http.Request) (int, interface{}) {
+	return http.StatusOK, s.decisionHistory()
+}
+
+// apiSnapshots lists the snapshots available in the configured snapshot provider.
+func (s *Operator) apiSnapshots(_ *http.Request) (int, interface{}) {
+	metadatas, err := s.snapshotProvider.List()
+	if err != nil {
+		return http.StatusBadGateway, err
+	}
+
+	snapshots := make([]snapshotInfo, 0, len(metadatas))
+	for _, metadata := range metadatas {
+		snapshots = append(snapshots, snapshotInfo{Name: metadata.Name, Revision: metadata.Revision, Size: metadata.Size})
+	}
+	return http.StatusOK, snapshots
+}
+
+// apiSnapshot takes a snapshot of the local member and saves it to the configured snapshot provider. As etcd may be
+// starting or stopping, it waits for the action being executed by the main loop, if any.
+func (s *Operator) apiSnapshot(_ *http.Request) (int, interface{}) {
+	if err := s.rejectInDryRun("take a snapshot"); err != nil {
+		return http.StatusConflict, err
+	}
+
+	s.serverMu.Lock()
+	defer s.serverMu.Unlock()
+
+	if s.server == nil || !s.server.IsRunning() {
+		return http.StatusConflict, errors.New("etcd is not running")
+	}
+	zap.S().Info("snapshot requested through the admin api")
+	if err := s.server.Snapshot(); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
+
+// apiDefrag defragments the local member, once the action being executed by the main loop, if any, is done.
+func (s *Operator) apiDefrag(_ *http.Request) (int, interface{}) {
+	if err := s.rejectInDryRun("defragment the local member"); err != nil {
+		return http.StatusConflict, err
+	}
+
+	s.serverMu.Lock()
+	defer s.serverMu.Unlock()
+
+	if s.server == nil || !s.server.IsRunning() {
+		return http.StatusConflict, errors.New("etcd is not running")
+	}
+	zap.S().Info("defragmentation requested through the admin api")
+	if err := s.server.Defragment(); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
+
+// rejectInDryRun returns an error if the operator runs in dry-run mode, in which the admin API must not change the state
+// of etcd either.
+func (s *Operator) rejectInDryRun(description string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.cfg.DryRun {
+		zap.S().Infof("DRY-RUN: refused to %s through the admin api", description)
+		return errors.New("the operator runs in dry-run mode")
+	}
+	return nil
+}
+
+// apiClusterClient creates an etcd client for the instances found during the last evaluation.
+func (s *Operator) apiClusterClient() (*etcd.Client, int, error) {
+	ev := s.lastEvaluation()
+	if ev == nil {
+		return nil, http.StatusServiceUnavailable, errors.New("cluster has not been evaluated yet")
+	}
+
+	var addresses []string
+	for _, instance := range ev.Instances {
+		addresses = append(addresses, etcd.JoinHostPort(instance.Address, instance.Ports.Client))
+	}
+	client, err := etcd.NewClient(addresses, s.cfg.Etcd.ClientTransportSecurity, false)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	return client, http.StatusOK, nil
+}
+
+// requireClientCert restricts the given state-changing endpoint to the clients that presented a certificate verified by
+// the web server, which is never the case over plain HTTP.
+func requireClientCert(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			writeJSON(w, http.StatusForbidden, apiError{Error: "this endpoint requires a verified client certificate"})
+			return
+		}
+		h(w, r)
+	}
+}
+
+func apiHandler(method string, f func(*http.Request) (int, interface{})) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeJSON(w, http.StatusMethodNotAllowed, apiError{Error: "method not allowed"})
+			return
+		}
+
+		code, v := f(r)
+		if err, ok := v.(error); ok {
+			v = apiError{Error: err.Error()}
+		}
+		writeJSON(w, code, v)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		zap.S().With(zap.Error(err)).Warn("failed to marshal api response")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if _, err := w.Write(b); err != nil {
+		zap.S().With(zap.Error(err)).Warn("failed to write api response")
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2017 Quentin Machu & eco authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package operator
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireClientCert(t *testing.T) {
+	var called int
+	handler := requireClientCert(func(w http.ResponseWriter, _ *http.Request) {
+		called++
+		w.WriteHeader(http.StatusOK)
+	})
+
+	for _, tc := range []struct {
+		name     string
+		tls      *tls.ConnectionState
+		wantCode int
+	}{
+		{"plain http", nil, http.StatusForbidden},
+		{"tls without client certificate", &tls.ConnectionState{}, http.StatusForbidden},
+		{"verified client certificate", &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{}}}}, http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			called = 0
+			r := httptest.NewRequest(http.MethodPost, apiPrefix+"/defrag", nil)
+			r.TLS = tc.tls
+			w := httptest.NewRecorder()
+
+			handler(w, r)
+			if w.Code != tc.wantCode {
+				t.Errorf("got status %d, want %d", w.Code, tc.wantCode)
+			}
+			if wantCalled := tc.wantCode == http.StatusOK; (called == 1) != wantCalled {
+				t.Errorf("handler called %d times, want called: %v", called, wantCalled)
+			}
+		})
+	}
+}
+
+func TestAPIDryRun(t *testing.T) {
+	s := &Operator{cfg: Config{DryRun: true}}
+
+	for _, tc := range []struct {
+		name     string
+		handler  func(*http.Request) (int, interface{})
+		url      string
+		wantCode int
+	}{
+		{"snapshot", s.apiSnapshot, apiPrefix + "/snapshot", http.StatusConflict},
+		{"defrag", s.apiDefrag, apiPrefix + "/defrag", http.StatusConflict},
+		{"pause cluster", s.apiPause, apiPrefix + "/pause?scope=cluster", http.StatusConflict},
+		{"resume cluster", s.apiResume, apiPrefix + "/resume?scope=cluster", http.StatusConflict},
+		{"pause instance", s.apiPause, apiPrefix + "/pause", http.StatusOK},
+		{"resume instance", s.apiResume, apiPrefix + "/resume", http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			code, _ := tc.handler(httptest.NewRequest(http.MethodPost, tc.url, nil))
+			if code != tc.wantCode {
+				t.Errorf("got status %d, want %d", code, tc.wantCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,234 @@
+// Copyright 2017 Quentin Machu & eco authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package operator
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	"go.uber.org/zap"
+
+	"github.com/quentin-m/etcd-cloud-operator/pkg/etcd"
+)
+
+// ACLAuditConfig configures the periodic comparison of etcd's actual auth state with the initial ACL config.
+type ACLAuditConfig struct {
+	// Interval between two audits, performed by the seeder. Zero disables the audit.
+	Interval time.Duration `yaml:"interval"`
+
+	// Enforce makes the seeder correct the missing grants and the extra permissions found on the declared roles and
+	// users.
+	Enforce bool `yaml:"enforce"`
+
+	// RemoveUnmanaged makes the seeder delete the users and roles that are not declared in the initial ACL config,
+	// when Enforce is set.
+	RemoveUnmanaged bool `yaml:"remove-unmanaged"`
+}
+
+// aclDrift is the outcome of an ACL audit.
+type aclDrift struct {
+	Time             time.Time  `json:"time"`
+	UnmanagedUsers   []string   `json:"unmanagedUsers,omitempty"`
+	UnmanagedRoles   []string   `json:"unmanagedRoles,omitempty"`
+	MissingUsers     []string   `json:"missingUsers,omitempty"`
+	MissingRoles     []string   `json:"missingRoles,omitempty"`
+	MissingGrants    []aclGrant `json:"missingGrants,omitempty"`
+	ExtraPermissions []aclGrant `json:"extraPermissions,omitempty"`
+	Corrected        bool       `json:"corrected"`
+	Error            string     `json:"error,omitempty"`
+
+	diff etcd.ACLDiff
+}
+
+// aclGrant is either a permission granted to a role, or a role granted to a user.
+type aclGrant struct {
+	User       string           `json:"user,omitempty"`
+	Role       string           `json:"role"`
+	Permission *etcd.Permission `json:"permission,omitempty"`
+}
+
+func (d *aclDrift) empty() bool {
+	return len(d.UnmanagedUsers) == 0 && len(d.UnmanagedRoles) == 0 && d.diff.Empty()
+}
+
+// auditACL compares the actual auth state of etcd with the given config, and corrects the drift if enforcement is
+// enabled. It does nothing until the audit interval has elapsed since the last audit.
+func (s *Operator) auditACL(d *decision, config *etcd.ACLConfig) {
+	if s.cfg.ACLAudit.Interval <= 0 || time.Since(s.lastACLAudit) < s.cfg.ACLAudit.Interval {
+		return
+	}
+	s.lastACLAudit = time.Now()
+
+	drift, err := s.detectACLDrift(config)
+	if err != nil {
+		zap.S().With(zap.Error(err)).Warn("failed to audit the ACL")
+		drift = &aclDrift{Time: time.Now(), Error: err.Error()}
+	} else if !drift.empty() {
+		zap.S().Warnf("ACL drift detected: %d unmanaged users, %d unmanaged roles, %d missing users, %d missing roles, %d missing grants, %d extra permissions",
+			len(drift.UnmanagedUsers), len(drift.UnmanagedRoles), len(drift.MissingUsers), len(drift.MissingRoles), len(drift.MissingGrants), len(drift.ExtraPermissions))
+
+		if s.cfg.ACLAudit.Enforce {
+			err := s.performUnlessFrozen(d, "correct the ACL drift", func() error { return s.correctACLDrift(drift, config) })
+			if err != nil {
+				zap.S().With(zap.Error(err)).Error("failed to correct the ACL drift")
+				drift.Error = err.Error()
+			} else {
+				drift.Corrected = !s.cfg.DryRun && !s.isFrozen()
+			}
+		}
+	}
+
+	s.mu.Lock()
+	s.aclDrift = drift
+	s.mu.Unlock()
+
+	promSetACLDrift(drift)
+}
+
+// detectACLDrift reads the actual auth state of etcd, and lists its differences with the given config.
+func (s *Operator) detectACLDrift(config *etcd.ACLConfig) (*aclDrift, error) {
+	actual, err := s.etcdClient.AuthState(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	// Diffing against the config itself as the previous one ignores the passwords, which can not be read back, and
+	// never deletes anything.
+	diff, err := etcd.DiffACL(actual, config, config)
+	if err != nil {
+		return nil, err
+	}
+	drift := &aclDrift{Time: time.Now(), diff: diff}
+
+	commonName, err := s.getCertCommonName()
+	if err != nil {
+		return nil, err
+	}
+	systemUsers := []string{"root", "etcd", commonName}
+
+	for _, user := range actual.Users {
+		if !contains(systemUsers, user.Name) && !declaresUser(config, user.Name) {
+			drift.UnmanagedUsers = append(drift.UnmanagedUsers, user.Name)
+		}
+	}
+	for _, role := range actual.Roles {
+		if role.Name != "root" && !declaresRole(config, role.Name) {
+			drift.UnmanagedRoles = append(drift.UnmanagedRoles, role.Name)
+		}
+	}
+
+	for _, rd := range diff.Roles {
+		if rd.Create {
+			drift.MissingRoles = append(drift.MissingRoles, rd.Name)
+		}
+		for i := range rd.Grant {
+			drift.MissingGrants = append(drift.MissingGrants, aclGrant{Role: rd.Name, Permission: &rd.Grant[i]})
+		}
+		for i := range rd.Revoke {
+			drift.ExtraPermissions = append(drift.ExtraPermissions, aclGrant{Role: rd.Name, Permission: &rd.Revoke[i]})
+		}
+	}
+	for _, ud := range diff.Users {
+		if ud.Create {
+			drift.MissingUsers = append(drift.MissingUsers, ud.Name)
+		}
+		for _, role := range ud.GrantRoles {
+			drift.MissingGrants = append(drift.MissingGrants, aclGrant{User: ud.Name, Role: role})
+		}
+		for _, role := range ud.RevokeRoles {
+			drift.ExtraPermissions = append(drift.ExtraPermissions, aclGrant{User: ud.Name, Role: role})
+		}
+	}
+
+	return drift, nil
+}
+
+// correctACLDrift applies the changes required to converge the actual auth state to the given config.
+func (s *Operator) correctACLDrift(drift *aclDrift, config *etcd.ACLConfig) error {
+	ctx := context.Background()
+	if err := s.etcdClient.ApplyACLDiff(ctx, drift.diff, config); err != nil {
+		return err
+	}
+	if !s.cfg.ACLAudit.RemoveUnmanaged {
+		return nil
+	}
+
+	for _, name := range drift.UnmanagedUsers {
+		zap.S().Infof("deleting unmanaged user %q", name)
+		err := etcd.WithRequestTimeout(ctx, func(ctx context.Context) error {
+			_, err := s.etcdClient.UserDelete(ctx, name)
+			return err
+		})
+		if err != nil && err != rpctypes.ErrUserNotFound {
+			return err
+		}
+	}
+	for _, name := range drift.UnmanagedRoles {
+		zap.S().Infof("deleting unmanaged role %q", name)
+		err := etcd.WithRequestTimeout(ctx, func(ctx context.Context) error {
+			_, err := s.etcdClient.RoleDelete(ctx, name)
+			return err
+		})
+		if err != nil && err != rpctypes.ErrRoleNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// resetACLDrift forgets the outcome of the last audit, when this instance is not the one auditing anymore.
+func (s *Operator) resetACLDrift() {
+	s.lastACLAudit = time.Time{}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.aclDrift != nil {
+		s.aclDrift = nil
+		promSetACLDrift(&aclDrift{})
+	}
+}
+
+func declaresUser(config *etcd.ACLConfig, name string) bool {
+	for _, user := range config.Users {
+		if user.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func declaresRole(config *etcd.ACLConfig, name string) bool {
+	for _, role := range config.Roles {
+		if role.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// apiACLDrift returns the outcome of the last ACL audit performed by this instance.
+func (s *Operator) apiACLDrift(_ *http.Request) (int, interface{}) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.aclDrift == nil {
+		return http.StatusNotFound, errors.New("the ACL has not been audited by this instance, only the seeder audits it")
+	}
+	return http.StatusOK, s.aclDrift
+}
@@ -0,0 +1,290 @@
+// Copyright 2017 Quentin Machu & eco authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package operator
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"go.uber.org/zap"
+
+	"github.com/quentin-m/etcd-cloud-operator/pkg/etcd"
+	"github.com/quentin-m/etcd-cloud-operator/pkg/providers/asg"
+	"github.com/quentin-m/etcd-cloud-operator/pkg/providers/snapshot"
+)
+
+const (
+	caCertSecret = "ca.crt"
+	caKeySecret  = "ca.key"
+)
+
+var errNoCA = errors.New("the internal CA does not exist")
+
+// caStore keeps the certificate and key of the internal CA, shared by all the instances.
+type caStore interface {
+	// load returns the PEM-encoded certificate and key of the CA, or errNoCA.
+	load() ([]byte, []byte, error)
+	store(certPEM, keyPEM []byte) error
+}
+
+func newCAStore(cfg *etcd.InternalCAConfig, snapshotProvider snapshot.Provider) (caStore, error) {
+	if cfg.Store == etcd.InternalCAStoreSnapshot {
+		secretStore, ok := snapshotProvider.(snapshot.SecretStore)
+		if !ok {
+			return nil, errors.New("the snapshot provider can not store the internal CA")
+		}
+		return &snapshotCAStore{secretStore}, nil
+	}
+	return &fileCAStore{certFile: cfg.CertFile, keyFile: cfg.KeyFile}, nil
+}
+
+type fileCAStore struct {
+	certFile, keyFile string
+}
+
+func (f *fileCAStore) load() ([]byte, []byte, error) {
+	certPEM, err := ioutil.ReadFile(f.certFile)
+	if os.IsNotExist(err) {
+		return nil, nil, errNoCA
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := ioutil.ReadFile(f.keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	return certPEM, keyPEM, nil
+}
+
+func (f *fileCAStore) store(certPEM, keyPEM []byte) error {
+	if err := writeFileAtomic(f.keyFile, keyPEM, 0600); err != nil {
+		return err
+	}
+	return writeFileAtomic(f.certFile, certPEM, 0644)
+}
+
+type snapshotCAStore struct {
+	secretStore snapshot.SecretStore
+}
+
+func (s *snapshotCAStore) load() ([]byte, []byte, error) {
+	certPEM, err := s.secretStore.GetSecret(caCertSecret)
+	if err == snapshot.ErrNoSecret {
+		return nil, nil, errNoCA
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := s.secretStore.GetSecret(caKeySecret)
+	if err != nil {
+		return nil, nil, err
+	}
+	return certPEM, keyPEM, nil
+}
+
+func (s *snapshotCAStore) store(certPEM, keyPEM []byte) error {
+	// The certificate is stored last, as it is the one marking the CA as existing.
+	if err := s.secretStore.PutSecret(caKeySecret, keyPEM); err != nil {
+		return err
+	}
+	return s.secretStore.PutSecret(caCertSecret, certPEM)
+}
+
+// ensureCertificates makes sure that the certificates issued by the internal CA to this instance exist, match its
+// address, and are not about to expire, and issues them otherwise. etcd reads the certificates on every handshake,
+// therefore the renewed ones are picked up without restarting it.
+//
+// In dry-run mode, an existing CA is loaded, but nothing is created, issued or written: it is only logged.
+func (s *Operator) ensureCertificates(asgInstances []asg.Instance, asgSelf asg.Instance) error {
+	cfg := s.cfg.Etcd.InternalCA
+	if cfg == nil || !cfg.Enabled {
+		return nil
+	}
+
+	if s.ca == nil {
+		ca, err := s.loadCA(asgInstances, asgSelf)
+		if err == errNoCA {
+			// The CA is only missing in dry-run mode, where it is not created.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		s.ca = ca
+	}
+
+	if !s.cfg.DryRun {
+		if err := os.MkdirAll(cfg.Dir, 0700); err != nil {
+			return err
+		}
+	}
+	if err := s.writeFileIfChanged(cfg.CAFile(), s.ca.CertPEM, 0644); err != nil {
+		return err
+	}
+	if cfg.ExtraClientCAFile != "" {
+		extraPEM, err := ioutil.ReadFile(cfg.ExtraClientCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read trusted CA file: %v", err)
+		}
+		if err := s.writeFileIfChanged(cfg.ClientCAFile(), s.ca.Bundle(extraPEM), 0644); err != nil {
+			return err
+		}
+	}
+
+	// The client certificates share the same common name, which is the etcd user of the operator, and are also served
+	// by the members to their clients, hence the loopback addresses.
+	address := asgSelf.Address()
+	serverHosts := []string{address, "127.0.0.1", "localhost"}
+	if s.cfg.Etcd.AdvertiseAddress != "" && s.cfg.Etcd.AdvertiseAddress != address {
+		serverHosts = append(serverHosts, s.cfg.Etcd.AdvertiseAddress)
+	}
+	if err := s.ensureCertificate(cfg.ServerCertFile(), cfg.ServerKeyFile(), cfg.ClientCommonName, serverHosts); err != nil {
+		return err
+	}
+	return s.ensureCertificate(cfg.PeerCertFile(), cfg.PeerKeyFile(), asgSelf.Name(), []string{address})
+}
+
+// loadCA reads the internal CA from its store. If it does not exist yet, the instance whose name comes first in the
+// auto-scaling group creates it, while the others wait for it.
+func (s *Operator) loadCA(asgInstances []asg.Instance, asgSelf asg.Instance) (*etcd.CA, error) {
+	certPEM, keyPEM, err := s.caStore.load()
+	if err == nil {
+		return etcd.ParseCA(certPEM, keyPEM)
+	}
+	if err != errNoCA {
+		return nil, fmt.Errorf("failed to load the internal CA: %v", err)
+	}
+
+	for _, instance := range asgInstances {
+		if instance.Name() < asgSelf.Name() {
+			return nil, fmt.Errorf("waiting for the internal CA to be created by %q", instance.Name())
+		}
+	}
+
+	if s.skipInDryRun("create and store the internal CA") {
+		return nil, errNoCA
+	}
+
+	zap.S().Info("creating the internal CA")
+	ca, keyPEM, err := etcd.NewCA(s.cfg.Etcd.InternalCA.ClientCommonName)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.caStore.store(ca.CertPEM, keyPEM); err != nil {
+		return nil, fmt.Errorf("failed to store the internal CA: %v", err)
+	}
+	return ca, nil
+}
+
+func (s *Operator) ensureCertificate(certFile, keyFile, commonName string, hosts []string) error {
+	reason := "it does not exist"
+	if certPEM, err := ioutil.ReadFile(certFile); err == nil {
+		if _, err := os.Stat(keyFile); err == nil {
+			reason = s.ca.NeedsRenewal(certPEM, commonName, hosts, s.cfg.Etcd.InternalCA.RenewBefore)
+		}
+	}
+	if reason == "" || s.skipInDryRun(fmt.Sprintf("issue certificate %q, as %s", certFile, reason)) {
+		return nil
+	}
+
+	zap.S().Infof("issuing certificate %q, as %s", certFile, reason)
+	certPEM, keyPEM, err := s.ca.Issue(commonName, hosts, s.cfg.Etcd.InternalCA.Validity)
+	if err != nil {
+		return err
+	}
+	return writeKeyPairAtomic(certFile, keyFile, certPEM, keyPEM)
+}
+
+func (s *Operator) writeFileIfChanged(path string, data []byte, perm os.FileMode) error {
+	if current, err := ioutil.ReadFile(path); err == nil && bytes.Equal(current, data) {
+		return nil
+	}
+	if s.skipInDryRun(fmt.Sprintf("write %q", path)) {
+		return nil
+	}
+	return writeFileAtomic(path, data, perm)
+}
+
+// skipInDryRun logs the given operation and returns true if the operator runs in dry-run mode, in which case it must
+// not be carried out.
+func (s *Operator) skipInDryRun(description string) bool {
+	if !s.cfg.DryRun {
+		return false
+	}
+	zap.S().Infof("DRY-RUN: would %s", description)
+	return true
+}
+
+// writeFileAtomic writes the file through a temporary file, so that it is never read partially written.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmpPath, err := stageFile(path, data, perm)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	return os.Rename(tmpPath, path)
+}
+
+// writeKeyPairAtomic replaces a certificate and its key, which etcd reads on every handshake. Both are fully written to
+// temporary files before being renamed one right after the other, so that the window in which the new certificate is
+// paired with the old key is as short as possible.
+func writeKeyPairAtomic(certFile, keyFile string, certPEM, keyPEM []byte) error {
+	tmpCertFile, err := stageFile(certFile, certPEM, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpCertFile)
+
+	tmpKeyFile, err := stageFile(keyFile, keyPEM, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpKeyFile)
+
+	if err := os.Rename(tmpCertFile, certFile); err != nil {
+		return err
+	}
+	return os.Rename(tmpKeyFile, keyFile)
+}
+
+// stageFile writes the given data to a temporary file next to the given path, and returns the temporary file's path.
+func stageFile(path string, data []byte, perm os.FileMode) (string, error) {
+	tmpF, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := tmpF.Write(data); err != nil {
+		tmpF.Close()
+		os.Remove(tmpF.Name())
+		return "", err
+	}
+	if err := tmpF.Chmod(perm); err != nil {
+		tmpF.Close()
+		os.Remove(tmpF.Name())
+		return "", err
+	}
+	if err := tmpF.Close(); err != nil {
+		os.Remove(tmpF.Name())
+		return "", err
+	}
+	return tmpF.Name(), nil
+}
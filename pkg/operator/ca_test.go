@@ -0,0 +1,124 @@
+// Copyright 2017 Quentin Machu & eco authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package operator
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/quentin-m/etcd-cloud-operator/pkg/etcd"
+	"github.com/quentin-m/etcd-cloud-operator/pkg/providers/asg"
+)
+
+type testInstance struct {
+	name, address string
+}
+
+func (i testInstance) Name() string        { return i.name }
+func (i testInstance) Address() string     { return i.address }
+func (i testInstance) BindAddress() string { return "0.0.0.0" }
+
+func newTestCAOperator(t *testing.T, dryRun bool) (*Operator, string) {
+	dir := t.TempDir()
+	cfg := Config{DryRun: dryRun}
+	cfg.Etcd.InternalCA = &etcd.InternalCAConfig{
+		Enabled:  true,
+		CertFile: filepath.Join(dir, "ca", "ca.crt"),
+		KeyFile:  filepath.Join(dir, "ca", "ca.key"),
+		Dir:      filepath.Join(dir, "pki"),
+	}
+	cfg.Etcd.ApplyInternalCA()
+	if err := os.Mkdir(filepath.Join(dir, "ca"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	return &Operator{
+		cfg:     cfg,
+		caStore: &fileCAStore{certFile: cfg.Etcd.InternalCA.CertFile, keyFile: cfg.Etcd.InternalCA.KeyFile},
+	}, dir
+}
+
+func listFiles(t *testing.T, dir string) []string {
+	var files []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			files = append(files, path)
+		}
+		return err
+	})
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestEnsureCertificates(t *testing.T) {
+	s, _ := newTestCAOperator(t, false)
+	self := testInstance{name: "a", address: "10.0.0.1"}
+
+	if err := s.ensureCertificates([]asg.Instance{self}, self); err != nil {
+		t.Fatalf("failed to ensure certificates: %v", err)
+	}
+	cfg := s.cfg.Etcd.InternalCA
+	for _, f := range []string{cfg.CertFile, cfg.KeyFile, cfg.CAFile(), cfg.ServerCertFile(), cfg.ServerKeyFile(), cfg.PeerCertFile(), cfg.PeerKeyFile()} {
+		if _, err := os.Stat(f); err != nil {
+			t.Errorf("missing file %q: %v", f, err)
+		}
+	}
+
+	// The other instances wait for the CA to be created by the first one.
+	other, _ := newTestCAOperator(t, false)
+	if err := other.ensureCertificates([]asg.Instance{self, testInstance{name: "b"}}, testInstance{name: "b"}); err == nil {
+		t.Error("instance created the CA while waiting for another one")
+	}
+	if files := listFiles(t, filepath.Dir(other.cfg.Etcd.InternalCA.Dir)); len(files) != 0 {
+		t.Errorf("got files %v, want none", files)
+	}
+}
+
+func TestEnsureCertificatesDryRun(t *testing.T) {
+	self := testInstance{name: "a", address: "10.0.0.1"}
+
+	// Without a CA, nothing is created.
+	s, dir := newTestCAOperator(t, true)
+	if err := s.ensureCertificates([]asg.Instance{self}, self); err != nil {
+		t.Fatalf("failed to ensure certificates: %v", err)
+	}
+	if files := listFiles(t, dir); len(files) != 0 {
+		t.Errorf("got files %v in dry-run mode, want none", files)
+	}
+	if s.ca != nil {
+		t.Error("CA created in dry-run mode")
+	}
+
+	// An existing CA is loaded, but no certificate is issued.
+	ca, keyPEM, err := etcd.NewCA("eco")
+	if err != nil {
+		t.Fatalf("failed to create CA: %v", err)
+	}
+	if err := s.caStore.store(ca.CertPEM, keyPEM); err != nil {
+		t.Fatalf("failed to store CA: %v", err)
+	}
+	if err := s.ensureCertificates([]asg.Instance{self}, self); err != nil {
+		t.Fatalf("failed to ensure certificates: %v", err)
+	}
+	if s.ca == nil {
+		t.Error("existing CA not loaded in dry-run mode")
+	}
+	if _, err := os.Stat(s.cfg.Etcd.InternalCA.Dir); !os.IsNotExist(err) {
+		t.Error("certificates directory created in dry-run mode")
+	}
+}
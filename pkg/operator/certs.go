@@ -0,0 +1,225 @@
+// Copyright 2017 Quentin Machu & eco authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package operator
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/quentin-m/etcd-cloud-operator/pkg/etcd"
+)
+
+// certExpiryWarningInterval is the minimum time between two warnings about the same certificate expiring soon.
+const certExpiryWarningInterval = time.Hour
+
+// certFile is a certificate, key or CA file of one of the security configs, as last read by checkCertificates.
+type certFile struct {
+	config, kind, path string
+
+	sum      [sha256.Size]byte
+	notAfter time.Time
+	warned   time.Time
+}
+
+// watchedCertFiles lists the files of the etcd clients, etcd peers and status security configs.
+func (s *Operator) watchedCertFiles() []*certFile {
+	var files []*certFile
+	for _, c := range []struct {
+		name string
+		sc   etcd.SecurityConfig
+	}{
+		{"client", s.cfg.Etcd.ClientTransportSecurity},
+		{"peer", s.cfg.Etcd.PeerTransportSecurity},
+		{"status", s.cfg.StatusTransportSecurity},
+	} {
+		for kind, path := range map[string]string{"cert": c.sc.CertFile, "key": c.sc.KeyFile, "ca": c.sc.TrustedCAFile} {
+			if path != "" {
+				files = append(files, &certFile{config: c.name, kind: kind, path: path})
+			}
+		}
+	}
+	return files
+}
+
+// checkCertificates reads the certificate, key and CA files, reports their expiry, and reloads the ones that changed.
+//
+// etcd reads its certificate and key on every handshake, so renewed ones are served right away, but it only reads its
+// trusted CA when it starts. The operator's own web server and status client are rebuilt from the changed files.
+func (s *Operator) checkCertificates() {
+	changed := make(map[string]map[string]bool)
+	for _, f := range s.watchedCertFiles() {
+		data, err := ioutil.ReadFile(f.path)
+		if err != nil {
+			zap.S().With(zap.Error(err)).Warnf("failed to read %s %s file %q", f.config, f.kind, f.path)
+			continue
+		}
+
+		key := f.config + "/" + f.kind
+		previous, seen := s.certFiles[key]
+		seen = seen && previous.path == f.path
+		if seen && previous.sum == sha256.Sum256(data) {
+			f = previous
+		} else {
+			f.sum = sha256.Sum256(data)
+			if f.kind != "key" {
+				if f.notAfter, err = earliestExpiry(data); err != nil {
+					zap.S().With(zap.Error(err)).Warnf("failed to parse %s %s file %q", f.config, f.kind, f.path)
+				}
+			}
+			if seen {
+				zap.S().Infof("%s %s file %q changed", f.config, f.kind, f.path)
+				if changed[f.config] == nil {
+					changed[f.config] = make(map[string]bool)
+				}
+				changed[f.config][f.kind] = true
+			}
+			s.certFiles[key] = f
+		}
+
+		if f.notAfter.IsZero() {
+			continue
+		}
+		promSetCertificateExpiry(f.config, f.kind, f.notAfter)
+		if time.Until(f.notAfter) < s.cfg.CertificateExpiryWarning && time.Since(f.warned) > certExpiryWarningInterval {
+			zap.S().Warnf("%s %s file %q expires on %v", f.config, f.kind, f.path, f.notAfter.Format(time.RFC3339))
+			f.warned = time.Now()
+		}
+	}
+
+	for _, config := range []string{"client", "peer"} {
+		if changed[config]["cert"] || changed[config]["key"] {
+			sc := s.cfg.Etcd.ClientTransportSecurity
+			if config == "peer" {
+				sc = s.cfg.Etcd.PeerTransportSecurity
+			}
+			if _, err := tls.LoadX509KeyPair(sc.CertFile, sc.KeyFile); err != nil {
+				zap.S().With(zap.Error(err)).Errorf("the new etcd %s certificate is invalid, handshakes will fail", config)
+			} else {
+				promCertificateReloadsTotal.WithLabelValues(config).Inc()
+			}
+		}
+		if changed[config]["ca"] {
+			zap.S().Warnf("the etcd %s trusted CA file changed, it is only read when the etcd member restarts", config)
+			promCertificatePendingRestart.WithLabelValues(config).Set(1)
+		}
+	}
+
+	if len(changed["status"]) > 0 {
+		if err := s.reloadStatusTLS(); err != nil {
+			zap.S().With(zap.Error(err)).Error("failed to reload the status transport security, keeping the previous one")
+		} else {
+			zap.S().Info("reloaded the status transport security")
+			promCertificateReloadsTotal.WithLabelValues("status").Inc()
+		}
+	}
+}
+
+// started resets the pending restart of the etcd security configs if the etcd member started successfully, as it has
+// read their trusted CA files then.
+func started(err error) error {
+	if err == nil {
+		for _, config := range []string{"client", "peer"} {
+			promCertificatePendingRestart.WithLabelValues(config).Set(0)
+		}
+	}
+	return err
+}
+
+// reloadStatusTLS rebuilds the TLS configurations of the operator's web server and status client.
+func (s *Operator) reloadStatusTLS() error {
+	serverTLSConfig, err := statusServerTLSConfig(s.cfg.StatusTransportSecurity)
+	if err != nil {
+		return err
+	}
+	clientTLSConfig, err := statusClientTLSConfig(s.cfg.StatusTransportSecurity)
+	if err != nil {
+		return err
+	}
+	if serverTLSConfig == nil || clientTLSConfig == nil {
+		return errors.New("TLS is disabled")
+	}
+
+	s.statusTLS.set(serverTLSConfig)
+	s.httpClient = &http.Client{
+		Timeout:   isHealthyTimeout,
+		Transport: &http.Transport{TLSClientConfig: clientTLSConfig},
+	}
+	return nil
+}
+
+// earliestExpiry returns the earliest expiry date of the PEM-encoded certificates, which may be a CA bundle.
+func earliestExpiry(data []byte) (time.Time, error) {
+	var notAfter time.Time
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if notAfter.IsZero() || cert.NotAfter.Before(notAfter) {
+			notAfter = cert.NotAfter
+		}
+	}
+	if notAfter.IsZero() {
+		return time.Time{}, errors.New("no certificate found")
+	}
+	return notAfter, nil
+}
+
+// reloadableTLSConfig holds a TLS configuration that can be replaced while a server is using it.
+type reloadableTLSConfig struct {
+	mu     sync.RWMutex
+	config *tls.Config
+}
+
+func newReloadableTLSConfig(config *tls.Config) *reloadableTLSConfig {
+	return &reloadableTLSConfig{config: config}
+}
+
+func (r *reloadableTLSConfig) get() *tls.Config {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.config
+}
+
+func (r *reloadableTLSConfig) set(config *tls.Config) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.config = config
+}
+
+// serverConfig returns a TLS configuration handing over every handshake to the current configuration.
+func (r *reloadableTLSConfig) serverConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.get(), nil
+		},
+		// Only there for the server to know that a certificate is available, GetConfigForClient takes precedence.
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return nil, errors.New("no certificate")
+		},
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2017 Quentin Machu & eco authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package operator
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/quentin-m/etcd-cloud-operator/pkg/etcd"
+)
+
+func issueTestCertificate(t *testing.T, ca *etcd.CA, validity time.Duration) ([]byte, []byte) {
+	t.Helper()
+	certPEM, keyPEM, err := ca.Issue("eco", []string{"127.0.0.1"}, validity)
+	if err != nil {
+		t.Fatalf("failed to issue certificate: %v", err)
+	}
+	return certPEM, keyPEM
+}
+
+func TestEarliestExpiry(t *testing.T) {
+	ca, keyPEM, err := etcd.NewCA("eco")
+	if err != nil {
+		t.Fatalf("failed to create CA: %v", err)
+	}
+	shortPEM, _ := issueTestCertificate(t, ca, time.Hour)
+	short, err := earliestExpiry(shortPEM)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	bundle := append(append(append([]byte{}, ca.CertPEM...), keyPEM...), shortPEM...)
+	if got, err := earliestExpiry(bundle); err != nil || !got.Equal(short) {
+		t.Errorf("got %v, %v for a bundle, want %v", got, err, short)
+	}
+	if got, err := earliestExpiry(ca.CertPEM); err != nil || !got.Equal(ca.Cert.NotAfter) {
+		t.Errorf("got %v, %v for the CA, want %v", got, err, ca.Cert.NotAfter)
+	}
+	if _, err := earliestExpiry(keyPEM); err == nil {
+		t.Error("expected an error without any certificate")
+	}
+	if _, err := earliestExpiry([]byte("-----BEGIN CERTIFICATE-----\nZ2FyYmFnZQ==\n-----END CERTIFICATE-----\n")); err == nil {
+		t.Error("expected an error for an invalid certificate")
+	}
+}
+
+func TestCheckCertificates(t *testing.T) {
+	dir := t.TempDir()
+	ca, _, err := etcd.NewCA("eco")
+	if err != nil {
+		t.Fatalf("failed to create CA: %v", err)
+	}
+	otherCA, _, err := etcd.NewCA("other")
+	if err != nil {
+		t.Fatalf("failed to create CA: %v", err)
+	}
+
+	sc := etcd.SecurityConfig{
+		CertFile:      filepath.Join(dir, "server.crt"),
+		KeyFile:       filepath.Join(dir, "server.key"),
+		TrustedCAFile: filepath.Join(dir, "ca.crt"),
+	}
+	write := func(path string, data []byte) {
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	certPEM, keyPEM := issueTestCertificate(t, ca, time.Hour)
+	write(sc.CertFile, certPEM)
+	write(sc.KeyFile, keyPEM)
+	write(sc.TrustedCAFile, ca.CertPEM)
+
+	s := &Operator{certFiles: make(map[string]*certFile)}
+	s.cfg.Etcd.ClientTransportSecurity = sc
+
+	reloads := func() float64 { return testutil.ToFloat64(promCertificateReloadsTotal.WithLabelValues("client")) }
+	pendingRestart := func() float64 { return testutil.ToFloat64(promCertificatePendingRestart.WithLabelValues("client")) }
+	started(nil)
+	initialReloads := reloads()
+
+	// The files read for the first time are not reported as changed.
+	s.checkCertificates()
+	if got := s.certFiles["client/cert"]; got == nil || !got.notAfter.Equal(mustExpiry(t, certPEM)) {
+		t.Errorf("got certificate file %+v, want its expiry to be recorded", got)
+	}
+	if reloads() != initialReloads || pendingRestart() != 0 {
+		t.Error("files read for the first time reported as changed")
+	}
+
+	// Unchanged files are not reported either.
+	s.checkCertificates()
+	if reloads() != initialReloads || pendingRestart() != 0 {
+		t.Error("unchanged files reported as changed")
+	}
+
+	// A renewed certificate is reloaded.
+	certPEM, keyPEM = issueTestCertificate(t, ca, 2*time.Hour)
+	write(sc.CertFile, certPEM)
+	write(sc.KeyFile, keyPEM)
+	s.checkCertificates()
+	if reloads() != initialReloads+1 {
+		t.Errorf("got %v reloads, want %v", reloads(), initialReloads+1)
+	}
+	if got := s.certFiles["client/cert"]; !got.notAfter.Equal(mustExpiry(t, certPEM)) {
+		t.Errorf("got expiry %v, want the renewed certificate's", got.notAfter)
+	}
+	if pendingRestart() != 0 {
+		t.Error("renewed certificate reported as pending a restart")
+	}
+
+	// A changed trusted CA is pending a restart, until etcd starts.
+	write(sc.TrustedCAFile, otherCA.CertPEM)
+	s.checkCertificates()
+	if pendingRestart() != 1 {
+		t.Error("changed trusted CA not reported as pending a restart")
+	}
+	started(errors.New("failed to start"))
+	if pendingRestart() != 1 {
+		t.Error("pending restart reset although etcd failed to start")
+	}
+	started(nil)
+	if pendingRestart() != 0 {
+		t.Error("pending restart not reset once etcd started")
+	}
+
+	// A config pointing to other files reads them as new ones.
+	s.cfg.Etcd.ClientTransportSecurity.TrustedCAFile = filepath.Join(dir, "other-ca.crt")
+	write(s.cfg.Etcd.ClientTransportSecurity.TrustedCAFile, ca.CertPEM)
+	s.checkCertificates()
+	if pendingRestart() != 0 {
+		t.Error("newly configured trusted CA reported as changed")
+	}
+}
+
+func mustExpiry(t *testing.T, certPEM []byte) time.Time {
+	t.Helper()
+	notAfter, err := earliestExpiry(certPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return notAfter
+}
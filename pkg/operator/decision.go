@@ -0,0 +1,201 @@
+// Copyright 2017 Quentin Machu & eco authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package operator
+
+import (
+	"fmt"
+	"time"
+)
+
+const decisionHistorySize = 100
+
+const (
+	actionShutdown         = "shutdown"
+	actionTerminate        = "terminate"
+	actionJoin             = "join"
+	actionStandby          = "standby"
+	actionAwaitQuorumCheck = "await-quorum-confirmation"
+	actionStop             = "stop"
+	actionAwaitStart       = "await-start"
+	actionSeed             = "seed"
+	actionNone             = "none"
+)
+
+// decision is a structured trace of a single iteration of the operator's loop: the inputs that were considered,
+// what the peers answered, the action that was chosen, and why every other action was rejected.
+type decision struct {
+	Time          time.Time      `json:"time"`
+	Inputs        decisionInputs `json:"inputs"`
+	Peers         []peerStatus   `json:"peers"`
+	Action        string         `json:"action"`
+	Rejected      []rejection    `json:"rejected"`
+	DryRun        []string       `json:"dryRun,omitempty"`
+	Paused        []string       `json:"paused,omitempty"`
+	PreviousState string         `json:"previousState"`
+	State         string         `json:"state"`
+	Error         string         `json:"error,omitempty"`
+}
+
+type decisionInputs struct {
+	Shutdown    bool           `json:"shutdown"`
+	Terminating bool           `json:"terminating"`
+	EtcdHealthy bool           `json:"etcdHealthy"`
+	EtcdRunning bool           `json:"etcdRunning"`
+	IsSeeder    bool           `json:"isSeeder"`
+	ClusterSize int            `json:"clusterSize"`
+	Quorum      int            `json:"quorum"`
+	States      map[string]int `json:"states"`
+	Paused      bool           `json:"paused"`
+	PausedPeers int            `json:"pausedPeers"`
+}
+
+// peerStatus is the answer of an ECO instance to fetchStatus, or the error encountered while querying it.
+type peerStatus struct {
+	Name     string `json:"name"`
+	Address  string `json:"address"`
+	State    string `json:"state"`
+	Revision int64  `json:"revision"`
+	Paused   bool   `json:"paused"`
+	Error    string `json:"error,omitempty"`
+}
+
+type rejection struct {
+	Action string `json:"action"`
+	Reason string `json:"reason"`
+}
+
+// rule associates an action with the conditions that must all be met for it to be selected.
+type rule struct {
+	action     string
+	conditions []condition
+}
+
+type condition struct {
+	description string
+	met         bool
+}
+
+// rules returns the operator's actions in order of precedence, along with their conditions evaluated against the
+// current state.
+func (s *Operator) rules() []rule {
+	quorum := s.clusterSize/2 + 1
+	allStarting := fmt.Sprintf("all %d instances ready to start", s.clusterSize)
+	hasQuorum := fmt.Sprintf("at least %d instances OK", quorum)
+
+	return []rule{
+		{actionShutdown, []condition{
+			{"received SIGTERM", s.shutdown},
+		}},
+		{actionTerminate, []condition{
+			{"instance terminating", s.terminating},
+		}},
+		{actionJoin, []condition{
+			{"etcd healthy", s.etcdHealthy},
+			{"etcd not running", !s.etcdRunning},
+		}},
+		{actionStandby, []condition{
+			{"etcd healthy", s.etcdHealthy},
+			{"etcd running", s.etcdRunning},
+		}},
+		{actionAwaitQuorumCheck, []condition{
+			{"etcd unhealthy", !s.etcdHealthy},
+			{"etcd running", s.etcdRunning},
+			{hasQuorum, s.states["OK"] >= quorum},
+		}},
+		{actionStop, []condition{
+			{"etcd unhealthy", !s.etcdHealthy},
+			{"etcd running", s.etcdRunning},
+			{"fewer than " + hasQuorum, s.states["OK"] < quorum},
+		}},
+		{actionAwaitStart, []condition{
+			{"etcd unhealthy", !s.etcdHealthy},
+			{"etcd not running", !s.etcdRunning},
+			{"not " + allStarting + " or not seeder", s.states["START"] != s.clusterSize || !s.isSeeder},
+		}},
+		{actionSeed, []condition{
+			{"etcd unhealthy", !s.etcdHealthy},
+			{"etcd not running", !s.etcdRunning},
+			{allStarting, s.states["START"] == s.clusterSize},
+			{"seeder", s.isSeeder},
+		}},
+	}
+}
+
+// decide selects the first action whose conditions are all met, and records why the others were rejected.
+func (s *Operator) decide() *decision {
+	d := &decision{
+		Time: time.Now(),
+		Inputs: decisionInputs{
+			Shutdown:    s.shutdown,
+			Terminating: s.terminating,
+			EtcdHealthy: s.etcdHealthy,
+			EtcdRunning: s.etcdRunning,
+			IsSeeder:    s.isSeeder,
+			ClusterSize: s.clusterSize,
+			Quorum:      s.clusterSize/2 + 1,
+			States:      s.states,
+			Paused:      s.isPaused(),
+			PausedPeers: s.pausedPeers,
+		},
+		Peers:         s.peers,
+		Action:        actionNone,
+		PreviousState: s.state,
+	}
+
+	for _, r := range s.rules() {
+		if d.Action != actionNone {
+			d.Rejected = append(d.Rejected, rejection{Action: r.action, Reason: "preceded by " + d.Action})
+			continue
+		}
+
+		var unmet []string
+		for _, c := range r.conditions {
+			if !c.met {
+				unmet = append(unmet, c.description)
+			}
+		}
+		if len(unmet) > 0 {
+			d.Rejected = append(d.Rejected, rejection{Action: r.action, Reason: fmt.Sprintf("unmet: %v", unmet)})
+			continue
+		}
+		d.Action = r.action
+	}
+
+	return d
+}
+
+// recordDecision completes the given decision with its outcome, and appends it to the bounded history.
+func (s *Operator) recordDecision(d *decision, err error) {
+	d.State = s.state
+	if err != nil {
+		d.Error = err.Error()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.decisions = append(s.decisions, d)
+	if len(s.decisions) > decisionHistorySize {
+		s.decisions = s.decisions[len(s.decisions)-decisionHistorySize:]
+	}
+}
+
+// decisionHistory returns a copy of the recorded decisions, from oldest to newest.
+func (s *Operator) decisionHistory() []*decision {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]*decision(nil), s.decisions...)
+}
@@ -0,0 +1,40 @@
+// Copyright 2017 Quentin Machu & eco authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package operator
+
+import "testing"
+
+func TestDecideSeed(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		clusterSize int
+		starting    int
+		isSeeder    bool
+		want        string
+	}{
+		{name: "all instances ready", clusterSize: 3, starting: 3, isSeeder: true, want: actionSeed},
+		// E.g. an instance waiting on a launch lifecycle hook, which the provider leaves out of the size.
+		{name: "instance left out of the size", clusterSize: 2, starting: 2, isSeeder: true, want: actionSeed},
+		{name: "instance missing", clusterSize: 3, starting: 2, isSeeder: true, want: actionAwaitStart},
+		{name: "not seeder", clusterSize: 3, starting: 3, want: actionAwaitStart},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &Operator{clusterSize: tc.clusterSize, isSeeder: tc.isSeeder, states: map[string]int{"START": tc.starting}}
+			if d := s.decide(); d.Action != tc.want {
+				t.Errorf("got action %s, want %s (rejected: %v)", d.Action, tc.want, d.Rejected)
+			}
+		})
+	}
+}
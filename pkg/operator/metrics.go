@@ -0,0 +1,268 @@
+// Copyright 2017 Quentin Machu & eco authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package operator
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const promNamespace = "eco"
+
+var (
+	promRegisterOnce sync.Once
+
+	// knownStates lists the states an ECO instance can report, so that the
+	// state gauges can be reset when the state changes.
+	knownStates = []string{"OK", "PENDING", "START", "UNKNOWN"}
+
+	promState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: promNamespace,
+			Name:      "state",
+			Help:      "The current state of the operator (1 for the current state, 0 otherwise)",
+		},
+		[]string{"state"},
+	)
+	promStateTransitionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: promNamespace,
+			Name:      "state_transitions_total",
+			Help:      "Number of state transitions of the operator",
+		},
+		[]string{"from", "to"},
+	)
+	promIsSeeder = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: promNamespace,
+			Name:      "is_seeder",
+			Help:      "Whether this instance is currently elected as the seeder",
+		},
+	)
+	promPeerStates = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: promNamespace,
+			Name:      "peer_states",
+			Help:      "Number of ECO instances reporting each state, as observed by this instance",
+		},
+		[]string{"state"},
+	)
+	promASGSize = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: promNamespace,
+			Name:      "asg_size",
+			Help:      "The desired size of the auto-scaling group",
+		},
+	)
+	promASGInstances = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: promNamespace,
+			Name:      "asg_instances",
+			Help:      "Number of instances discovered in the auto-scaling group",
+		},
+	)
+	promCertificateExpiry = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: promNamespace,
+			Name:      "certificate_expiry_timestamp_seconds",
+			Help:      "The expiry date of the earliest expiring certificate of each security config's cert and ca files",
+		},
+		[]string{"config", "file"},
+	)
+	promCertificateReloadsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: promNamespace,
+			Name:      "certificate_reloads_total",
+			Help:      "Number of times the certificates of each security config have been reloaded",
+		},
+		[]string{"config"},
+	)
+	promCertificatePendingRestart = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: promNamespace,
+			Name:      "certificate_pending_restart",
+			Help:      "Whether the trusted CA of each etcd security config changed, which etcd only reads when restarted",
+		},
+		[]string{"config"},
+	)
+	promPaused = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: promNamespace,
+			Name:      "paused",
+			Help:      "Whether this instance is paused, either locally or for the whole cluster",
+		},
+	)
+	promConfigReloadsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: promNamespace,
+			Name:      "config_reloads_total",
+			Help:      "Number of configuration reloads, by result (success, failure)",
+		},
+		[]string{"result"},
+	)
+	promConfigPendingRestart = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: promNamespace,
+			Name:      "config_pending_restart",
+			Help:      "Number of reloaded settings that require a restart to be applied",
+		},
+	)
+	promACLAuditsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: promNamespace,
+			Name:      "acl_audits_total",
+			Help:      "Number of audits of the etcd auth state against the initial ACL config, by result (success, failure)",
+		},
+		[]string{"result"},
+	)
+	promACLAuditFailed = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: promNamespace,
+			Name:      "acl_audit_failed",
+			Help:      "Whether the last audit of the etcd auth state failed, in which case acl_drift is not exported",
+		},
+	)
+	promACLDrift = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: promNamespace,
+			Name:      "acl_drift",
+			Help:      "Number of differences between the etcd auth state and the initial ACL config found by the last audit, by kind",
+		},
+		[]string{"kind"},
+	)
+	promACLDriftCorrectionsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: promNamespace,
+			Name:      "acl_drift_corrections_total",
+			Help:      "Number of times the ACL drift has been corrected",
+		},
+	)
+	promEvaluateDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: promNamespace,
+			Name:      "evaluate_duration_seconds",
+			Help:      "Time taken to evaluate the cluster state",
+			Buckets:   prometheus.ExponentialBuckets(0.05, 2, 12),
+		},
+	)
+	promExecuteDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: promNamespace,
+			Name:      "execute_duration_seconds",
+			Help:      "Time taken to execute the selected action",
+			Buckets:   prometheus.ExponentialBuckets(0.05, 2, 12),
+		},
+	)
+)
+
+func promRegister() {
+	promRegisterOnce.Do(func() {
+		prometheus.MustRegister(promState)
+		prometheus.MustRegister(promStateTransitionsTotal)
+		prometheus.MustRegister(promIsSeeder)
+		prometheus.MustRegister(promPeerStates)
+		prometheus.MustRegister(promASGSize)
+		prometheus.MustRegister(promASGInstances)
+		prometheus.MustRegister(promPaused)
+		prometheus.MustRegister(promCertificateExpiry)
+		prometheus.MustRegister(promCertificateReloadsTotal)
+		prometheus.MustRegister(promCertificatePendingRestart)
+		prometheus.MustRegister(promConfigReloadsTotal)
+		prometheus.MustRegister(promConfigPendingRestart)
+		prometheus.MustRegister(promACLAuditsTotal)
+		prometheus.MustRegister(promACLAuditFailed)
+		prometheus.MustRegister(promACLDrift)
+		prometheus.MustRegister(promACLDriftCorrectionsTotal)
+		prometheus.MustRegister(promEvaluateDuration)
+		prometheus.MustRegister(promExecuteDuration)
+	})
+}
+
+func promSetState(from, to string) {
+	for _, state := range knownStates {
+		promState.WithLabelValues(state).Set(0)
+	}
+	promState.WithLabelValues(to).Set(1)
+
+	if from != to {
+		promStateTransitionsTotal.WithLabelValues(from, to).Inc()
+	}
+}
+
+func promSetEvaluation(isSeeder bool, states map[string]int, asgSize, asgInstances int) {
+	if isSeeder {
+		promIsSeeder.Set(1)
+	} else {
+		promIsSeeder.Set(0)
+	}
+
+	for _, state := range knownStates {
+		promPeerStates.WithLabelValues(state).Set(float64(states[state]))
+	}
+
+	promASGSize.Set(float64(asgSize))
+	promASGInstances.Set(float64(asgInstances))
+}
+
+func promSetPaused(paused bool) {
+	if paused {
+		promPaused.Set(1)
+	} else {
+		promPaused.Set(0)
+	}
+}
+
+func promSetReload(status *reloadStatus) {
+	if status.Error != "" {
+		promConfigReloadsTotal.WithLabelValues("failure").Inc()
+		return
+	}
+	promConfigReloadsTotal.WithLabelValues("success").Inc()
+	promConfigPendingRestart.Set(float64(len(status.PendingRestart)))
+}
+
+func promSetACLDrift(drift *aclDrift) {
+	if drift.Error != "" {
+		// The drift found by the previous audit may have been corrected since, or have grown.
+		promACLAuditsTotal.WithLabelValues("failure").Inc()
+		promACLAuditFailed.Set(1)
+		promACLDrift.Reset()
+		return
+	}
+	promACLAuditFailed.Set(0)
+	if !drift.Time.IsZero() {
+		promACLAuditsTotal.WithLabelValues("success").Inc()
+	}
+	if drift.Corrected {
+		promACLDriftCorrectionsTotal.Inc()
+	}
+
+	promACLDrift.WithLabelValues("unmanaged_users").Set(float64(len(drift.UnmanagedUsers)))
+	promACLDrift.WithLabelValues("unmanaged_roles").Set(float64(len(drift.UnmanagedRoles)))
+	promACLDrift.WithLabelValues("missing_users").Set(float64(len(drift.MissingUsers)))
+	promACLDrift.WithLabelValues("missing_roles").Set(float64(len(drift.MissingRoles)))
+	promACLDrift.WithLabelValues("missing_grants").Set(float64(len(drift.MissingGrants)))
+	promACLDrift.WithLabelValues("extra_permissions").Set(float64(len(drift.ExtraPermissions)))
+}
+
+func promObserveDuration(h prometheus.Histogram, t time.Time) {
+	h.Observe(time.Since(t).Seconds())
+}
+
+func promSetCertificateExpiry(config, file string, notAfter time.Time) {
+	promCertificateExpiry.WithLabelValues(config, file).Set(float64(notAfter.Unix()))
+}
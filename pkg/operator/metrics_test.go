@@ -0,0 +1,46 @@
+// Copyright 2017 Quentin Machu & eco authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package operator
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPromSetACLDriftFailure(t *testing.T) {
+	promSetACLDrift(&aclDrift{Time: time.Now(), MissingUsers: []string{"alice"}})
+	if got := testutil.ToFloat64(promACLDrift.WithLabelValues("missing_users")); got != 1 {
+		t.Errorf("got %v missing users, want 1", got)
+	}
+
+	// A failed audit must not leave the previous drift exported, nor look like no drift at all.
+	promSetACLDrift(&aclDrift{Time: time.Now(), Error: "etcdserver: request timed out"})
+	if got := testutil.CollectAndCount(promACLDrift); got != 0 {
+		t.Errorf("got %d drift series after a failed audit, want none", got)
+	}
+	if got := testutil.ToFloat64(promACLAuditFailed); got != 1 {
+		t.Errorf("got audit failed %v, want 1", got)
+	}
+
+	promSetACLDrift(&aclDrift{Time: time.Now()})
+	if got := testutil.ToFloat64(promACLAuditFailed); got != 0 {
+		t.Errorf("got audit failed %v after a successful audit, want 0", got)
+	}
+	if got := testutil.ToFloat64(promACLDrift.WithLabelValues("missing_users")); got != 0 {
+		t.Errorf("got %v missing users, want 0", got)
+	}
+}
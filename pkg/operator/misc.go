@@ -40,6 +40,7 @@ type status struct {
 
 	State    string `json:"state"`
 	Revision int64  `json:"revision"`
+	Paused   bool   `json:"paused"`
 }
 
 func initProviders(cfg Config) (asg.Provider, snapshot.Provider) {
@@ -68,7 +69,7 @@ func initProviders(cfg Config) (asg.Provider, snapshot.Provider) {
 	return asgProvider, snapshotProvider
 }
 
-func fetchStatuses(httpClient *http.Client, etcdClient *etcd.Client, asgInstances []asg.Instance, asgSelf asg.Instance) (bool, bool, map[string]int) {
+func fetchStatuses(httpClient *http.Client, statusScheme string, clusterPorts asg.Ports, etcdClient *etcd.Client, asgInstances []asg.Instance, asgSelf asg.Instance) (bool, bool, map[string]int, []peerStatus) {
 	var wg sync.WaitGroup
 	var mu sync.Mutex
 	wg.Add(1 + len(asgInstances))
@@ -82,24 +83,32 @@ func fetchStatuses(httpClient *http.Client, etcdClient *etcd.Client, asgInstance
 
 	// Fetch ECO statuses.
 	var ecoStatuses []*status
+	var peers []peerStatus
 	for _, asgInstance := range asgInstances {
 		go func(asgInstance asg.Instance) {
 			defer wg.Done()
 
-			st, err := fetchStatus(httpClient, asgInstance)
-			if err != nil {
-				zap.S().With(zap.Error(err)).Warnf("failed to query %s", asgInstance.Name())
-				return
-			}
+			st, err := fetchStatus(httpClient, statusScheme, asg.InstancePorts(asgInstance, clusterPorts), asgInstance)
 
 			mu.Lock()
 			defer mu.Unlock()
 
-			ecoStatuses = append(ecoStatuses, st)
+			peer := peerStatus{Name: asgInstance.Name(), Address: asgInstance.Address(), State: st.State, Revision: st.Revision, Paused: st.Paused}
+			if err != nil {
+				zap.S().With(zap.Error(err)).Warnf("failed to query %s", asgInstance.Name())
+				peer.Error = err.Error()
+			} else {
+				ecoStatuses = append(ecoStatuses, st)
+			}
+			peers = append(peers, peer)
 		}(asgInstance)
 	}
 	wg.Wait()
 
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Name < peers[j].Name
+	})
+
 	// Sort the ECO statuses so we can systematically find the identity of the seeder.
 	sort.Slice(ecoStatuses, func(i, j int) bool {
 		if ecoStatuses[i].Revision == ecoStatuses[j].Revision {
@@ -117,17 +126,18 @@ func fetchStatuses(httpClient *http.Client, etcdClient *etcd.Client, asgInstance
 		ecoStates[ecoStatus.State]++
 	}
 
-	return etcdHealthy, ecoStatuses[len(ecoStatuses)-1].instance.Name() == asgSelf.Name(), ecoStates
+	isSeeder := len(ecoStatuses) > 0 && ecoStatuses[len(ecoStatuses)-1].instance.Name() == asgSelf.Name()
+	return etcdHealthy, isSeeder, ecoStates, peers
 }
 
-func fetchStatus(httpClient *http.Client, instance asg.Instance) (*status, error) {
+func fetchStatus(httpClient *http.Client, statusScheme string, ports asg.Ports, instance asg.Instance) (*status, error) {
 	var st = status{
 		instance: instance,
 		State:    "UNKNOWN",
 		Revision: 0,
 	}
 
-	resp, err := httpClient.Get(fmt.Sprintf("http://%s:%d/status", instance.Address(), webServerPort))
+	resp, err := httpClient.Get(fmt.Sprintf("%s://%s/status", statusScheme, etcd.JoinHostPort(instance.Address(), ports.Status)))
 	if err != nil {
 		return &st, err
 	}
@@ -143,6 +153,7 @@ func fetchStatus(httpClient *http.Client, instance asg.Instance) (*status, error
 }
 
 func serverConfig(cfg Config, asgSelf asg.Instance, snapshotProvider snapshot.Provider) etcd.ServerConfig {
+	ports := asg.InstancePorts(asgSelf, cfg.Ports)
 	return etcd.ServerConfig{
 		Name:                    asgSelf.Name(),
 		DataDir:                 cfg.Etcd.DataDir,
@@ -152,20 +163,25 @@ func serverConfig(cfg Config, asgSelf asg.Instance, snapshotProvider snapshot.Pr
 		BindAddress:             asgSelf.BindAddress(),
 		PublicAddress:           stringOverride(asgSelf.Address(), cfg.Etcd.AdvertiseAddress),
 		PrivateAddress:          asgSelf.Address(),
+		ClientPort:              ports.Client,
+		PeerPort:                ports.Peer,
+		MetricsPort:             ports.Metrics,
 		ClientSC:                cfg.Etcd.ClientTransportSecurity,
 		PeerSC:                  cfg.Etcd.PeerTransportSecurity,
 		UnhealthyMemberTTL:      cfg.UnhealthyMemberTTL,
 		SnapshotProvider:        snapshotProvider,
+		SnapshotProviderName:    cfg.Snapshot.Provider,
 		SnapshotInterval:        cfg.Snapshot.Interval,
 		SnapshotTTL:             cfg.Snapshot.TTL,
 		JWTAuthTokenConfig:      cfg.Etcd.JWTAuthTokenConfig,
 		MaxRequestBytes:         cfg.Etcd.MaxRequestBytes,
+		LearnerPromotionTimeout: cfg.Etcd.LearnerPromotionTimeout,
 	}
 }
 
-func instancesAddresses(instances []asg.Instance) (addresses []string) {
+func instancesEndpoints(instances []asg.Instance, clusterPorts asg.Ports) (endpoints []string) {
 	for _, instance := range instances {
-		addresses = append(addresses, instance.Address())
+		endpoints = append(endpoints, etcd.JoinHostPort(instance.Address(), asg.InstancePorts(instance, clusterPorts).Client))
 	}
 	return
 }
@@ -16,14 +16,15 @@ package operator
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
 
 	"github.com/quentin-m/etcd-cloud-operator/pkg/etcd"
@@ -34,22 +35,41 @@ import (
 const (
 	loopInterval = 15 * time.Second
 
-	webServerPort = 2378
+	defaultStatusPort = 2378
 )
 
+// defaultPorts are the ports used by the instances when the configuration does not set them.
+var defaultPorts = asg.Ports{
+	Client:  etcd.DefaultClientPort,
+	Peer:    etcd.DefaultPeerPort,
+	Metrics: etcd.DefaultMetricsPort,
+	Status:  defaultStatusPort,
+}
+
 type Operator struct {
-	server *etcd.Server
+	// The etcd server is created, started and stopped by the main loop, and used by the admin API concurrently:
+	// serverMu is held while doing any of it, rather than mu, which must not be held while etcd starts or stops.
+	serverMu sync.Mutex
+	server   *etcd.Server
 
 	// New()
 	cfg              Config
 	asgProvider      asg.Provider
 	snapshotProvider snapshot.Provider
+	caStore          caStore
 
-	httpClient *http.Client
+	httpClient   *http.Client
+	statusScheme string
+	statusTLS    *reloadableTLSConfig
 
 	shutdownChan chan os.Signal
 	shutdown     bool
-	ticker       *time.Ticker
+	// Set once the instance has departed on SIGTERM, for Run to exit after the decision is recorded.
+	departed bool
+	ticker   *time.Ticker
+
+	loader     ConfigLoader
+	reloadChan chan os.Signal
 
 	// evaluate()
 	etcdHealthy bool
@@ -57,25 +77,78 @@ type Operator struct {
 
 	etcdClient   *etcd.Client
 	etcdSnapshot *snapshot.Metadata
+	ca           *etcd.CA
+	certFiles    map[string]*certFile
 
 	state  string
 	states map[string]int
+	peers  []peerStatus
 
 	isSeeder    bool
 	clusterSize int
+	terminating bool
+
+	// execute()
+	terminationCompleted bool
+	lastACLAudit         time.Time
+	appliedACL           *etcd.ACLConfig
+	appliedACLRevision   int64
+
+	// Exposed through the admin API.
+	mu            sync.RWMutex
+	evaluation    *evaluation
+	decisions     []*decision
+	localPaused   bool
+	clusterPaused bool
+	pausedPeers   int
+	reloadStatus  *reloadStatus
+	aclDrift      *aclDrift
 }
 
 // Config is the global configuration for an instance of ECO.
 type Config struct {
-	CheckInterval        time.Duration `yaml:"check-interval"`
-	UnhealthyMemberTTL 	 time.Duration `yaml:"unhealthy-member-ttl"`
+	CheckInterval      time.Duration `yaml:"check-interval"`
+	UnhealthyMemberTTL time.Duration `yaml:"unhealthy-member-ttl"`
+
+	// LogLevel overrides the logging level given on the command-line, it can be changed by reloading the
+	// configuration.
+	LogLevel string `yaml:"log-level"`
+
+	// ScaleInMemberRemoval makes an instance that is being stopped remove itself from the etcd cluster, if the
+	// auto-scaling group has been scaled in, rather than waiting for the other members to clean it up.
+	ScaleInMemberRemoval bool `yaml:"scale-in-member-removal"`
+
+	// DryRun makes the operator evaluate the cluster and select actions as usual, without ever carrying them out.
+	DryRun bool `yaml:"dry-run"`
+
+	// CertificateExpiryWarning is how long before their expiry the certificates in use start being warned about.
+	CertificateExpiryWarning time.Duration `yaml:"certificate-expiry-warning"`
+
+	// Ports are the ports the instances serve etcd and the operator on, which the auto-scaling group provider may
+	// override per instance.
+	Ports asg.Ports `yaml:"ports"`
 
 	Etcd     etcd.EtcdConfiguration `yaml:"etcd"`
 	ASG      asg.Config             `yaml:"asg"`
 	Snapshot snapshot.Config        `yaml:"snapshot"`
+
+	// ACLAudit configures the periodic detection of the changes made by hand to the etcd auth state, that diverge from
+	// the initial ACL config.
+	ACLAudit ACLAuditConfig `yaml:"acl-audit"`
+
+	// StatusTransportSecurity is the TLS configuration of the operator's web server (status, admin API and
+	// metrics), and of the client used to query the status of the other ECO instances.
+	StatusTransportSecurity etcd.SecurityConfig `yaml:"status-transport-security"`
 }
 
-func New(cfg Config) *Operator {
+// New creates an operator from the given configuration. If a loader is given, the configuration is reloaded with it
+// upon SIGHUP.
+func New(cfg Config, loader ConfigLoader) *Operator {
+	cfg.Ports = cfg.Ports.WithDefaults(defaultPorts)
+	if err := validatePorts(cfg.Ports); err != nil {
+		zap.S().With(zap.Error(err)).Fatal("invalid ports configuration")
+	}
+
 	// Initialize providers.
 	asgProvider, snapshotProvider := initProviders(cfg)
 	if snapshotProvider == nil || cfg.Snapshot.Interval == 0 {
@@ -86,19 +159,70 @@ func New(cfg Config) *Operator {
 	shutdownChan := make(chan os.Signal, 1)
 	signal.Notify(shutdownChan, syscall.SIGTERM)
 
+	reloadChan := make(chan os.Signal, 1)
+	if loader != nil {
+		signal.Notify(reloadChan, syscall.SIGHUP)
+	}
+
+	// Setup the status server and client's TLS configurations.
+	serverTLSConfig, err := statusServerTLSConfig(cfg.StatusTransportSecurity)
+	if err != nil {
+		zap.S().With(zap.Error(err)).Fatal("failed to read status server transport security")
+	}
+	clientTLSConfig, err := statusClientTLSConfig(cfg.StatusTransportSecurity)
+	if err != nil {
+		zap.S().With(zap.Error(err)).Fatal("failed to read status client transport security")
+	}
+
+	var statusTLS *reloadableTLSConfig
+	if serverTLSConfig != nil {
+		statusTLS = newReloadableTLSConfig(serverTLSConfig)
+	}
+
+	// Setup the internal CA's store.
+	var caStore caStore
+	if cfg.Etcd.InternalCA != nil && cfg.Etcd.InternalCA.Enabled {
+		if caStore, err = newCAStore(cfg.Etcd.InternalCA, snapshotProvider); err != nil {
+			zap.S().With(zap.Error(err)).Fatal("failed to setup the internal CA")
+		}
+	}
+
+	if cfg.DryRun {
+		zap.S().Warn("running in dry-run mode, no action will be carried out")
+	}
+
+	// Register metrics.
+	promRegister()
+
 	return &Operator{
 		cfg:              cfg,
 		asgProvider:      asgProvider,
 		snapshotProvider: snapshotProvider,
-		httpClient:       &http.Client{Timeout: isHealthyTimeout},
-		state:            "UNKNOWN",
-		ticker:           time.NewTicker(cfg.CheckInterval),
-		shutdownChan:     shutdownChan,
+		caStore:          caStore,
+		httpClient: &http.Client{
+			Timeout:   isHealthyTimeout,
+			Transport: &http.Transport{TLSClientConfig: clientTLSConfig},
+		},
+		statusScheme: scheme(clientTLSConfig),
+		statusTLS:    statusTLS,
+		certFiles:    make(map[string]*certFile),
+		state:        "UNKNOWN",
+		ticker:       time.NewTicker(cfg.CheckInterval),
+		shutdownChan: shutdownChan,
+		loader:       loader,
+		reloadChan:   reloadChan,
 	}
 }
 
 func (s *Operator) Run() {
-	go s.webserver()
+	// The web server is started right away, so that the metrics and the admin API are served even while the
+	// auto-scaling group can not be evaluated. The per-instance ports are only used to reach the peers, unless the
+	// provider overrides the local instance's ones.
+	statusPort := s.cfg.Ports.Status
+	if portsProvider, ok := s.asgProvider.(asg.PortsProvider); ok {
+		statusPort = portsProvider.SelfPorts().WithDefaults(s.cfg.Ports).Status
+	}
+	go s.webserver(statusPort)
 
 	for {
 		if err := s.evaluate(); err != nil {
@@ -109,79 +233,130 @@ func (s *Operator) Run() {
 		if err := s.execute(); err != nil {
 			zap.S().With(zap.Error(err)).Warn("could not execute action")
 		}
+		if s.departed {
+			os.Exit(0)
+		}
 		s.wait()
 	}
 }
 
 func (s *Operator) evaluate() error {
+	defer promObserveDuration(promEvaluateDuration, time.Now())
+
 	// Fetch the auto-scaling group state.
 	asgInstances, asgSelf, asgSize, err := s.asgProvider.AutoScalingGroupStatus()
 	if err != nil {
 		return fmt.Errorf("failed to sync auto-scaling group: %v", err)
 	}
 
+	// Issue or renew the certificates of the internal CA, which the etcd clients and server below rely on.
+	if err := s.ensureCertificates(asgInstances, asgSelf); err != nil {
+		return fmt.Errorf("failed to ensure the internal CA's certificates: %v", err)
+	}
+	s.checkCertificates()
+
 	// Create the etcd cluster client.
-	client, err := etcd.NewClient(instancesAddresses(asgInstances), s.cfg.Etcd.ClientTransportSecurity, true)
+	client, err := etcd.NewClient(instancesEndpoints(asgInstances, s.cfg.Ports), s.cfg.Etcd.ClientTransportSecurity, true)
 	if err != nil {
 		zap.S().With(zap.Error(err)).Warn("failed to create etcd cluster client")
 	}
 
 	// Output.
+	s.serverMu.Lock()
 	if s.server == nil {
 		s.server = etcd.NewServer(serverConfig(s.cfg, asgSelf, s.snapshotProvider))
 	}
+	s.serverMu.Unlock()
 
 	s.etcdRunning = s.server.IsRunning()
-	s.etcdHealthy, s.isSeeder, s.states = fetchStatuses(s.httpClient, client, asgInstances, asgSelf)
+	s.etcdHealthy, s.isSeeder, s.states, s.peers = fetchStatuses(s.httpClient, s.statusScheme, s.cfg.Ports, client, asgInstances, asgSelf)
 	s.clusterSize = asgSize
+	if lifecycleProvider, ok := s.asgProvider.(asg.LifecycleProvider); ok {
+		s.terminating = lifecycleProvider.IsTerminating()
+	}
+
+	// Determine whether we, the cluster, or any of our peers are paused.
+	s.setPausedPeers(s.peers)
+	s.syncClusterPaused(client)
+	s.server.SetPaused(s.isFrozen())
+
+	promSetEvaluation(s.isSeeder, s.states, asgSize, len(asgInstances))
+	promSetPaused(s.isPaused())
+	s.setEvaluation(asgInstances, asgSelf)
 
 	s.etcdClient = client
 	return nil
 }
 
-func (s *Operator) execute() error {
+func (s *Operator) execute() (err error) {
+	s.serverMu.Lock()
+	defer s.serverMu.Unlock()
+
+	t, previousState := time.Now(), s.state
+	d := s.decide()
 	defer func() {
 		if s.etcdClient != nil {
 			s.etcdClient.Close()
 		}
+		s.recordDecision(d, err)
+		promSetState(previousState, s.state)
+		promObserveDuration(promExecuteDuration, t)
 	}()
 
-	switch {
+	switch d.Action {
 	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
-	case s.shutdown:
-		zap.S().Info("STATUS: Received SIGTERM -> Snapshot + Stop")
+	case actionShutdown:
+		zap.S().Info("STATUS: Received SIGTERM -> Transfer leadership + Snapshot + Stop")
 		s.state = "PENDING"
 
-		s.server.Stop(s.etcdHealthy, true)
-		os.Exit(0)
+		s.depart(d, s.cfg.ScaleInMemberRemoval, s.clusterSize)
+		s.departed = true
+		return nil
+	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+	case actionTerminate:
+		zap.S().Info("STATUS: Terminating -> Transfer leadership + Snapshot + Stop + Leave + Complete termination")
+		s.state = "PENDING"
+
+		if s.terminationCompleted {
+			break
+		}
+		// The instance is going away for good, leave regardless of the desired size of the auto-scaling group.
+		s.depart(d, true, 0)
+
+		if err := s.perform(d, "complete the termination of the instance", s.asgProvider.(asg.LifecycleProvider).CompleteTermination); err != nil {
+			return err
+		}
+		s.terminationCompleted = true
 	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
-	case s.etcdHealthy && !s.etcdRunning:
+	case actionJoin:
 		zap.S().Info("STATUS: Healthy + Not running -> Join")
 		s.state = "PENDING"
 
-		if err := s.server.Join(s.etcdClient); err != nil {
+		if err := s.performUnlessFrozen(d, "join the cluster", func() error { return started(s.server.Join(s.etcdClient)) }); err != nil {
 			zap.S().With(zap.Error(err)).Error("failed to join the cluster")
 		}
 	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
-	case s.etcdHealthy && s.etcdRunning:
+	case actionStandby:
 		zap.S().Info("STATUS: Healthy + Running -> Standby")
 		s.state = "OK"
 	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
-	case !s.etcdHealthy && s.etcdRunning && s.states["OK"] >= s.clusterSize/2+1:
+	case actionAwaitQuorumCheck:
 		zap.S().Info("STATUS: Unhealthy + Running -> Pending confirmation from other ECO instances")
 		s.state = "PENDING"
-	case !s.etcdHealthy && s.etcdRunning && s.states["OK"] < s.clusterSize/2+1:
+	case actionStop:
 		zap.S().Info("STATUS: Unhealthy + Running + No quorum -> Snapshot + Stop")
 		s.state = "PENDING"
 
-		s.server.Stop(false, true)
+		s.performUnlessFrozen(d, "snapshot and stop etcd", func() error {
+			s.server.Stop(false, true)
+			return nil
+		})
 	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
-	case !s.etcdHealthy && !s.etcdRunning && (s.states["START"] != s.clusterSize || !s.isSeeder):
+	case actionAwaitStart:
 		if s.state != "START" {
-			var err error
 			if s.etcdSnapshot, err = s.server.SnapshotInfo(); err != nil && err != snapshot.ErrNoSnapshot {
 				return err
 			}
@@ -189,34 +364,72 @@ func (s *Operator) execute() error {
 		zap.S().Info("STATUS: Unhealthy + Not running -> Ready to start + Pending all ready / seeder")
 		s.state = "START"
 	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
-	case !s.etcdHealthy && !s.etcdRunning && s.states["START"] == s.clusterSize && s.isSeeder:
+	case actionSeed:
 		zap.S().Info("STATUS: Unhealthy + Not running + All ready + Seeder status -> Seeding cluster")
 		s.state = "START"
 
-		if err := s.server.Seed(s.etcdSnapshot); err != nil {
+		if err := s.performUnlessFrozen(d, "seed the cluster", func() error { return started(s.server.Seed(s.etcdSnapshot)) }); err != nil {
 			zap.S().With(zap.Error(err)).Error("failed to seed the cluster")
 		}
 	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 	default:
 		s.state = "UNKNOWN"
-		return errors.New("no adequate action found")
+		return fmt.Errorf("no adequate action found: %v", d.Rejected)
 		////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 	}
 
 	if s.state == "OK" && s.isSeeder && s.cfg.Etcd.InitACL != nil {
-		if err := s.reconcileInitACLConfig(s.cfg.Etcd.InitACL); err != nil {
+		if err := s.performUnlessFrozen(d, "reconcile the initial ACL config", func() error { return s.reconcileInitACLConfig(s.cfg.Etcd.InitACL) }); err != nil {
 			zap.S().With(zap.Error(err)).Error("failed to reconcile initial ACL config")
 			return err
 		}
+		s.auditACL(d, s.cfg.Etcd.InitACL)
+	} else {
+		s.resetACLDrift()
 	}
 
 	return nil
 }
 
-func (s *Operator) webserver() {
+// depart transfers the leadership away, snapshots and stops etcd, and if requested, removes the local member from the
+// cluster when it has more voting members than the given desired size.
+func (s *Operator) depart(d *decision, leave bool, desiredSize int) {
+	if s.etcdHealthy {
+		if err := s.perform(d, "transfer the leadership", s.server.TransferLeadership); err != nil {
+			zap.S().With(zap.Error(err)).Warn("failed to transfer leadership before stopping")
+		}
+	}
+	s.perform(d, "snapshot and stop etcd", func() error {
+		s.server.Stop(s.etcdHealthy, true)
+		return nil
+	})
+
+	if s.etcdHealthy && leave {
+		err := s.perform(d, "remove the local member from the cluster", func() error {
+			_, err := s.server.Leave(s.etcdClient, desiredSize)
+			return err
+		})
+		if err != nil {
+			zap.S().With(zap.Error(err)).Warn("failed to remove ourselves from the cluster")
+		}
+	}
+}
+
+// perform executes the given disruptive operation, unless the operator runs in dry-run mode, in which case the operation
+// is only logged and recorded in the decision.
+func (s *Operator) perform(d *decision, description string, f func() error) error {
+	if s.cfg.DryRun {
+		zap.S().Infof("DRY-RUN: would %s", description)
+		d.DryRun = append(d.DryRun, description)
+		return nil
+	}
+	return f()
+}
+
+func (s *Operator) webserver(port int) {
 	http.HandleFunc("/status", func(w http.ResponseWriter, _ *http.Request) {
-		st := status{State: s.state}
+		st := status{State: s.state, Paused: s.isPaused()}
 		if s.etcdSnapshot != nil {
 			st.Revision = s.etcdSnapshot.Revision
 		}
@@ -229,7 +442,40 @@ func (s *Operator) webserver() {
 			zap.S().With(zap.Error(err)).Warn("failed to write status")
 		}
 	})
-	zap.S().Fatal(http.ListenAndServe(fmt.Sprintf(":%d", webServerPort), nil))
+	http.Handle("/metrics", promhttp.Handler())
+	s.registerAPI()
+	server := &http.Server{Addr: fmt.Sprintf(":%d", port)}
+	if s.statusTLS != nil {
+		server.TLSConfig = s.statusTLS.serverConfig()
+		zap.S().Fatal(server.ListenAndServeTLS("", ""))
+	}
+	zap.S().Fatal(server.ListenAndServe())
+}
+
+func (s *Operator) setEvaluation(asgInstances []asg.Instance, asgSelf asg.Instance) {
+	ev := &evaluation{
+		Time:        time.Now(),
+		Self:        newInstanceInfo(asgSelf, s.cfg.Ports),
+		ClusterSize: s.clusterSize,
+		EtcdHealthy: s.etcdHealthy,
+		EtcdRunning: s.etcdRunning,
+		IsSeeder:    s.isSeeder,
+		States:      s.states,
+		Pause:       s.pauseStatus(),
+	}
+	for _, instance := range asgInstances {
+		ev.Instances = append(ev.Instances, newInstanceInfo(instance, s.cfg.Ports))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.evaluation = ev
+}
+
+func (s *Operator) lastEvaluation() *evaluation {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.evaluation
 }
 
 func (s *Operator) wait() {
@@ -241,5 +487,7 @@ func (s *Operator) wait() {
 	case <-s.ticker.C:
 	case <-s.shutdownChan:
 		s.shutdown = true
+	case <-s.reloadChan:
+		s.reload()
 	}
 }
@@ -0,0 +1,194 @@
+// Copyright 2017 Quentin Machu & eco authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package operator
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/quentin-m/etcd-cloud-operator/pkg/etcd"
+)
+
+const (
+	// pauseKeyPath is the sentinel key that pauses every ECO instance of the cluster while it exists.
+	pauseKeyPath = "/etcd-cloud-operator/paused"
+
+	pauseScopeCluster = "cluster"
+)
+
+type pauseStatus struct {
+	Paused      bool `json:"paused"`
+	Local       bool `json:"local"`
+	Cluster     bool `json:"cluster"`
+	PausedPeers int  `json:"pausedPeers"`
+}
+
+// isPaused returns whether this instance has been paused, either locally or for the whole cluster.
+func (s *Operator) isPaused() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.localPaused || s.clusterPaused
+}
+
+// isFrozen returns whether disruptive actions must be refrained from, because this instance or any of its peers has
+// been paused.
+func (s *Operator) isFrozen() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.localPaused || s.clusterPaused || s.pausedPeers > 0
+}
+
+// setPausedPeers records how many peers reported being paused.
+func (s *Operator) setPausedPeers(peers []peerStatus) {
+	pausedPeers := 0
+	for _, peer := range peers {
+		if peer.Paused {
+			pausedPeers++
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pausedPeers = pausedPeers
+}
+
+func (s *Operator) setLocalPaused(paused bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.localPaused = paused
+	if !paused {
+		// Forget the last known cluster-wide pause as well, in case the sentinel key can not be read anymore. It will
+		// be restored on the next evaluation if the key still exists.
+		s.clusterPaused = false
+	}
+}
+
+// syncClusterPaused reads the cluster-wide pause sentinel key. If the key can not be read, the last known value is
+// kept, as the cluster is likely undergoing the very maintenance the pause is meant for.
+func (s *Operator) syncClusterPaused(client *etcd.Client) {
+	if client == nil || !s.etcdHealthy {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultRequestTimeout)
+	defer cancel()
+
+	resp, err := client.Get(ctx, pauseKeyPath)
+	if err != nil {
+		zap.S().With(zap.Error(err)).Warn("failed to read the cluster pause key")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clusterPaused = len(resp.Kvs) > 0
+}
+
+func (s *Operator) pauseStatus() pauseStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return pauseStatus{
+		Paused:      s.localPaused || s.clusterPaused,
+		Local:       s.localPaused,
+		Cluster:     s.clusterPaused,
+		PausedPeers: s.pausedPeers,
+	}
+}
+
+// performUnlessFrozen executes the given disruptive operation, unless this instance or any of its peers is paused.
+func (s *Operator) performUnlessFrozen(d *decision, description string, f func() error) error {
+	if s.isFrozen() {
+		zap.S().Infof("PAUSED: not going to %s", description)
+		d.Paused = append(d.Paused, description)
+		return nil
+	}
+	return s.perform(d, description, f)
+}
+
+// apiPause pauses this instance, or the whole cluster when the "scope" query parameter is set to "cluster".
+func (s *Operator) apiPause(r *http.Request) (int, interface{}) {
+	if r.URL.Query().Get("scope") != pauseScopeCluster {
+		zap.S().Info("operator paused through the admin api")
+		s.setLocalPaused(true)
+		return http.StatusOK, s.pauseStatus()
+	}
+
+	if err := s.rejectInDryRun("pause the cluster"); err != nil {
+		return http.StatusConflict, err
+	}
+
+	client, code, err := s.apiClusterClient()
+	if err != nil {
+		return code, err
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultRequestTimeout)
+	defer cancel()
+
+	hostname := "unknown"
+	if ev := s.lastEvaluation(); ev != nil {
+		hostname = ev.Self.Name
+	}
+	if _, err := client.Put(ctx, pauseKeyPath, fmt.Sprintf("paused by %s at %s", hostname, time.Now().Format(time.RFC3339))); err != nil {
+		return http.StatusBadGateway, err
+	}
+	zap.S().Info("cluster paused through the admin api")
+
+	s.mu.Lock()
+	s.clusterPaused = true
+	s.mu.Unlock()
+
+	return http.StatusOK, s.pauseStatus()
+}
+
+// apiResume resumes this instance, or the whole cluster when the "scope" query parameter is set to "cluster".
+func (s *Operator) apiResume(r *http.Request) (int, interface{}) {
+	if r.URL.Query().Get("scope") != pauseScopeCluster {
+		zap.S().Info("operator resumed through the admin api")
+		s.setLocalPaused(false)
+		return http.StatusOK, s.pauseStatus()
+	}
+
+	if err := s.rejectInDryRun("resume the cluster"); err != nil {
+		return http.StatusConflict, err
+	}
+
+	client, code, err := s.apiClusterClient()
+	if err != nil {
+		return code, err
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultRequestTimeout)
+	defer cancel()
+
+	if _, err := client.Delete(ctx, pauseKeyPath); err != nil {
+		return http.StatusBadGateway, err
+	}
+	zap.S().Info("cluster resumed through the admin api")
+
+	s.mu.Lock()
+	s.clusterPaused = false
+	s.mu.Unlock()
+
+	return http.StatusOK, s.pauseStatus()
+}
@@ -0,0 +1,55 @@
+// Copyright 2017 Quentin Machu & eco authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package operator
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestPausedPeers(t *testing.T) {
+	s := &Operator{}
+	peers := []peerStatus{{Paused: true}, {}, {Paused: true}}
+
+	// The evaluation loop updates the paused peers while the admin API reads them, run with -race.
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			s.setPausedPeers(peers)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			s.pauseStatus()
+			s.isFrozen()
+		}
+	}()
+	wg.Wait()
+
+	if got := s.pauseStatus().PausedPeers; got != 2 {
+		t.Errorf("got %d paused peers, want 2", got)
+	}
+	if !s.isFrozen() {
+		t.Error("instance with paused peers is not frozen")
+	}
+
+	s.setPausedPeers(peers[1:2])
+	if s.isFrozen() {
+		t.Error("instance without any paused peer is frozen")
+	}
+}
@@ -0,0 +1,230 @@
+// Copyright 2017 Quentin Machu & eco authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package operator
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/quentin-m/etcd-cloud-operator/pkg/logger"
+	"github.com/quentin-m/etcd-cloud-operator/pkg/providers/asg"
+)
+
+// ConfigLoader reads the configuration again, typically from the file it was initially loaded from.
+type ConfigLoader func() (Config, error)
+
+// reloadStatus is the outcome of the last configuration reload.
+type reloadStatus struct {
+	Time           time.Time `json:"time"`
+	Applied        []string  `json:"applied,omitempty"`
+	PendingRestart []string  `json:"pendingRestart,omitempty"`
+	Error          string    `json:"error,omitempty"`
+}
+
+// reload loads the configuration again, applies the settings that are safe to change live, and reports the ones that
+// require a restart as pending.
+//
+// It must be called from the operator's loop, as it modifies the configuration read by evaluate() and execute().
+func (s *Operator) reload() {
+	zap.S().Info("reloading configuration")
+	status := &reloadStatus{Time: time.Now()}
+
+	cfg, err := s.loader()
+	if err == nil {
+		cfg.Ports = cfg.Ports.WithDefaults(defaultPorts)
+		err = validateReload(cfg)
+	}
+	if err != nil {
+		zap.S().With(zap.Error(err)).Error("failed to reload configuration, keeping the current one")
+		status.Error = err.Error()
+	} else {
+		status.Applied, status.PendingRestart = s.applyConfig(cfg)
+
+		if len(status.Applied) > 0 {
+			zap.S().Infof("applied configuration changes: %v", status.Applied)
+		} else {
+			zap.S().Info("no configuration change to apply")
+		}
+		if len(status.PendingRestart) > 0 {
+			zap.S().Warnf("configuration changes pending a restart: %v", status.PendingRestart)
+		}
+	}
+
+	s.mu.Lock()
+	s.reloadStatus = status
+	s.mu.Unlock()
+
+	promSetReload(status)
+}
+
+func validateReload(cfg Config) error {
+	if err := cfg.Etcd.Validate(); err != nil {
+		return err
+	}
+	if cfg.CheckInterval <= 0 {
+		return errors.New("check-interval must be positive")
+	}
+	if cfg.Snapshot.Interval <= 0 {
+		return errors.New("snapshots must be enabled for disaster recovery")
+	}
+	if err := validatePorts(cfg.Ports); err != nil {
+		return err
+	}
+	if cfg.LogLevel != "" {
+		var lvl zapcore.Level
+		if err := lvl.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyConfig applies the settings of the given configuration that can be changed live, and returns their names along
+// with the names of the changed settings that require a restart.
+func (s *Operator) applyConfig(cfg Config) (applied, pending []string) {
+	if cfg.CheckInterval != s.cfg.CheckInterval {
+		s.cfg.CheckInterval = cfg.CheckInterval
+		s.ticker.Reset(cfg.CheckInterval)
+		applied = append(applied, "check-interval")
+	}
+	if cfg.LogLevel != s.cfg.LogLevel {
+		if cfg.LogLevel != "" {
+			if err := logger.SetLevel(cfg.LogLevel); err != nil {
+				zap.S().With(zap.Error(err)).Error("failed to set log level")
+			}
+		}
+		s.cfg.LogLevel = cfg.LogLevel
+		applied = append(applied, "log-level")
+	}
+	if cfg.ScaleInMemberRemoval != s.cfg.ScaleInMemberRemoval {
+		s.cfg.ScaleInMemberRemoval = cfg.ScaleInMemberRemoval
+		applied = append(applied, "scale-in-member-removal")
+	}
+	if cfg.DryRun != s.cfg.DryRun {
+		// Also read by the admin API.
+		s.mu.Lock()
+		s.cfg.DryRun = cfg.DryRun
+		s.mu.Unlock()
+		applied = append(applied, "dry-run")
+	}
+	if cfg.CertificateExpiryWarning != s.cfg.CertificateExpiryWarning {
+		s.cfg.CertificateExpiryWarning = cfg.CertificateExpiryWarning
+		applied = append(applied, "certificate-expiry-warning")
+	}
+	if cfg.ACLAudit != s.cfg.ACLAudit {
+		s.cfg.ACLAudit = cfg.ACLAudit
+		applied = append(applied, "acl-audit")
+	}
+	if !s.cfg.Etcd.InitACL.Equal(cfg.Etcd.InitACL) {
+		s.cfg.Etcd.InitACL = cfg.Etcd.InitACL
+		applied = append(applied, "etcd.init-acl")
+	}
+
+	// The member cleaner and the snapshotter pick these up from the etcd server, if it has been created already.
+	var serverChanged bool
+	if cfg.UnhealthyMemberTTL != s.cfg.UnhealthyMemberTTL {
+		s.cfg.UnhealthyMemberTTL = cfg.UnhealthyMemberTTL
+		applied, serverChanged = append(applied, "unhealthy-member-ttl"), true
+	}
+	if cfg.Snapshot.Interval != s.cfg.Snapshot.Interval {
+		s.cfg.Snapshot.Interval = cfg.Snapshot.Interval
+		applied, serverChanged = append(applied, "snapshot.interval"), true
+	}
+	if cfg.Snapshot.TTL != s.cfg.Snapshot.TTL {
+		s.cfg.Snapshot.TTL = cfg.Snapshot.TTL
+		applied, serverChanged = append(applied, "snapshot.ttl"), true
+	}
+	if serverChanged {
+		s.serverMu.Lock()
+		if s.server != nil {
+			s.server.Reconfigure(s.cfg.UnhealthyMemberTTL, s.cfg.Snapshot.Interval, s.cfg.Snapshot.TTL)
+		}
+		s.serverMu.Unlock()
+	}
+
+	// Everything else is only read when the providers, the web server or etcd are started.
+	pending = append(pending, changedFields("etcd", s.cfg.Etcd, cfg.Etcd, "init-acl")...)
+	pending = append(pending, changedFields("asg", s.cfg.ASG, cfg.ASG)...)
+	pending = append(pending, changedFields("ports", s.cfg.Ports, cfg.Ports)...)
+	pending = append(pending, changedFields("snapshot", s.cfg.Snapshot, cfg.Snapshot, "interval", "ttl")...)
+	if !reflect.DeepEqual(s.cfg.StatusTransportSecurity, cfg.StatusTransportSecurity) {
+		pending = append(pending, "status-transport-security")
+	}
+
+	return applied, pending
+}
+
+// changedFields compares two structs of the same type field by field, and returns the YAML names of the fields that
+// differ, except the ignored ones. Inlined fields are reported under the prefix itself.
+func changedFields(prefix string, a, b interface{}, ignored ...string) (changed []string) {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+
+	for i := 0; i < va.NumField(); i++ {
+		name := strings.Split(va.Type().Field(i).Tag.Get("yaml"), ",")[0]
+		if contains(ignored, name) || reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			continue
+		}
+		if name == "" {
+			changed = append(changed, prefix)
+			continue
+		}
+		changed = append(changed, prefix+"."+name)
+	}
+	return changed
+}
+
+func validatePorts(ports asg.Ports) error {
+	seen := make(map[int]bool)
+	for _, port := range []int{ports.Client, ports.Peer, ports.Metrics, ports.Status} {
+		if port <= 0 || port > 65535 {
+			return fmt.Errorf("invalid port %d", port)
+		}
+		if seen[port] {
+			return fmt.Errorf("port %d is used more than once", port)
+		}
+		seen[port] = true
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Operator) lastReload() *reloadStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.reloadStatus
+}
+
+func (s *Operator) apiReload(_ *http.Request) (int, interface{}) {
+	status := s.lastReload()
+	if status == nil {
+		return http.StatusNotFound, errors.New("configuration has not been reloaded yet")
+	}
+	return http.StatusOK, status
+}
@@ -0,0 +1,127 @@
+// Copyright 2017 Quentin Machu & eco authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package operator
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"go.etcd.io/etcd/client/pkg/v3/transport"
+	"go.uber.org/zap"
+
+	"github.com/quentin-m/etcd-cloud-operator/pkg/etcd"
+)
+
+const selfSignedCertValidity = 5
+
+// statusServerTLSConfig returns the TLS configuration of the operator's web server, or nil if TLS is disabled.
+//
+// When a trusted CA file is given, or client-cert-auth is enabled, the peers must present a certificate signed by the
+// trusted CA.
+func statusServerTLSConfig(sc etcd.SecurityConfig) (*tls.Config, error) {
+	if !sc.TLSEnabled() {
+		return nil, nil
+	}
+
+	info := sc.TLSInfo()
+	if sc.AutoTLS && info.Empty() {
+		hostname, _ := os.Hostname()
+
+		var err error
+		info, err = transport.SelfCert(zap.L(), filepath.Join(os.TempDir(), "eco-status-tls"), []string{hostname}, selfSignedCertValidity)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate self-signed certificate: %v", err)
+		}
+	}
+	if sc.CertAuth && sc.TrustedCAFile == "" {
+		return nil, errors.New("client-cert-auth requires a trusted-ca-file")
+	}
+
+	return info.ServerConfig()
+}
+
+// statusClientTLSConfig returns the TLS configuration used to query the peers' status, or nil if TLS is disabled.
+//
+// Just like for the etcd clients, the certificates can not be expected to match the instances' addresses, therefore
+// hostname verification is skipped. However, when a trusted CA file is given, the certificate chain presented by the
+// peers is verified against it, which prevents any host from impersonating an ECO instance.
+func statusClientTLSConfig(sc etcd.SecurityConfig) (*tls.Config, error) {
+	if !sc.TLSEnabled() {
+		return nil, nil
+	}
+
+	tc, err := sc.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	if sc.TrustedCAFile == "" {
+		return tc, nil
+	}
+
+	caPEM, err := ioutil.ReadFile(sc.TrustedCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read trusted CA file: %v", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificate found in trusted CA file %q", sc.TrustedCAFile)
+	}
+	tc.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		return verifyCertificateChain(rawCerts, roots)
+	}
+
+	return tc, nil
+}
+
+// verifyCertificateChain verifies that the given certificate chain is signed by one of the roots, without verifying
+// the hostname.
+func verifyCertificateChain(rawCerts [][]byte, roots *x509.CertPool) error {
+	if len(rawCerts) == 0 {
+		return errors.New("no certificate presented")
+	}
+
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, rawCert := range rawCerts {
+		cert, err := x509.ParseCertificate(rawCert)
+		if err != nil {
+			return fmt.Errorf("failed to parse certificate: %v", err)
+		}
+		certs[i] = cert
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	return err
+}
+
+func scheme(tc *tls.Config) string {
+	if tc != nil {
+		return "https"
+	}
+	return "http"
+}
@@ -29,12 +29,67 @@ type Instance interface {
 	BindAddress() string
 }
 
+// Ports are the ports on which an instance serves etcd's clients, peers and metrics, and the operator's status. Zero
+// values stand for the cluster's ports.
+type Ports struct {
+	Client  int `yaml:"client" json:"client"`
+	Peer    int `yaml:"peer" json:"peer"`
+	Metrics int `yaml:"metrics" json:"metrics"`
+	Status  int `yaml:"status" json:"status"`
+}
+
+// WithDefaults returns the ports, with the unset ones taken from the given defaults.
+func (p Ports) WithDefaults(defaults Ports) Ports {
+	if p.Client == 0 {
+		p.Client = defaults.Client
+	}
+	if p.Peer == 0 {
+		p.Peer = defaults.Peer
+	}
+	if p.Metrics == 0 {
+		p.Metrics = defaults.Metrics
+	}
+	if p.Status == 0 {
+		p.Status = defaults.Status
+	}
+	return p
+}
+
+// PortsInstance is optionally implemented by the instances that do not use the cluster's ports, for instance because
+// several of them share the same host.
+type PortsInstance interface {
+	Ports() Ports
+}
+
+// PortsProvider is optionally implemented by the providers whose local instance may not use the cluster's ports, and
+// that know its ports as soon as they are configured.
+type PortsProvider interface {
+	SelfPorts() Ports
+}
+
+// InstancePorts returns the ports of the given instance, using the cluster's ports for the ones it does not override.
+func InstancePorts(instance Instance, cluster Ports) Ports {
+	if pi, ok := instance.(PortsInstance); ok {
+		return pi.Ports().WithDefaults(cluster)
+	}
+	return cluster
+}
+
 type Provider interface {
 	Configure(Config) error
 
 	AutoScalingGroupStatus() ([]Instance, Instance, int, error)
 }
 
+// LifecycleProvider is optionally implemented by the providers supporting lifecycle hooks, which allow the operator to
+// prepare for the termination of the local instance before it is carried out.
+type LifecycleProvider interface {
+	// IsTerminating returns whether the local instance is being terminated, as of the last AutoScalingGroupStatus.
+	IsTerminating() bool
+	// CompleteTermination notifies the provider that the local instance is ready to be terminated.
+	CompleteTermination() error
+}
+
 // Config represents the configuration of the auto-scaling group provider.
 type Config struct {
 	Provider string                 `yaml:"provider"`
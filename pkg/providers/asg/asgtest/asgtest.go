@@ -0,0 +1,32 @@
+// Copyright 2017 Quentin Machu & eco authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package asgtest provides utilities shared by the tests of the asg providers.
+package asgtest
+
+import (
+	"strings"
+
+	"github.com/quentin-m/etcd-cloud-operator/pkg/providers/asg"
+)
+
+// InstancesString lists the given instances as comma-separated name=address pairs, in order, so that the instances
+// returned by a provider can be compared with the expected ones at a glance.
+func InstancesString(instances []asg.Instance) string {
+	s := make([]string, 0, len(instances))
+	for _, i := range instances {
+		s = append(s, i.Name()+"="+i.Address())
+	}
+	return strings.Join(s, ",")
+}
@@ -20,19 +20,47 @@ import (
 	"strings"
 
 	aaws "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"go.uber.org/zap"
+
+	"github.com/quentin-m/etcd-cloud-operator/pkg/providers"
 	"github.com/quentin-m/etcd-cloud-operator/pkg/providers/asg"
 )
 
+const lifecycleTransitionTerminating = "autoscaling:EC2_INSTANCE_TERMINATING"
+
 func init() {
 	asg.Register("aws", &aws{})
 }
 
 type aws struct {
+	config config
+
 	asgName, instanceID, region string
+
+	// Lifecycle state of the local instance, as of the last call to AutoScalingGroupStatus.
+	selfLifecycleState string
+
+	// Optional, the credentials to use rather than the default chain (environment, shared files, instance role).
+	credentials *credentials.Credentials
+}
+
+type config struct {
+	// Optional, discovered from the ec2 metadata service otherwise.
+	Region     string `yaml:"region"`
+	InstanceID string `yaml:"instance-id"`
+
+	// Optional, allow to use custom (e.g. local) endpoints for the aws apis.
+	AutoScalingEndpoint string `yaml:"autoscaling-endpoint"`
+	EC2Endpoint         string `yaml:"ec2-endpoint"`
+
+	// Optional, the name of the termination lifecycle hook to complete. If not set, the first hook of the
+	// auto-scaling group for the EC2_INSTANCE_TERMINATING transition is used.
+	LifecycleHookName string `yaml:"lifecycle-hook-name"`
 }
 
 type instance struct {
@@ -52,6 +80,11 @@ func (i *instance) BindAddress() string {
 }
 
 func (a *aws) Configure(providerConfig asg.Config) error {
+	if err := providers.ParseParams(providerConfig.Params, &a.config); err != nil {
+		return fmt.Errorf("invalid configuration: %v", err)
+	}
+	a.region, a.instanceID = a.config.Region, a.config.InstanceID
+
 	// Fetch the underlying auto-scaling group once to verify the app is
 	// indeed running on one, and cache its name.
 	_, _, err := a.describeASG()
@@ -68,6 +101,16 @@ func (a *aws) AutoScalingGroupStatus() (instances []asg.Instance, self asg.Insta
 		return nil, nil, 0, err
 	}
 
+	lifecycleStates := make(map[string]string)
+	var pendingWait int
+	for _, asgInstance := range asg.Instances {
+		lifecycleStates[aaws.StringValue(asgInstance.InstanceId)] = aaws.StringValue(asgInstance.LifecycleState)
+		if aaws.StringValue(asgInstance.LifecycleState) == autoscaling.LifecycleStatePendingWait {
+			pendingWait++
+		}
+	}
+	a.selfLifecycleState = lifecycleStates[a.instanceID]
+
 	for _, reservation := range reservations {
 		for _, awsInstance := range reservation.Instances {
 			if strings.ToLower(*awsInstance.State.Name) != "running" {
@@ -75,18 +118,71 @@ func (a *aws) AutoScalingGroupStatus() (instances []asg.Instance, self asg.Insta
 			}
 
 			instance := &instance{name: *awsInstance.InstanceId, address: *awsInstance.PrivateIpAddress}
-			instances = append(instances, instance)
-
 			if instance.name == a.instanceID {
 				self = instance
 			}
+
+			// Instances waiting on a launch lifecycle hook are not ready to be part of the cluster yet, keep them out
+			// of the seeding decisions. They are not counted in the size either, so that the other instances can seed
+			// the cluster, which they join once their launch lifecycle action is completed.
+			if lifecycleStates[instance.name] == autoscaling.LifecycleStatePendingWait {
+				continue
+			}
+			instances = append(instances, instance)
 		}
 	}
-	size = int(*asg.DesiredCapacity)
+	size = int(*asg.DesiredCapacity) - pendingWait
 
 	return
 }
 
+func (a *aws) IsTerminating() bool {
+	return strings.HasPrefix(a.selfLifecycleState, "Terminating")
+}
+
+func (a *aws) CompleteTermination() error {
+	if a.selfLifecycleState != autoscaling.LifecycleStateTerminatingWait {
+		return nil
+	}
+
+	as, _, err := a.clients()
+	if err != nil {
+		return err
+	}
+
+	hookName := a.config.LifecycleHookName
+	if hookName == "" {
+		hooks, err := as.DescribeLifecycleHooks(&autoscaling.DescribeLifecycleHooksInput{
+			AutoScalingGroupName: aaws.String(a.asgName),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to describe aws auto-scaling group's lifecycle hooks: %v", err)
+		}
+		for _, hook := range hooks.LifecycleHooks {
+			if aaws.StringValue(hook.LifecycleTransition) == lifecycleTransitionTerminating {
+				hookName = aaws.StringValue(hook.LifecycleHookName)
+				break
+			}
+		}
+		if hookName == "" {
+			return errors.New("no termination lifecycle hook found on the aws auto-scaling group")
+		}
+	}
+
+	_, err = as.CompleteLifecycleAction(&autoscaling.CompleteLifecycleActionInput{
+		AutoScalingGroupName:  aaws.String(a.asgName),
+		InstanceId:            aaws.String(a.instanceID),
+		LifecycleHookName:     aaws.String(hookName),
+		LifecycleActionResult: aaws.String("CONTINUE"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to complete aws lifecycle action: %v", err)
+	}
+
+	zap.S().Infof("completed lifecycle action %q for instance %q", hookName, a.instanceID)
+	return nil
+}
+
 func (a *aws) describeASG() (*autoscaling.Group, []*ec2.Reservation, error) {
 	if a.region == "" || a.instanceID == "" {
 		sess, err := session.NewSession()
@@ -103,20 +199,18 @@ func (a *aws) describeASG() (*autoscaling.Group, []*ec2.Reservation, error) {
 		if err != nil {
 			return nil, nil, fmt.Errorf("failed to retrieve aws ec2 instance identity: %v", err)
 		}
-		a.instanceID = instanceIdentity.InstanceID
-
-		a.region, err = ec2meta.Region()
-		if err != nil {
-			return nil, nil, fmt.Errorf("failed to retrieve aws ec2 region: %v", err)
+		if a.instanceID == "" {
+			a.instanceID = instanceIdentity.InstanceID
+		}
+		if a.region == "" {
+			a.region = instanceIdentity.Region
 		}
 	}
 
-	sess, err := session.NewSession(aaws.NewConfig().WithRegion(a.region))
+	as, ec2s, err := a.clients()
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to create aws session: %v", err)
+		return nil, nil, err
 	}
-	as := autoscaling.New(sess)
-	ec2s := ec2.New(sess)
 
 	if a.asgName == "" {
 		asgInstance, err := as.DescribeAutoScalingInstances(&autoscaling.DescribeAutoScalingInstancesInput{
@@ -152,3 +246,24 @@ func (a *aws) describeASG() (*autoscaling.Group, []*ec2.Reservation, error) {
 
 	return asg.AutoScalingGroups[0], reservations.Reservations, nil
 }
+
+func (a *aws) clients() (*autoscaling.AutoScaling, *ec2.EC2, error) {
+	cfg := aaws.NewConfig().WithRegion(a.region)
+	if a.credentials != nil {
+		cfg = cfg.WithCredentials(a.credentials)
+	}
+	sess, err := session.NewSession(cfg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create aws session: %v", err)
+	}
+
+	asCfg, ec2Cfg := aaws.NewConfig(), aaws.NewConfig()
+	if a.config.AutoScalingEndpoint != "" {
+		asCfg = asCfg.WithEndpoint(a.config.AutoScalingEndpoint)
+	}
+	if a.config.EC2Endpoint != "" {
+		ec2Cfg = ec2Cfg.WithEndpoint(a.config.EC2Endpoint)
+	}
+
+	return autoscaling.New(sess, asCfg), ec2.New(sess, ec2Cfg), nil
+}
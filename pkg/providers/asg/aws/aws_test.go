@@ -0,0 +1,188 @@
+// Copyright 2017 Quentin Machu & eco authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aws
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+
+	"github.com/quentin-m/etcd-cloud-operator/pkg/providers/asg"
+	"github.com/quentin-m/etcd-cloud-operator/pkg/providers/asg/asgtest"
+)
+
+// fakeAWS serves the subset of the Auto Scaling and EC2 query APIs used by the provider.
+type fakeAWS struct {
+	mu sync.Mutex
+
+	// Lifecycle state of each instance of the auto-scaling group, by instance ID.
+	lifecycleStates map[string]string
+
+	// Form of the CompleteLifecycleAction calls.
+	completed []url.Values
+}
+
+func (f *fakeAWS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var ids []string
+	for id := range f.lifecycleStates {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var body string
+	switch action := r.Form.Get("Action"); action {
+	case "DescribeAutoScalingInstances":
+		body = `<AutoScalingInstances><member><AutoScalingGroupName>eco</AutoScalingGroupName><InstanceId>i-1</InstanceId></member></AutoScalingInstances>`
+	case "DescribeAutoScalingGroups":
+		var instances string
+		for _, id := range ids {
+			instances += fmt.Sprintf(`<member><InstanceId>%s</InstanceId><LifecycleState>%s</LifecycleState></member>`, id, f.lifecycleStates[id])
+		}
+		body = `<AutoScalingGroups><member><AutoScalingGroupName>eco</AutoScalingGroupName><DesiredCapacity>3</DesiredCapacity><Instances>` + instances + `</Instances></member></AutoScalingGroups>`
+	case "DescribeLifecycleHooks":
+		body = `<LifecycleHooks>` +
+			`<member><LifecycleHookName>launch</LifecycleHookName><LifecycleTransition>autoscaling:EC2_INSTANCE_LAUNCHING</LifecycleTransition></member>` +
+			`<member><LifecycleHookName>drain</LifecycleHookName><LifecycleTransition>autoscaling:EC2_INSTANCE_TERMINATING</LifecycleTransition></member>` +
+			`</LifecycleHooks>`
+	case "CompleteLifecycleAction":
+		f.completed = append(f.completed, r.Form)
+	case "DescribeInstances":
+		var instances string
+		for i, id := range ids {
+			instances += fmt.Sprintf(`<item><instanceId>%s</instanceId><privateIpAddress>10.0.0.%d</privateIpAddress><instanceState><code>16</code><name>running</name></instanceState></item>`, id, i+1)
+		}
+		instances += `<item><instanceId>i-stopped</instanceId><privateIpAddress>10.0.0.99</privateIpAddress><instanceState><code>80</code><name>stopped</name></instanceState></item>`
+		fmt.Fprintf(w, `<DescribeInstancesResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/"><requestId>r</requestId><reservationSet><item><reservationId>r-1</reservationId><instancesSet>%s</instancesSet></item></reservationSet></DescribeInstancesResponse>`, instances)
+		return
+	default:
+		http.Error(w, "unexpected action "+action, http.StatusBadRequest)
+		return
+	}
+
+	action := r.Form.Get("Action")
+	fmt.Fprintf(w, `<%[1]sResponse xmlns="http://autoscaling.amazonaws.com/doc/2011-01-01/"><%[1]sResult>%[2]s</%[1]sResult><ResponseMetadata><RequestId>r</RequestId></ResponseMetadata></%[1]sResponse>`, action, body)
+}
+
+func newTestProvider(t *testing.T, lifecycleStates map[string]string) (*aws, *fakeAWS) {
+	fake := &fakeAWS{lifecycleStates: lifecycleStates}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	a := &aws{credentials: credentials.NewStaticCredentials("test", "test", "")}
+	err := a.Configure(asg.Config{Params: map[string]interface{}{
+		"region":               "us-east-1",
+		"instance-id":          "i-1",
+		"autoscaling-endpoint": server.URL,
+		"ec2-endpoint":         server.URL,
+	}})
+	if err != nil {
+		t.Fatalf("failed to configure provider: %v", err)
+	}
+	return a, fake
+}
+
+func TestAutoScalingGroupStatus(t *testing.T) {
+	a, _ := newTestProvider(t, map[string]string{"i-1": "InService", "i-2": "InService", "i-3": "Pending:Wait"})
+
+	instances, self, size, err := a.AutoScalingGroupStatus()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if got, want := asgtest.InstancesString(instances), "i-1=10.0.0.1,i-2=10.0.0.2"; got != want {
+		t.Errorf("got instances %s, want %s (Pending:Wait and stopped instances left out)", got, want)
+	}
+	if self == nil || self.Name() != "i-1" {
+		t.Errorf("got self %v, want i-1", self)
+	}
+	// The seeder waits for size instances to be ready to start, which must not include the Pending:Wait one.
+	if size != len(instances) {
+		t.Errorf("got size %d, want %d", size, len(instances))
+	}
+	if a.IsTerminating() {
+		t.Error("InService instance reported as terminating")
+	}
+}
+
+func TestLifecycleTermination(t *testing.T) {
+	a, fake := newTestProvider(t, map[string]string{"i-1": "Terminating:Wait", "i-2": "InService"})
+
+	if _, _, _, err := a.AutoScalingGroupStatus(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !a.IsTerminating() {
+		t.Fatal("Terminating:Wait instance not reported as terminating")
+	}
+
+	if err := a.CompleteTermination(); err != nil {
+		t.Fatalf("failed to complete termination: %v", err)
+	}
+	if len(fake.completed) != 1 {
+		t.Fatalf("got %d CompleteLifecycleAction calls, want 1", len(fake.completed))
+	}
+	// The lifecycle action is identified by the instance ID, which stands for the lifecycle action token.
+	form := fake.completed[0]
+	for k, want := range map[string]string{
+		"AutoScalingGroupName":  "eco",
+		"LifecycleHookName":     "drain",
+		"InstanceId":            "i-1",
+		"LifecycleActionResult": "CONTINUE",
+	} {
+		if got := form.Get(k); got != want {
+			t.Errorf("got %s=%q, want %q", k, got, want)
+		}
+	}
+
+	// Once the instance has moved on, there is nothing left to complete.
+	fake.lifecycleStates["i-1"] = "Terminating:Proceed"
+	if _, _, _, err := a.AutoScalingGroupStatus(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := a.CompleteTermination(); err != nil {
+		t.Fatalf("failed to complete termination: %v", err)
+	}
+	if len(fake.completed) != 1 {
+		t.Errorf("got %d CompleteLifecycleAction calls, want 1", len(fake.completed))
+	}
+}
+
+func TestLifecycleTerminationConfiguredHook(t *testing.T) {
+	a, fake := newTestProvider(t, map[string]string{"i-1": "Terminating:Wait"})
+	a.config.LifecycleHookName = "custom"
+
+	if _, _, _, err := a.AutoScalingGroupStatus(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := a.CompleteTermination(); err != nil {
+		t.Fatalf("failed to complete termination: %v", err)
+	}
+	if len(fake.completed) != 1 || fake.completed[0].Get("LifecycleHookName") != "custom" {
+		t.Errorf("got CompleteLifecycleAction calls %v, want one for hook custom", fake.completed)
+	}
+}
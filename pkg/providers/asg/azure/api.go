@@ -0,0 +1,257 @@
+// Copyright 2017 Quentin Machu & eco authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azure
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	apiTimeout = 10 * time.Second
+
+	imdsAPIVersion     = "2021-02-01"
+	identityAPIVersion = "2018-02-01"
+	vmssAPIVersion     = "2021-07-01"
+	nicAPIVersion      = "2018-10-01"
+)
+
+// imdsClient is a minimal client of the Azure Instance Metadata Service.
+type imdsClient struct {
+	endpoint string
+	resource string
+	http     *http.Client
+
+	tokenM      sync.Mutex
+	token       string
+	tokenExpiry time.Time
+}
+
+// newIMDSClient creates a client of the given metadata service, whose access tokens are issued for the given resource.
+func newIMDSClient(endpoint, resource string) *imdsClient {
+	return &imdsClient{endpoint: strings.TrimSuffix(endpoint, "/"), resource: resource, http: &http.Client{Timeout: apiTimeout}}
+}
+
+func (c *imdsClient) get(path string, query url.Values, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, c.endpoint+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Metadata", "true")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to query azure instance metadata service: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("azure instance metadata service returned %d for %s", resp.StatusCode, path)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (c *imdsClient) instance() (*instanceMetadata, error) {
+	var md instanceMetadata
+	if err := c.get("/metadata/instance", url.Values{"api-version": {imdsAPIVersion}}, &md); err != nil {
+		return nil, err
+	}
+	return &md, nil
+}
+
+// accessToken returns an access token of the instance's managed identity for the management api, cached until
+// shortly before it expires.
+func (c *imdsClient) accessToken() (string, error) {
+	c.tokenM.Lock()
+	defer c.tokenM.Unlock()
+
+	if c.token != "" && time.Now().Before(c.tokenExpiry) {
+		return c.token, nil
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   string `json:"expires_in"`
+	}
+	query := url.Values{"api-version": {identityAPIVersion}, "resource": {c.resource}}
+	if err := c.get("/metadata/identity/oauth2/token", query, &token); err != nil {
+		return "", err
+	}
+	expiresIn, _ := strconv.Atoi(token.ExpiresIn)
+	c.token, c.tokenExpiry = token.AccessToken, time.Now().Add(time.Duration(expiresIn)*time.Second-time.Minute)
+	return c.token, nil
+}
+
+// managementClient is a minimal client of the Azure Resource Manager API.
+type managementClient struct {
+	endpoint string
+	imds     *imdsClient
+	http     *http.Client
+}
+
+func newManagementClient(endpoint string, imds *imdsClient) *managementClient {
+	return &managementClient{endpoint: strings.TrimSuffix(endpoint, "/"), imds: imds, http: &http.Client{Timeout: apiTimeout}}
+}
+
+// get queries the given path of the API, or the path of the given absolute URL (e.g. a nextLink), and decodes the
+// response into v.
+func (c *managementClient) get(pathOrURL string, query url.Values, v interface{}) error {
+	u := c.endpoint + pathOrURL
+	if i := strings.Index(pathOrURL, "/subscriptions/"); i > 0 {
+		u = c.endpoint + pathOrURL[i:]
+	} else if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	token, err := c.imds.accessToken()
+	if err != nil {
+		return fmt.Errorf("failed to get azure access token: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to query azure management api: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var e apiError
+		if json.NewDecoder(resp.Body).Decode(&e) == nil && e.Error.Message != "" {
+			return fmt.Errorf("azure management api returned %d: %s", resp.StatusCode, e.Error.Message)
+		}
+		return fmt.Errorf("azure management api returned %d", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func scaleSetPath(subscriptionID, resourceGroup, name string) string {
+	return fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Compute/virtualMachineScaleSets/%s", subscriptionID, resourceGroup, name)
+}
+
+func (c *managementClient) getScaleSet(subscriptionID, resourceGroup, name string) (*scaleSet, error) {
+	var ss scaleSet
+	if err := c.get(scaleSetPath(subscriptionID, resourceGroup, name), url.Values{"api-version": {vmssAPIVersion}}, &ss); err != nil {
+		return nil, err
+	}
+	return &ss, nil
+}
+
+func (c *managementClient) listScaleSetVMs(subscriptionID, resourceGroup, name string) ([]scaleSetVM, error) {
+	var vms []scaleSetVM
+	next, query := scaleSetPath(subscriptionID, resourceGroup, name)+"/virtualMachines", url.Values{"api-version": {vmssAPIVersion}}
+	for next != "" {
+		var list struct {
+			Value    []scaleSetVM `json:"value"`
+			NextLink string       `json:"nextLink"`
+		}
+		if err := c.get(next, query, &list); err != nil {
+			return nil, err
+		}
+		vms = append(vms, list.Value...)
+		next = list.NextLink
+	}
+	return vms, nil
+}
+
+func (c *managementClient) listScaleSetNICs(subscriptionID, resourceGroup, name string) ([]networkInterface, error) {
+	var nics []networkInterface
+	next, query := scaleSetPath(subscriptionID, resourceGroup, name)+"/networkInterfaces", url.Values{"api-version": {nicAPIVersion}}
+	for next != "" {
+		var list struct {
+			Value    []networkInterface `json:"value"`
+			NextLink string             `json:"nextLink"`
+		}
+		if err := c.get(next, query, &list); err != nil {
+			return nil, err
+		}
+		nics = append(nics, list.Value...)
+		next = list.NextLink
+	}
+	return nics, nil
+}
+
+// The subset of the Azure objects used by the provider.
+
+type apiError struct {
+	Error struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+type instanceMetadata struct {
+	Compute struct {
+		Name              string `json:"name"`
+		VMScaleSetName    string `json:"vmScaleSetName"`
+		ResourceGroupName string `json:"resourceGroupName"`
+		SubscriptionID    string `json:"subscriptionId"`
+	} `json:"compute"`
+}
+
+type scaleSet struct {
+	Name string `json:"name"`
+	Sku  struct {
+		Capacity int `json:"capacity"`
+	} `json:"sku"`
+}
+
+type scaleSetVM struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	InstanceID string `json:"instanceId"`
+	Properties struct {
+		ProvisioningState string `json:"provisioningState"`
+	} `json:"properties"`
+}
+
+type networkInterface struct {
+	Properties struct {
+		Primary          bool `json:"primary"`
+		IPConfigurations []struct {
+			Properties struct {
+				Primary          bool   `json:"primary"`
+				PrivateIPAddress string `json:"privateIPAddress"`
+			} `json:"properties"`
+		} `json:"ipConfigurations"`
+		VirtualMachine struct {
+			ID string `json:"id"`
+		} `json:"virtualMachine"`
+	} `json:"properties"`
+}
+
+// privateIP returns the private IP address of the primary IP configuration of the network interface.
+func (n *networkInterface) privateIP() string {
+	var ip string
+	for _, ipc := range n.Properties.IPConfigurations {
+		if ipc.Properties.Primary {
+			return ipc.Properties.PrivateIPAddress
+		}
+		if ip == "" {
+			ip = ipc.Properties.PrivateIPAddress
+		}
+	}
+	return ip
+}
@@ -0,0 +1,167 @@
+// Copyright 2017 Quentin Machu & eco authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package azure implements an auto-scaling group provider for Azure virtual machine scale sets.
+package azure
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/quentin-m/etcd-cloud-operator/pkg/providers"
+	"github.com/quentin-m/etcd-cloud-operator/pkg/providers/asg"
+)
+
+const (
+	defaultIMDSEndpoint       = "http://169.254.169.254"
+	defaultManagementEndpoint = "https://management.azure.com"
+)
+
+func init() {
+	asg.Register("azure", &azure{})
+}
+
+type azure struct {
+	config     config
+	imds       *imdsClient
+	management *managementClient
+}
+
+type config struct {
+	// Optional, discovered from the instance metadata service otherwise.
+	SubscriptionID string `yaml:"subscription-id"`
+	ResourceGroup  string `yaml:"resource-group"`
+	ScaleSet       string `yaml:"scale-set"`
+	InstanceName   string `yaml:"instance-name"`
+
+	// Optional, allow to use custom (e.g. local) endpoints for the instance metadata service and the management api.
+	// Access tokens are issued for the management endpoint.
+	IMDSEndpoint       string `yaml:"imds-endpoint"`
+	ManagementEndpoint string `yaml:"management-endpoint"`
+}
+
+type instance struct {
+	name, address string
+}
+
+func (i *instance) Name() string {
+	return i.name
+}
+
+func (i *instance) Address() string {
+	return i.address
+}
+
+func (i *instance) BindAddress() string {
+	return i.address
+}
+
+func (a *azure) Configure(providerConfig asg.Config) error {
+	a.config = config{IMDSEndpoint: defaultIMDSEndpoint, ManagementEndpoint: defaultManagementEndpoint}
+	if err := providers.ParseParams(providerConfig.Params, &a.config); err != nil {
+		return fmt.Errorf("invalid configuration: %v", err)
+	}
+	a.imds = newIMDSClient(a.config.IMDSEndpoint, strings.TrimSuffix(a.config.ManagementEndpoint, "/")+"/")
+	a.management = newManagementClient(a.config.ManagementEndpoint, a.imds)
+
+	if a.config.SubscriptionID == "" || a.config.ResourceGroup == "" || a.config.ScaleSet == "" || a.config.InstanceName == "" {
+		md, err := a.imds.instance()
+		if err != nil {
+			return fmt.Errorf("application is not running on azure: %v", err)
+		}
+		if md.Compute.VMScaleSetName == "" && a.config.ScaleSet == "" {
+			return errors.New("application is not running inside an azure virtual machine scale set")
+		}
+		if a.config.SubscriptionID == "" {
+			a.config.SubscriptionID = md.Compute.SubscriptionID
+		}
+		if a.config.ResourceGroup == "" {
+			a.config.ResourceGroup = md.Compute.ResourceGroupName
+		}
+		if a.config.ScaleSet == "" {
+			a.config.ScaleSet = md.Compute.VMScaleSetName
+		}
+		if a.config.InstanceName == "" {
+			a.config.InstanceName = md.Compute.Name
+		}
+	}
+
+	// Fetch the scale set once to verify it exists.
+	if _, err := a.management.getScaleSet(a.config.SubscriptionID, a.config.ResourceGroup, a.config.ScaleSet); err != nil {
+		return fmt.Errorf("failed to get azure virtual machine scale set: %v", err)
+	}
+
+	zap.S().Debugf("Running as instance %s within the azure virtual machine scale set %s/%s", a.config.InstanceName, a.config.ResourceGroup, a.config.ScaleSet)
+	return nil
+}
+
+func (a *azure) AutoScalingGroupStatus() ([]asg.Instance, asg.Instance, int, error) {
+	ss, err := a.management.getScaleSet(a.config.SubscriptionID, a.config.ResourceGroup, a.config.ScaleSet)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("failed to get azure virtual machine scale set: %v", err)
+	}
+	vms, err := a.management.listScaleSetVMs(a.config.SubscriptionID, a.config.ResourceGroup, a.config.ScaleSet)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("failed to list azure virtual machine scale set's instances: %v", err)
+	}
+	nics, err := a.management.listScaleSetNICs(a.config.SubscriptionID, a.config.ResourceGroup, a.config.ScaleSet)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("failed to list azure virtual machine scale set's network interfaces: %v", err)
+	}
+
+	// Resource IDs are case-insensitive, and are not always returned with the same case by the different apis.
+	privateIPs := make(map[string]string)
+	for i := range nics {
+		nic := &nics[i]
+		vmID := strings.ToLower(nic.Properties.VirtualMachine.ID)
+		if ip := nic.privateIP(); ip != "" && (nic.Properties.Primary || privateIPs[vmID] == "") {
+			privateIPs[vmID] = ip
+		}
+	}
+
+	var instances []asg.Instance
+	var self asg.Instance
+	var instancesStr []string
+	for _, vm := range vms {
+		isSelf := vm.Name == a.config.InstanceName
+
+		// Instances being created may not be booted yet, and the ones being deleted are leaving the scale set. The
+		// local instance is running regardless of what its provisioning state says.
+		state := vm.Properties.ProvisioningState
+		if state != "Succeeded" && state != "Updating" && !isSelf {
+			continue
+		}
+
+		address := privateIPs[strings.ToLower(vm.ID)]
+		if address == "" {
+			continue
+		}
+
+		instance := &instance{name: vm.Name, address: address}
+		if isSelf {
+			self = instance
+		}
+		instances = append(instances, instance)
+		instancesStr = append(instancesStr, fmt.Sprintf("%s (%s)", instance.address, strings.ToLower(state)))
+	}
+	if self == nil {
+		return nil, nil, 0, fmt.Errorf("the local instance %q is not an instance of the azure virtual machine scale set", a.config.InstanceName)
+	}
+
+	zap.S().Debugf("Discovered %d / %d replicas: %s", len(instances), ss.Sku.Capacity, strings.Join(instancesStr, ", "))
+	return instances, self, ss.Sku.Capacity, nil
+}
@@ -0,0 +1,207 @@
+// Copyright 2017 Quentin Machu & eco authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azure
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/quentin-m/etcd-cloud-operator/pkg/providers/asg"
+	"github.com/quentin-m/etcd-cloud-operator/pkg/providers/asg/asgtest"
+)
+
+const (
+	testToken     = "test-token"
+	testScaleSet  = "/subscriptions/my-subscription/resourceGroups/eco-rg/providers/Microsoft.Compute/virtualMachineScaleSets/eco"
+	testVMIDUpper = "/subscriptions/MY-SUBSCRIPTION/resourceGroups/ECO-RG/providers/Microsoft.Compute/virtualMachineScaleSets/ECO/virtualMachines/"
+)
+
+// fakeAzure serves both the instance metadata service, under /metadata, and the management api, for the instance eco_0
+// of the scale set eco. The virtual machines and network interfaces are served one per page, linked by nextLink.
+type fakeAzure struct {
+	url string
+
+	vms  []map[string]interface{}
+	nics []map[string]interface{}
+}
+
+func (f *fakeAzure) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	if strings.HasPrefix(r.URL.Path, "/metadata/") {
+		if r.Header.Get("Metadata") != "true" {
+			http.Error(w, "missing Metadata header", http.StatusBadRequest)
+			return
+		}
+		switch r.URL.Path {
+		case "/metadata/instance":
+			fmt.Fprint(w, `{"compute": {"name": "eco_0", "vmScaleSetName": "eco", "resourceGroupName": "eco-rg", "subscriptionId": "my-subscription"}}`)
+		case "/metadata/identity/oauth2/token":
+			if query.Get("resource") != f.url+"/" {
+				http.Error(w, "unexpected resource "+query.Get("resource"), http.StatusBadRequest)
+				return
+			}
+			fmt.Fprintf(w, `{"access_token": %q, "expires_in": "3599", "token_type": "Bearer"}`, testToken)
+		default:
+			http.NotFound(w, r)
+		}
+		return
+	}
+
+	if r.Header.Get("Authorization") != "Bearer "+testToken {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"error": {"code": "InvalidAuthenticationToken", "message": "invalid token"}}`)
+		return
+	}
+	if query.Get("api-version") == "" {
+		http.Error(w, "missing api-version", http.StatusBadRequest)
+		return
+	}
+
+	switch r.URL.Path {
+	case testScaleSet:
+		fmt.Fprint(w, `{"name": "eco", "sku": {"name": "Standard_D2s_v3", "capacity": 3}}`)
+	case testScaleSet + "/virtualMachines":
+		f.servePage(w, r, f.vms)
+	case testScaleSet + "/networkInterfaces":
+		f.servePage(w, r, f.nics)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeAzure) servePage(w http.ResponseWriter, r *http.Request, values []map[string]interface{}) {
+	page, _ := strconv.Atoi(r.URL.Query().Get("$skiptoken"))
+	list := map[string]interface{}{"value": values[page : page+1]}
+	if page+1 < len(values) {
+		list["nextLink"] = fmt.Sprintf("%s%s?api-version=%s&$skiptoken=%d", f.url, r.URL.Path, r.URL.Query().Get("api-version"), page+1)
+	}
+	json.NewEncoder(w).Encode(list)
+}
+
+func newFakeAzure(t *testing.T) (*fakeAzure, *azure) {
+	f := &fakeAzure{}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	f.url = server.URL
+
+	a := &azure{}
+	err := a.Configure(asg.Config{Params: map[string]interface{}{
+		"imds-endpoint":       server.URL,
+		"management-endpoint": server.URL,
+	}})
+	if err != nil {
+		t.Fatalf("failed to configure provider: %v", err)
+	}
+	return f, a
+}
+
+func vm(id, state string) map[string]interface{} {
+	return map[string]interface{}{
+		"id":         testVMIDUpper + id,
+		"name":       "eco_" + id,
+		"instanceId": id,
+		"properties": map[string]interface{}{"provisioningState": state},
+	}
+}
+
+func nic(id string, primary bool, ipConfigurations ...map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"properties": map[string]interface{}{
+			"primary":          primary,
+			"ipConfigurations": ipConfigurations,
+			"virtualMachine":   map[string]string{"id": strings.ToLower(testVMIDUpper) + id},
+		},
+	}
+}
+
+func ipConfiguration(ip string, primary bool) map[string]interface{} {
+	return map[string]interface{}{"properties": map[string]interface{}{"primary": primary, "privateIPAddress": ip}}
+}
+
+func TestConfigure(t *testing.T) {
+	_, a := newFakeAzure(t)
+	if a.config.SubscriptionID != "my-subscription" || a.config.ResourceGroup != "eco-rg" || a.config.ScaleSet != "eco" || a.config.InstanceName != "eco_0" {
+		t.Errorf("got config %+v, want the instance eco_0 of the scale set my-subscription/eco-rg/eco", a.config)
+	}
+}
+
+func TestAutoScalingGroupStatus(t *testing.T) {
+	f, a := newFakeAzure(t)
+	f.vms = []map[string]interface{}{
+		vm("0", "Succeeded"),
+		vm("1", "Updating"),
+		vm("2", "Creating"),
+		vm("3", "Deleting"),
+		vm("4", "Failed"),
+		vm("5", "Succeeded"),
+	}
+	f.nics = []map[string]interface{}{
+		// The primary IP configuration is preferred, the first one otherwise.
+		nic("0", true, ipConfiguration("10.0.0.10", false), ipConfiguration("10.0.0.1", true)),
+		nic("1", true, ipConfiguration("10.0.0.2", false), ipConfiguration("10.0.0.20", false)),
+		// The primary network interface is preferred, whichever comes first.
+		nic("5", false, ipConfiguration("10.0.1.5", true)),
+		nic("5", true, ipConfiguration("10.0.0.5", true)),
+		nic("5", false, ipConfiguration("10.0.2.5", true)),
+		nic("2", true, ipConfiguration("10.0.0.3", true)),
+		nic("3", true, ipConfiguration("10.0.0.4", true)),
+	}
+
+	instances, self, size, err := a.AutoScalingGroupStatus()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, want := asgtest.InstancesString(instances), "eco_0=10.0.0.1,eco_1=10.0.0.2,eco_5=10.0.0.5"; got != want {
+		t.Errorf("got instances %s, want %s", got, want)
+	}
+	if self.Name() != "eco_0" || self.BindAddress() != "10.0.0.1" {
+		t.Errorf("got self %s bound to %s, want eco_0 bound to 10.0.0.1", self.Name(), self.BindAddress())
+	}
+	if size != 3 {
+		t.Errorf("got size %d, want 3", size)
+	}
+}
+
+func TestAutoScalingGroupStatusSelf(t *testing.T) {
+	f, a := newFakeAzure(t)
+	f.nics = []map[string]interface{}{nic("0", true, ipConfiguration("10.0.0.1", true))}
+
+	// The local instance is running, whatever its provisioning state.
+	f.vms = []map[string]interface{}{vm("0", "Failed")}
+	if _, self, _, err := a.AutoScalingGroupStatus(); err != nil || self.Name() != "eco_0" {
+		t.Errorf("got self %v, %v, want eco_0", self, err)
+	}
+
+	f.vms = []map[string]interface{}{vm("1", "Succeeded")}
+	if _, _, _, err := a.AutoScalingGroupStatus(); err == nil || !strings.Contains(err.Error(), "is not an instance") {
+		t.Errorf("got error %v, want the local instance not to be found", err)
+	}
+}
+
+func TestManagementClientError(t *testing.T) {
+	f, a := newFakeAzure(t)
+	a.imds.token = "expired-token"
+	f.vms = []map[string]interface{}{vm("0", "Succeeded")}
+
+	if _, _, _, err := a.AutoScalingGroupStatus(); err == nil || !strings.Contains(err.Error(), "returned 401: invalid token") {
+		t.Errorf("got error %v, want the api error", err)
+	}
+}
@@ -0,0 +1,294 @@
+// Copyright 2017 Quentin Machu & eco authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dns implements an auto-scaling group provider that discovers the members from DNS records, either the SRV
+// records also used by etcd's own discovery (_etcd-server._tcp.<domain>), or the A / AAAA records of a hostname.
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/quentin-m/etcd-cloud-operator/pkg/providers"
+	"github.com/quentin-m/etcd-cloud-operator/pkg/providers/asg"
+)
+
+const (
+	recordsSRV = "srv"
+	recordsA   = "a"
+
+	lookupTimeout = 5 * time.Second
+)
+
+func init() {
+	asg.Register("dns", &dns{})
+}
+
+// resolver is the subset of net.Resolver used by the provider.
+type resolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+type dns struct {
+	config   config
+	resolver resolver
+}
+
+type config struct {
+	// Domain under which the records are published.
+	Domain string `yaml:"domain"`
+
+	// Records is the kind of records listing the members: "srv" (default), _<service>._tcp.<domain>, whose targets and
+	// ports are the members' addresses and peer ports, or "a", the addresses of hostname.
+	Records  string `yaml:"records"`
+	Service  string `yaml:"service"`
+	Hostname string `yaml:"hostname"`
+
+	// Optional, the address to listen on for SRV records, whose targets are hostnames. Defaults to 0.0.0.0.
+	BindAddress string `yaml:"bind-address"`
+
+	// Size of the cluster. When not set, it is read from the TXT record size-record, _etcd-size.<domain> by default,
+	// containing either "<size>" or "size=<size>".
+	Size       int    `yaml:"size"`
+	SizeRecord string `yaml:"size-record"`
+
+	// Optional, the name of the local member (<target>:<port> for SRV records, or the target alone if it is not shared
+	// by several members, and the address for A records). Otherwise, it is the member matching the hostname, or whose
+	// address is a local IP address.
+	Self string `yaml:"self"`
+
+	// Optional, the DNS server (host:port) to query instead of the system's resolvers.
+	Nameserver string `yaml:"nameserver"`
+}
+
+type instance struct {
+	name, address, bindAddress string
+	ports                      asg.Ports
+}
+
+func (i *instance) Name() string {
+	return i.name
+}
+
+func (i *instance) Address() string {
+	return i.address
+}
+
+func (i *instance) BindAddress() string {
+	return i.bindAddress
+}
+
+func (i *instance) Ports() asg.Ports {
+	return i.ports
+}
+
+func (d *dns) Configure(providerConfig asg.Config) error {
+	d.config = config{Records: recordsSRV, Service: "etcd-server", BindAddress: "0.0.0.0"}
+	if err := providers.ParseParams(providerConfig.Params, &d.config); err != nil {
+		return fmt.Errorf("invalid configuration: %v", err)
+	}
+	d.config.Domain = strings.TrimSuffix(d.config.Domain, ".")
+
+	switch d.config.Records {
+	case recordsSRV:
+		if d.config.Domain == "" {
+			return errors.New("invalid configuration: domain must be set")
+		}
+	case recordsA:
+		if d.config.Hostname == "" {
+			d.config.Hostname = d.config.Domain
+		}
+		if d.config.Hostname == "" {
+			return errors.New("invalid configuration: hostname or domain must be set")
+		}
+	default:
+		return fmt.Errorf("invalid configuration: records must be %q or %q", recordsSRV, recordsA)
+	}
+
+	if d.config.Size < 0 {
+		return errors.New("invalid configuration: size can not be negative")
+	}
+	if d.config.Size == 0 && d.config.SizeRecord == "" {
+		if d.config.Domain == "" {
+			return errors.New("invalid configuration: size, size-record or domain must be set")
+		}
+		d.config.SizeRecord = "_etcd-size." + d.config.Domain
+	}
+
+	d.resolver = net.DefaultResolver
+	if d.config.Nameserver != "" {
+		d.resolver = newResolver(d.config.Nameserver)
+	}
+	return nil
+}
+
+func (d *dns) AutoScalingGroupStatus() ([]asg.Instance, asg.Instance, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+
+	size, err := d.size(ctx)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	var instances []*instance
+	if d.config.Records == recordsSRV {
+		instances, err = d.lookupSRV(ctx)
+	} else {
+		instances, err = d.lookupA(ctx)
+	}
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if len(instances) == 0 {
+		return nil, nil, 0, errors.New("no member found in dns")
+	}
+
+	self, err := d.findSelf(ctx, instances)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	asgInstances := make([]asg.Instance, 0, len(instances))
+	instancesStr := make([]string, 0, len(instances))
+	for _, i := range instances {
+		asgInstances = append(asgInstances, i)
+		instancesStr = append(instancesStr, i.address)
+	}
+
+	zap.S().Debugf("Discovered %d / %d replicas: %s", len(instances), size, strings.Join(instancesStr, ", "))
+	return asgInstances, self, size, nil
+}
+
+func (d *dns) lookupSRV(ctx context.Context) ([]*instance, error) {
+	_, srvs, err := d.resolver.LookupSRV(ctx, d.config.Service, "tcp", d.config.Domain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve _%s._tcp.%s: %v", d.config.Service, d.config.Domain, err)
+	}
+
+	// Several members may share a host, and thus a target, on different ports.
+	var instances []*instance
+	seen := make(map[string]bool)
+	for _, srv := range srvs {
+		target := strings.TrimSuffix(srv.Target, ".")
+		name := net.JoinHostPort(target, strconv.Itoa(int(srv.Port)))
+		if target == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		instances = append(instances, &instance{
+			name:        name,
+			address:     target,
+			bindAddress: d.config.BindAddress,
+			ports:       asg.Ports{Peer: int(srv.Port)},
+		})
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].name < instances[j].name })
+	return instances, nil
+}
+
+func (d *dns) lookupA(ctx context.Context) ([]*instance, error) {
+	addrs, err := d.resolver.LookupIPAddr(ctx, d.config.Hostname)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %v", d.config.Hostname, err)
+	}
+
+	var instances []*instance
+	seen := make(map[string]bool)
+	for _, addr := range addrs {
+		ip := addr.IP.String()
+		if seen[ip] {
+			continue
+		}
+		seen[ip] = true
+
+		instances = append(instances, &instance{name: ip, address: ip, bindAddress: ip})
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].name < instances[j].name })
+	return instances, nil
+}
+
+// size returns the configured size of the cluster, or the one published in the size TXT record.
+func (d *dns) size(ctx context.Context) (int, error) {
+	if d.config.Size > 0 {
+		return d.config.Size, nil
+	}
+
+	txts, err := d.resolver.LookupTXT(ctx, d.config.SizeRecord)
+	if err != nil {
+		return 0, fmt.Errorf("failed to resolve the size record %s: %v", d.config.SizeRecord, err)
+	}
+	for _, txt := range txts {
+		size, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(txt), "size="))
+		if err == nil && size > 0 {
+			return size, nil
+		}
+	}
+	return 0, fmt.Errorf("no valid size found in the size record %s: %v", d.config.SizeRecord, txts)
+}
+
+// findSelf determines the local member, from the explicit override, the hostname, or the local IP addresses.
+func (d *dns) findSelf(ctx context.Context, instances []*instance) (*instance, error) {
+	if self := strings.TrimSuffix(d.config.Self, "."); self != "" {
+		var found []*instance
+		for _, i := range instances {
+			if i.name == self {
+				return i, nil
+			}
+			if i.address == self {
+				found = append(found, i)
+			}
+		}
+		switch len(found) {
+		case 0:
+			return nil, fmt.Errorf("self %q is not one of the %d members found", d.config.Self, len(instances))
+		case 1:
+			return found[0], nil
+		default:
+			return nil, fmt.Errorf("self %q is shared by several members, set it to %q or %q", d.config.Self, found[0].name, found[1].name)
+		}
+	}
+
+	asgInstances := make([]asg.Instance, 0, len(instances))
+	for _, i := range instances {
+		asgInstances = append(asgInstances, i)
+	}
+	self, err := asg.FindLocalInstance(ctx, d.resolver, asgInstances)
+	if err != nil {
+		return nil, err
+	}
+	return self.(*instance), nil
+}
+
+// newResolver returns a resolver querying the given DNS server only.
+func newResolver(nameserver string) *net.Resolver {
+	dialer := &net.Dialer{Timeout: lookupTimeout}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, nameserver)
+		},
+	}
+}
@@ -0,0 +1,248 @@
+// Copyright 2017 Quentin Machu & eco authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/quentin-m/etcd-cloud-operator/pkg/providers/asg"
+	"github.com/quentin-m/etcd-cloud-operator/pkg/providers/asg/asgtest"
+)
+
+// fakeResolver serves the records of the etcd.example.com domain.
+type fakeResolver struct {
+	srv  []*net.SRV
+	ips  map[string][]string
+	txts map[string][]string
+}
+
+func (r *fakeResolver) LookupSRV(_ context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	if service != "etcd-server" || proto != "tcp" || name != "etcd.example.com" {
+		return "", nil, errors.New("no such host")
+	}
+	return "_etcd-server._tcp.etcd.example.com.", r.srv, nil
+}
+
+func (r *fakeResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	ips, ok := r.ips[host]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	var addrs []net.IPAddr
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return addrs, nil
+}
+
+func (r *fakeResolver) LookupTXT(_ context.Context, name string) ([]string, error) {
+	txts, ok := r.txts[name]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	return txts, nil
+}
+
+func newFakeResolver() *fakeResolver {
+	return &fakeResolver{
+		srv: []*net.SRV{
+			{Target: "b.etcd.example.com.", Port: 2380},
+			{Target: "a.etcd.example.com.", Port: 2390},
+			{Target: "a.etcd.example.com.", Port: 2380},
+			// Duplicated records, and records without target, are ignored.
+			{Target: "a.etcd.example.com.", Port: 2380},
+			{Target: ".", Port: 2380},
+		},
+		ips: map[string][]string{
+			"etcd.example.com":   {"198.51.100.2", "198.51.100.1", "198.51.100.2", "fd00::1"},
+			"a.etcd.example.com": {"198.51.100.1"},
+			"b.etcd.example.com": {"127.0.0.1"},
+		},
+		txts: map[string][]string{
+			"_etcd-size.etcd.example.com": {"v=spf1 -all", "size=5"},
+			"size.example.com":            {" 7 "},
+			"invalid.example.com":         {"size=-1", "three"},
+		},
+	}
+}
+
+func newTestProvider(t *testing.T, resolver *fakeResolver, params map[string]interface{}) *dns {
+	d := &dns{}
+	if err := d.Configure(asg.Config{Params: params}); err != nil {
+		t.Fatalf("failed to configure provider: %v", err)
+	}
+	d.resolver = resolver
+	return d
+}
+
+func TestAutoScalingGroupStatusSRV(t *testing.T) {
+	d := newTestProvider(t, newFakeResolver(), map[string]interface{}{"domain": "etcd.example.com."})
+
+	instances, self, size, err := d.AutoScalingGroupStatus()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := "a.etcd.example.com:2380=a.etcd.example.com,a.etcd.example.com:2390=a.etcd.example.com,b.etcd.example.com:2380=b.etcd.example.com"
+	if got := asgtest.InstancesString(instances); got != want {
+		t.Errorf("got instances %s, want %s", got, want)
+	}
+	for i, port := range []int{2380, 2390, 2380} {
+		if got := asg.InstancePorts(instances[i], asg.Ports{Peer: 1, Client: 2}); got != (asg.Ports{Peer: port, Client: 2}) {
+			t.Errorf("got ports %+v for %s, want peer port %d", got, instances[i].Name(), port)
+		}
+	}
+	if self.Name() != "b.etcd.example.com:2380" || self.BindAddress() != "0.0.0.0" {
+		t.Errorf("got self %s bound to %s, want b.etcd.example.com:2380 bound to 0.0.0.0", self.Name(), self.BindAddress())
+	}
+	if size != 5 {
+		t.Errorf("got size %d, want 5", size)
+	}
+}
+
+func TestAutoScalingGroupStatusA(t *testing.T) {
+	d := newTestProvider(t, newFakeResolver(), map[string]interface{}{"domain": "etcd.example.com", "records": "a", "size": 3, "self": "198.51.100.2"})
+
+	instances, self, size, err := d.AutoScalingGroupStatus()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, want := asgtest.InstancesString(instances), "198.51.100.1=198.51.100.1,198.51.100.2=198.51.100.2,fd00::1=fd00::1"; got != want {
+		t.Errorf("got instances %s, want %s", got, want)
+	}
+	if self.Name() != "198.51.100.2" || self.BindAddress() != "198.51.100.2" {
+		t.Errorf("got self %s bound to %s, want 198.51.100.2 bound to itself", self.Name(), self.BindAddress())
+	}
+	if size != 3 {
+		t.Errorf("got size %d, want 3", size)
+	}
+}
+
+func TestSize(t *testing.T) {
+	for _, tc := range []struct {
+		params map[string]interface{}
+		want   int
+	}{
+		{params: map[string]interface{}{"size": 3}, want: 3},
+		{params: map[string]interface{}{}, want: 5},
+		{params: map[string]interface{}{"size-record": "size.example.com"}, want: 7},
+		{params: map[string]interface{}{"size-record": "invalid.example.com"}},
+		{params: map[string]interface{}{"size-record": "missing.example.com"}},
+	} {
+		tc.params["domain"] = "etcd.example.com"
+		d := newTestProvider(t, newFakeResolver(), tc.params)
+
+		size, err := d.size(context.Background())
+		if tc.want == 0 {
+			if err == nil {
+				t.Errorf("got size %d with params %v, want an error", size, tc.params)
+			}
+			continue
+		}
+		if err != nil || size != tc.want {
+			t.Errorf("got size %d, %v with params %v, want %d", size, err, tc.params, tc.want)
+		}
+	}
+}
+
+func TestFindSelf(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatalf("failed to get hostname: %v", err)
+	}
+	local := strings.SplitN(hostname, ".", 2)[0] + ".etcd.example.com."
+
+	for _, tc := range []struct {
+		name      string
+		self      string
+		srv       []*net.SRV
+		ips       map[string][]string
+		want, err string
+	}{
+		{name: "override", self: "a.etcd.example.com:2390", want: "a.etcd.example.com:2390"},
+		{name: "override by unique target", self: "b.etcd.example.com.", want: "b.etcd.example.com:2380"},
+		{name: "override by shared target", self: "a.etcd.example.com", err: "shared by several members"},
+		{name: "unknown override", self: "c.etcd.example.com", err: "is not one of the 3 members found"},
+		{name: "local address", want: "b.etcd.example.com:2380"},
+		{
+			name: "hostname",
+			srv:  []*net.SRV{{Target: local, Port: 2380}, {Target: "b.etcd.example.com.", Port: 2380}},
+			want: strings.TrimSuffix(local, ".") + ":2380",
+		},
+		{
+			name: "hostname shared by members on different ports",
+			srv:  []*net.SRV{{Target: local, Port: 2380}, {Target: local, Port: 2390}, {Target: "b.etcd.example.com.", Port: 2380}},
+			err:  "set self to pick one",
+		},
+		{
+			name: "shared local address",
+			ips:  map[string][]string{"a.etcd.example.com": {"127.0.0.1"}, "b.etcd.example.com": {"198.51.100.2"}},
+			err:  "set self to pick one",
+		},
+		{
+			name: "no local address",
+			ips:  map[string][]string{"a.etcd.example.com": {"198.51.100.1"}},
+			err:  "none of the members",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resolver := newFakeResolver()
+			if tc.srv != nil {
+				resolver.srv = tc.srv
+			}
+			if tc.ips != nil {
+				resolver.ips = tc.ips
+			}
+			d := newTestProvider(t, resolver, map[string]interface{}{"domain": "etcd.example.com", "size": 3, "self": tc.self})
+
+			_, self, _, err := d.AutoScalingGroupStatus()
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("got error %v, want %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if self.Name() != tc.want {
+				t.Errorf("got self %s, want %s", self.Name(), tc.want)
+			}
+		})
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	for _, tc := range []struct {
+		params map[string]interface{}
+		err    string
+	}{
+		{params: map[string]interface{}{}, err: "domain must be set"},
+		{params: map[string]interface{}{"records": "a"}, err: "hostname or domain must be set"},
+		{params: map[string]interface{}{"records": "a", "hostname": "etcd.example.com"}, err: "size, size-record or domain must be set"},
+		{params: map[string]interface{}{"records": "mx", "domain": "etcd.example.com"}, err: "records must be"},
+		{params: map[string]interface{}{"domain": "etcd.example.com", "size": -1}, err: "size can not be negative"},
+	} {
+		d := &dns{}
+		if err := d.Configure(asg.Config{Params: tc.params}); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("got error %v with params %v, want %q", err, tc.params, tc.err)
+		}
+	}
+}
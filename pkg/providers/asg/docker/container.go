@@ -15,11 +15,19 @@
 package docker
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
-	"os/exec"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
 	"strings"
+	"time"
 )
 
+const engineTimeout = 10 * time.Second
+
 type container struct {
 	id, name, address string
 }
@@ -36,26 +44,144 @@ func (i *container) BindAddress() string {
 	return i.address
 }
 
-func containerList(namePattern string) ([]string, error) {
-	out, err := exec.Command("docker", "ps", fmt.Sprintf("--filter=name=%s", namePattern), "--format={{ .Names }}").CombinedOutput()
+// engineClient is a minimal client of the Docker Engine API.
+type engineClient struct {
+	endpoint string
+	http     *http.Client
+}
+
+// newEngineClient creates a client for the given Docker host, either unix:///path/to/docker.sock or tcp://host:port.
+func newEngineClient(host string) (*engineClient, error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid docker host %q: %v", host, err)
+	}
+
+	switch u.Scheme {
+	case "unix":
+		socket := u.Path
+		dialer := &net.Dialer{Timeout: engineTimeout}
+		return &engineClient{
+			// The host is ignored, all connections go through the socket.
+			endpoint: "http://docker",
+			http: &http.Client{
+				Timeout: engineTimeout,
+				Transport: &http.Transport{
+					DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+						return dialer.DialContext(ctx, "unix", socket)
+					},
+				},
+			},
+		}, nil
+	case "tcp", "http":
+		return &engineClient{endpoint: "http://" + u.Host, http: &http.Client{Timeout: engineTimeout}}, nil
+	default:
+		return nil, fmt.Errorf("unsupported docker host %q", host)
+	}
+}
+
+func (c *engineClient) get(path string, query url.Values, v interface{}) error {
+	u := c.endpoint + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	resp, err := c.http.Get(u)
 	if err != nil {
-		return nil, fmt.Errorf("failed to list containers: %s", bytesToTrimmedString(out))
+		return fmt.Errorf("failed to query docker engine: %v", err)
 	}
-	return strings.Split(bytesToTrimmedString(out), "\n"), nil
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Message string `json:"message"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&e) == nil && e.Message != "" {
+			return fmt.Errorf("docker engine returned %d for %s: %s", resp.StatusCode, path, e.Message)
+		}
+		return fmt.Errorf("docker engine returned %d for %s", resp.StatusCode, path)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
 }
 
-func containerInspect(name string) (*container, error) {
-	out, err := exec.Command("docker", "inspect", `--format={{ .ID}},{{ .Name }},{{range $k, $v := .NetworkSettings.Networks}}{{printf "%s" $v.IPAddress}}{{end}}`, name).CombinedOutput()
+// containerList lists the running containers whose name contains the given pattern, and that have all the given
+// labels.
+func (c *engineClient) containerList(namePattern string, labels map[string]string) ([]containerSummary, error) {
+	filters := map[string][]string{"status": {"running"}}
+	if namePattern != "" {
+		filters["name"] = []string{namePattern}
+	}
+	for k, v := range labels {
+		filters["label"] = append(filters["label"], k+"="+v)
+	}
+	filtersJSON, err := json.Marshal(filters)
 	if err != nil {
-		return nil, fmt.Errorf("failed to inspect container %q: %s", name, bytesToTrimmedString(out))
+		return nil, err
 	}
-	if outSplit := strings.Split(bytesToTrimmedString(out), ","); len(outSplit) == 3 {
-		return &container{id: outSplit[0], name: strings.TrimPrefix(outSplit[1], "/"), address: outSplit[2]}, nil
+
+	var containers []containerSummary
+	if err := c.get("/containers/json", url.Values{"filters": {string(filtersJSON)}}, &containers); err != nil {
+		return nil, fmt.Errorf("failed to list containers: %v", err)
 	}
+	return containers, nil
+}
+
+// containerHostname returns the hostname configured in the given container.
+func (c *engineClient) containerHostname(id string) (string, error) {
+	var inspect struct {
+		Config struct {
+			Hostname string `json:"Hostname"`
+		} `json:"Config"`
+	}
+	if err := c.get("/containers/"+id+"/json", nil, &inspect); err != nil {
+		return "", fmt.Errorf("failed to inspect container %q: %v", id, err)
+	}
+	return inspect.Config.Hostname, nil
+}
 
-	return nil, fmt.Errorf("failed to inspect container %q: unexpected output: %s", name, bytesToTrimmedString(out))
+type containerSummary struct {
+	ID              string            `json:"Id"`
+	Names           []string          `json:"Names"`
+	Labels          map[string]string `json:"Labels"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress         string `json:"IPAddress"`
+			GlobalIPv6Address string `json:"GlobalIPv6Address"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
 }
 
-func bytesToTrimmedString(b []byte) string {
-	return strings.TrimSuffix(string(b), "\n")
+func (s *containerSummary) name() string {
+	if len(s.Names) == 0 {
+		return s.ID
+	}
+	return strings.TrimPrefix(s.Names[0], "/")
+}
+
+// address returns the address of the container on the first of the given networks it is attached to, or on any
+// network if none is given.
+func (s *containerSummary) address(networks []string) string {
+	addressOn := func(network string) string {
+		n, ok := s.NetworkSettings.Networks[network]
+		if !ok {
+			return ""
+		}
+		if n.IPAddress != "" {
+			return n.IPAddress
+		}
+		return n.GlobalIPv6Address
+	}
+
+	if len(networks) == 0 {
+		for network := range s.NetworkSettings.Networks {
+			networks = append(networks, network)
+		}
+		sort.Strings(networks)
+	}
+	for _, network := range networks {
+		if address := addressOn(network); address != "" {
+			return address
+		}
+	}
+	return ""
 }
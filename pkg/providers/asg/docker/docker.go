@@ -16,7 +16,9 @@ package docker
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"regexp"
 	"strings"
 
 	"go.uber.org/zap"
@@ -25,50 +27,139 @@ import (
 	"github.com/quentin-m/etcd-cloud-operator/pkg/providers/asg"
 )
 
+const defaultDockerHost = "unix:///var/run/docker.sock"
+
+// containerIDPattern matches the ID of the container the process runs in, as found in /proc/self/cgroup (cgroup v1)
+// or /proc/self/mountinfo (cgroup v2, through the bind-mounted /etc/hostname).
+var containerIDPattern = regexp.MustCompile(`(?:/docker/|/docker-|/containers/)([0-9a-f]{64})`)
+
 func init() {
 	asg.Register("docker", &docker{})
 }
 
 type docker struct {
 	config config
+	client *engineClient
+
+	// ID of the container the operator runs in, if it could be found in /proc.
+	selfID string
 }
 
 type config struct {
-	Size       int    `yaml:"size"`
-	NameFilter string `yaml:"name-filter"`
+	Size int `yaml:"size"`
+
+	// Optional, the containers must have a name containing NameFilter, and all the Labels (e.g.
+	// com.docker.compose.project: eco).
+	NameFilter string            `yaml:"name-filter"`
+	Labels     map[string]string `yaml:"labels"`
+
+	// Optional, the networks on which the containers are addressed, by order of preference. Defaults to any.
+	Networks []string `yaml:"networks"`
+
+	// Optional, the Docker Engine API endpoint, defaults to DOCKER_HOST or the local unix socket.
+	Host string `yaml:"host"`
+
+	// Optional, the name or ID of the local container. Otherwise, it is found from /proc, or from the hostname.
+	Self string `yaml:"self"`
 }
 
 func (d *docker) Configure(providerConfig asg.Config) error {
-	d.config = config{Size: 3, NameFilter: "eco-"}
+	d.config = config{Size: 3, NameFilter: "eco-", Host: os.Getenv("DOCKER_HOST")}
 	if err := providers.ParseParams(providerConfig.Params, &d.config); err != nil {
 		return fmt.Errorf("invalid configuration: %v", err)
 	}
+	if d.config.Host == "" {
+		d.config.Host = defaultDockerHost
+	}
+
+	client, err := newEngineClient(d.config.Host)
+	if err != nil {
+		return err
+	}
+	d.client = client
+	d.selfID = findContainerID()
 	return nil
 }
 
 func (d *docker) AutoScalingGroupStatus() (instances []asg.Instance, self asg.Instance, size int, err error) {
 	instancesStr := make([]string, 0, d.config.Size)
-	hostname, _ := os.Hostname()
 
-	// List all containers names, which match the filter.
-	containerNames, err := containerList(d.config.NameFilter)
+	summaries, err := d.client.containerList(d.config.NameFilter, d.config.Labels)
 	if err != nil {
 		return nil, nil, 0, err
 	}
 
-	for _, name := range containerNames {
-		container, err := containerInspect(name)
-		if err != nil {
-			return nil, nil, 0, err
+	for i := range summaries {
+		summary := &summaries[i]
+
+		c := &container{id: summary.ID, name: summary.name(), address: summary.address(d.config.Networks)}
+		if c.address == "" {
+			zap.S().Warnf("container %q has no address on networks %v, ignoring it", c.name, d.config.Networks)
+			continue
 		}
-		if strings.Contains(container.id, hostname) {
-			self = container
+		if d.isSelf(summary) {
+			self = c
 		}
-		instances = append(instances, container)
-		instancesStr = append(instancesStr, container.address)
+		instances = append(instances, c)
+		instancesStr = append(instancesStr, c.address)
+	}
+
+	// Without an explicit override, fall back to comparing the hostnames, as the container ID may not be visible
+	// from within the container (e.g. with a private cgroup namespace).
+	if self == nil && d.config.Self == "" {
+		self = d.findSelfByHostname(instances)
+	}
+	if self == nil {
+		return nil, nil, 0, fmt.Errorf("the local container is not one of the %d containers found", len(instances))
 	}
 	size = d.config.Size
 
 	zap.S().Debugf("Discovered %d / %d replicas: %s", len(instances), d.config.Size, strings.Join(instancesStr, ", "))
 	return
 }
+
+func (d *docker) isSelf(summary *containerSummary) bool {
+	if d.config.Self != "" {
+		return d.config.Self == summary.name() || strings.HasPrefix(summary.ID, d.config.Self)
+	}
+	return d.selfID != "" && summary.ID == d.selfID
+}
+
+// findSelfByHostname returns the container whose hostname is the local one, which is the short container ID unless
+// it has been set explicitly.
+func (d *docker) findSelfByHostname(instances []asg.Instance) asg.Instance {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil
+	}
+
+	for _, instance := range instances {
+		c := instance.(*container)
+		if strings.HasPrefix(c.id, hostname) {
+			return c
+		}
+		containerHostname, err := d.client.containerHostname(c.id)
+		if err != nil {
+			zap.S().With(zap.Error(err)).Warnf("failed to get the hostname of container %q", c.name)
+			continue
+		}
+		if containerHostname == hostname {
+			return c
+		}
+	}
+	return nil
+}
+
+// findContainerID returns the ID of the container the process runs in, or "" if it can not be found.
+func findContainerID() string {
+	for _, path := range []string{"/proc/self/cgroup", "/proc/self/mountinfo"} {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		if m := containerIDPattern.FindSubmatch(b); m != nil {
+			return string(m[1])
+		}
+	}
+	return ""
+}
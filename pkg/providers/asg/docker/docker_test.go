@@ -0,0 +1,257 @@
+// Copyright 2017 Quentin Machu & eco authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/quentin-m/etcd-cloud-operator/pkg/providers/asg"
+	"github.com/quentin-m/etcd-cloud-operator/pkg/providers/asg/asgtest"
+)
+
+type fakeContainer struct {
+	id, name, hostname string
+	running            bool
+	labels             map[string]string
+
+	// IPv4 and IPv6 addresses, by network.
+	ipv4, ipv6 map[string]string
+}
+
+// fakeEngine serves the subset of the Docker Engine API used by the provider.
+type fakeEngine struct {
+	containers []fakeContainer
+}
+
+func (f *fakeEngine) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/containers/json" {
+		var filters map[string][]string
+		if err := json.Unmarshal([]byte(r.URL.Query().Get("filters")), &filters); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		summaries := []map[string]interface{}{}
+		for _, c := range f.containers {
+			if !f.matches(c, filters) {
+				continue
+			}
+			networks := make(map[string]interface{})
+			for network, ip := range c.ipv4 {
+				networks[network] = map[string]string{"IPAddress": ip}
+			}
+			for network, ip := range c.ipv6 {
+				networks[network] = map[string]string{"IPAddress": c.ipv4[network], "GlobalIPv6Address": ip}
+			}
+			summaries = append(summaries, map[string]interface{}{
+				"Id":              c.id,
+				"Names":           []string{"/" + c.name},
+				"Labels":          c.labels,
+				"NetworkSettings": map[string]interface{}{"Networks": networks},
+			})
+		}
+		json.NewEncoder(w).Encode(summaries)
+		return
+	}
+
+	for _, c := range f.containers {
+		if r.URL.Path == "/containers/"+c.id+"/json" {
+			fmt.Fprintf(w, `{"Id": %q, "Config": {"Hostname": %q}}`, c.id, c.hostname)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNotFound)
+	fmt.Fprint(w, `{"message": "no such container"}`)
+}
+
+func (f *fakeEngine) matches(c fakeContainer, filters map[string][]string) bool {
+	for _, status := range filters["status"] {
+		if status == "running" && !c.running {
+			return false
+		}
+	}
+	for _, name := range filters["name"] {
+		if !strings.Contains(c.name, name) {
+			return false
+		}
+	}
+	for _, label := range filters["label"] {
+		kv := strings.SplitN(label, "=", 2)
+		if v, ok := c.labels[kv[0]]; !ok || v != kv[1] {
+			return false
+		}
+	}
+	return true
+}
+
+// newFakeEngine serves a fake engine on a unix socket, and returns the docker host to reach it.
+func newFakeEngine(t *testing.T, hostname string) string {
+	eco := map[string]string{"com.docker.compose.project": "eco"}
+	fake := &fakeEngine{containers: []fakeContainer{
+		{
+			id: strings.Repeat("a", 64), name: "eco-0", hostname: "aaaaaaaaaaaa", running: true, labels: eco,
+			ipv4: map[string]string{"bridge": "172.17.0.2", "eco_default": "10.0.0.2"},
+		},
+		{
+			id: strings.Repeat("b", 64), name: "eco-1", hostname: hostname, running: true, labels: eco,
+			ipv6: map[string]string{"eco_default": "fd00::3"},
+		},
+		{id: strings.Repeat("c", 64), name: "eco-2", running: true, labels: map[string]string{"com.docker.compose.project": "other"}, ipv4: map[string]string{"bridge": "172.17.0.4"}},
+		{id: strings.Repeat("d", 64), name: "web", running: true, labels: eco, ipv4: map[string]string{"bridge": "172.17.0.5"}},
+		{id: strings.Repeat("e", 64), name: "eco-3", running: true, labels: eco},
+		{id: strings.Repeat("f", 64), name: "eco-4", labels: eco, ipv4: map[string]string{"bridge": "172.17.0.7"}},
+	}}
+
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("failed to listen on %q: %v", socket, err)
+	}
+	server := httptest.NewUnstartedServer(fake)
+	server.Listener.Close()
+	server.Listener = l
+	server.Start()
+	t.Cleanup(server.Close)
+
+	return "unix://" + socket
+}
+
+func newTestProvider(t *testing.T, host string, params map[string]interface{}) *docker {
+	p := map[string]interface{}{"host": host, "labels": map[string]interface{}{"com.docker.compose.project": "eco"}}
+	for k, v := range params {
+		p[k] = v
+	}
+
+	d := &docker{}
+	if err := d.Configure(asg.Config{Params: p}); err != nil {
+		t.Fatalf("failed to configure provider: %v", err)
+	}
+	// The tests may run in a container, which must not be taken for one of the fake ones.
+	d.selfID = ""
+	return d
+}
+
+func TestAutoScalingGroupStatus(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatalf("failed to get hostname: %v", err)
+	}
+	host := newFakeEngine(t, hostname)
+
+	for _, tc := range []struct {
+		name   string
+		params map[string]interface{}
+
+		instances, self string
+	}{
+		{
+			name:      "any network",
+			params:    map[string]interface{}{"self": "eco-0"},
+			instances: "eco-0=172.17.0.2,eco-1=fd00::3",
+			self:      "eco-0",
+		},
+		{
+			name:      "preferred network",
+			params:    map[string]interface{}{"self": "eco-0", "networks": []string{"missing", "eco_default", "bridge"}},
+			instances: "eco-0=10.0.0.2,eco-1=fd00::3",
+			self:      "eco-0",
+		},
+		{
+			name:      "single network",
+			params:    map[string]interface{}{"self": "eco-0", "networks": []string{"bridge"}},
+			instances: "eco-0=172.17.0.2",
+			self:      "eco-0",
+		},
+		{
+			name:      "self by id",
+			params:    map[string]interface{}{"self": "bbbbbbbbbbbb"},
+			instances: "eco-0=172.17.0.2,eco-1=fd00::3",
+			self:      "eco-1",
+		},
+		{
+			name:      "self by hostname",
+			instances: "eco-0=172.17.0.2,eco-1=fd00::3",
+			self:      "eco-1",
+		},
+		{
+			name:      "name filter",
+			params:    map[string]interface{}{"self": "web", "name-filter": "web"},
+			instances: "web=172.17.0.5",
+			self:      "web",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d := newTestProvider(t, host, tc.params)
+
+			instances, self, size, err := d.AutoScalingGroupStatus()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got := asgtest.InstancesString(instances); got != tc.instances {
+				t.Errorf("got instances %s, want %s", got, tc.instances)
+			}
+			if self.Name() != tc.self || self.BindAddress() != self.Address() {
+				t.Errorf("got self %s bound to %s, want %s bound to its address", self.Name(), self.BindAddress(), tc.self)
+			}
+			if size != 3 {
+				t.Errorf("got size %d, want 3", size)
+			}
+		})
+	}
+}
+
+func TestAutoScalingGroupStatusWithoutSelf(t *testing.T) {
+	host := newFakeEngine(t, "another-host")
+
+	for _, params := range []map[string]interface{}{
+		// Without an override, the local container is looked up by hostname, which matches none of them.
+		nil,
+		// With an override, the hostname is not looked up.
+		{"self": "eco-9"},
+	} {
+		d := newTestProvider(t, host, params)
+		if _, _, _, err := d.AutoScalingGroupStatus(); err == nil {
+			t.Errorf("expected an error with params %v", params)
+		}
+	}
+}
+
+func TestNewEngineClient(t *testing.T) {
+	for host, want := range map[string]string{
+		"unix:///var/run/docker.sock": "http://docker",
+		"tcp://10.0.0.1:2375":         "http://10.0.0.1:2375",
+		"ssh://10.0.0.1":              "",
+	} {
+		c, err := newEngineClient(host)
+		if want == "" {
+			if err == nil {
+				t.Errorf("expected an error for %q", host)
+			}
+			continue
+		}
+		if err != nil || c.endpoint != want {
+			t.Errorf("got %v, %v for %q, want endpoint %q", c, err, host, want)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+// Copyright 2017 Quentin Machu & eco authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gce
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const apiTimeout = 10 * time.Second
+
+// metadataClient is a minimal client of the GCE metadata server.
+type metadataClient struct {
+	endpoint string
+	http     *http.Client
+
+	tokenM      sync.Mutex
+	token       string
+	tokenExpiry time.Time
+}
+
+func newMetadataClient(endpoint string) *metadataClient {
+	return &metadataClient{endpoint: strings.TrimSuffix(endpoint, "/"), http: &http.Client{Timeout: apiTimeout}}
+}
+
+func (c *metadataClient) get(path string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, c.endpoint+path, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to query gce metadata server: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read gce metadata %s: %v", path, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("gce metadata server returned %d for %s", resp.StatusCode, path)
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// accessToken returns an access token of the instance's default service account, cached until shortly before it
+// expires.
+func (c *metadataClient) accessToken() (string, error) {
+	c.tokenM.Lock()
+	defer c.tokenM.Unlock()
+
+	if c.token != "" && time.Now().Before(c.tokenExpiry) {
+		return c.token, nil
+	}
+
+	body, err := c.get("/instance/service-accounts/default/token")
+	if err != nil {
+		return "", err
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal([]byte(body), &token); err != nil {
+		return "", fmt.Errorf("failed to decode gce access token: %v", err)
+	}
+	c.token, c.tokenExpiry = token.AccessToken, time.Now().Add(time.Duration(token.ExpiresIn)*time.Second-time.Minute)
+	return c.token, nil
+}
+
+// computeClient is a minimal client of the Compute Engine API.
+type computeClient struct {
+	endpoint string
+	metadata *metadataClient
+	http     *http.Client
+}
+
+func newComputeClient(endpoint string, metadata *metadataClient) *computeClient {
+	return &computeClient{endpoint: strings.TrimSuffix(endpoint, "/"), metadata: metadata, http: &http.Client{Timeout: apiTimeout}}
+}
+
+// do queries the given path of the API, and decodes the response into v.
+func (c *computeClient) do(method, path string, query url.Values, body io.Reader, v interface{}) error {
+	u := c.endpoint + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	token, err := c.metadata.accessToken()
+	if err != nil {
+		return fmt.Errorf("failed to get gce access token: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to query gce compute api: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var e apiError
+		if json.NewDecoder(resp.Body).Decode(&e) == nil && e.Error.Message != "" {
+			return fmt.Errorf("gce compute api returned %d for %s: %s", resp.StatusCode, path, e.Error.Message)
+		}
+		return fmt.Errorf("gce compute api returned %d for %s", resp.StatusCode, path)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// getInstanceGroupManager returns the managed instance group at the given location (zones/<zone> or
+// regions/<region>).
+func (c *computeClient) getInstanceGroupManager(project, location, name string) (*instanceGroupManager, error) {
+	var igm instanceGroupManager
+	path := fmt.Sprintf("/projects/%s/%s/instanceGroupManagers/%s", project, location, name)
+	if err := c.do(http.MethodGet, path, nil, nil, &igm); err != nil {
+		return nil, err
+	}
+	return &igm, nil
+}
+
+func (c *computeClient) listManagedInstances(project, location, name string) ([]managedInstance, error) {
+	var instances []managedInstance
+	path := fmt.Sprintf("/projects/%s/%s/instanceGroupManagers/%s/listManagedInstances", project, location, name)
+	query := url.Values{}
+	for {
+		var list managedInstanceList
+		if err := c.do(http.MethodPost, path, query, nil, &list); err != nil {
+			return nil, err
+		}
+		instances = append(instances, list.ManagedInstances...)
+		if list.NextPageToken == "" {
+			return instances, nil
+		}
+		query.Set("pageToken", list.NextPageToken)
+	}
+}
+
+// listInstances returns the running instances at the given location, keyed by instanceKey. The instances of regional
+// groups span the zones of the region, hence they are listed across all zones.
+func (c *computeClient) listInstances(project, location string) (map[string]computeInstance, error) {
+	path := fmt.Sprintf("/projects/%s/%s/instances", project, location)
+	if strings.HasPrefix(location, "regions/") {
+		path = fmt.Sprintf("/projects/%s/aggregated/instances", project)
+	}
+
+	instances := make(map[string]computeInstance)
+	query := url.Values{"filter": {`status = "RUNNING"`}}
+	for {
+		var list instanceList
+		if err := c.do(http.MethodGet, path, query, nil, &list); err != nil {
+			return nil, err
+		}
+		for _, instance := range list.instances() {
+			instances[instanceKey(instance.SelfLink)] = instance
+		}
+		if list.NextPageToken == "" {
+			return instances, nil
+		}
+		query.Set("pageToken", list.NextPageToken)
+	}
+}
+
+// instanceKey returns the part of an instance URL that identifies it regardless of the endpoint, i.e.
+// projects/<project>/zones/<zone>/instances/<name>.
+func instanceKey(instanceURL string) string {
+	if i := strings.Index(instanceURL, "projects/"); i >= 0 {
+		return instanceURL[i:]
+	}
+	return instanceURL
+}
+
+// The subset of the Compute Engine objects used by the provider.
+
+type apiError struct {
+	Error struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+type instanceGroupManager struct {
+	Name       string `json:"name"`
+	TargetSize int    `json:"targetSize"`
+}
+
+type managedInstanceList struct {
+	ManagedInstances []managedInstance `json:"managedInstances"`
+	NextPageToken    string            `json:"nextPageToken"`
+}
+
+type managedInstance struct {
+	Instance       string `json:"instance"`
+	InstanceStatus string `json:"instanceStatus"`
+	CurrentAction  string `json:"currentAction"`
+}
+
+// instanceList is either a list of the instances of a zone, whose items are the instances, or an aggregated list,
+// whose items are the instances of each zone.
+type instanceList struct {
+	Items         json.RawMessage `json:"items"`
+	NextPageToken string          `json:"nextPageToken"`
+}
+
+func (l *instanceList) instances() []computeInstance {
+	var instances []computeInstance
+	if json.Unmarshal(l.Items, &instances) == nil {
+		return instances
+	}
+	var scopes map[string]struct {
+		Instances []computeInstance `json:"instances"`
+	}
+	if json.Unmarshal(l.Items, &scopes) == nil {
+		for _, scope := range scopes {
+			instances = append(instances, scope.Instances...)
+		}
+	}
+	return instances
+}
+
+type computeInstance struct {
+	SelfLink          string `json:"selfLink"`
+	Name              string `json:"name"`
+	Status            string `json:"status"`
+	NetworkInterfaces []struct {
+		NetworkIP string `json:"networkIP"`
+	} `json:"networkInterfaces"`
+}
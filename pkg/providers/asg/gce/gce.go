@@ -0,0 +1,188 @@
+// Copyright 2017 Quentin Machu & eco authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package gce implements an auto-scaling group provider for Google Compute Engine managed instance groups.
+package gce
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/quentin-m/etcd-cloud-operator/pkg/providers"
+	"github.com/quentin-m/etcd-cloud-operator/pkg/providers/asg"
+)
+
+const (
+	defaultMetadataEndpoint = "http://metadata.google.internal/computeMetadata/v1"
+	defaultComputeEndpoint  = "https://compute.googleapis.com/compute/v1"
+)
+
+func init() {
+	asg.Register("gce", &gce{})
+}
+
+type gce struct {
+	config   config
+	metadata *metadataClient
+	compute  *computeClient
+
+	// Location of the managed instance group, either zones/<zone> or regions/<region>.
+	location string
+}
+
+type config struct {
+	// Optional, discovered from the metadata server otherwise. Region is only set for regional instance groups.
+	Project       string `yaml:"project"`
+	Zone          string `yaml:"zone"`
+	Region        string `yaml:"region"`
+	InstanceGroup string `yaml:"instance-group"`
+	InstanceName  string `yaml:"instance-name"`
+
+	// Optional, allow to use custom (e.g. local) endpoints for the metadata server and the compute api.
+	MetadataEndpoint string `yaml:"metadata-endpoint"`
+	ComputeEndpoint  string `yaml:"compute-endpoint"`
+}
+
+type instance struct {
+	name, address string
+}
+
+func (i *instance) Name() string {
+	return i.name
+}
+
+func (i *instance) Address() string {
+	return i.address
+}
+
+func (i *instance) BindAddress() string {
+	return i.address
+}
+
+func (g *gce) Configure(providerConfig asg.Config) error {
+	g.config = config{MetadataEndpoint: defaultMetadataEndpoint, ComputeEndpoint: defaultComputeEndpoint}
+	if err := providers.ParseParams(providerConfig.Params, &g.config); err != nil {
+		return fmt.Errorf("invalid configuration: %v", err)
+	}
+	if g.config.Zone != "" && g.config.Region != "" {
+		return errors.New("invalid configuration: only one of zone and region can be set")
+	}
+	g.metadata = newMetadataClient(g.config.MetadataEndpoint)
+	g.compute = newComputeClient(g.config.ComputeEndpoint, g.metadata)
+
+	if err := g.discover(); err != nil {
+		return err
+	}
+
+	// Fetch the managed instance group once to verify it exists.
+	if _, err := g.compute.getInstanceGroupManager(g.config.Project, g.location, g.config.InstanceGroup); err != nil {
+		return fmt.Errorf("failed to get gce managed instance group: %v", err)
+	}
+
+	zap.S().Debugf("Running as instance %s within the gce managed instance group %s/%s", g.config.InstanceName, g.location, g.config.InstanceGroup)
+	return nil
+}
+
+// discover fills the project, location, instance group and instance name that are not configured, from the metadata
+// server.
+func (g *gce) discover() error {
+	var err error
+	if g.config.Project == "" {
+		if g.config.Project, err = g.metadata.get("/project/project-id"); err != nil {
+			return fmt.Errorf("application is not running on gce: %v", err)
+		}
+	}
+	if g.config.InstanceName == "" {
+		if g.config.InstanceName, err = g.metadata.get("/instance/name"); err != nil {
+			return fmt.Errorf("application is not running on gce: %v", err)
+		}
+	}
+
+	// The created-by attribute is set by the managed instance group on its instances, as
+	// projects/<number>/zones/<zone>/instanceGroupManagers/<name>, or regions/<region> for regional groups.
+	if g.config.InstanceGroup == "" || (g.config.Zone == "" && g.config.Region == "") {
+		createdBy, err := g.metadata.get("/instance/attributes/created-by")
+		if err != nil {
+			return fmt.Errorf("application is not running inside a gce managed instance group: %v", err)
+		}
+		parts := strings.Split(createdBy, "/")
+		if len(parts) != 6 || parts[4] != "instanceGroupManagers" || (parts[2] != "zones" && parts[2] != "regions") {
+			return fmt.Errorf("application is not running inside a gce managed instance group (created by %q)", createdBy)
+		}
+		if g.config.InstanceGroup == "" {
+			g.config.InstanceGroup = parts[5]
+		}
+		if g.config.Zone == "" && g.config.Region == "" {
+			g.location = parts[2] + "/" + parts[3]
+		}
+	}
+
+	if g.config.Zone != "" {
+		g.location = "zones/" + g.config.Zone
+	}
+	if g.config.Region != "" {
+		g.location = "regions/" + g.config.Region
+	}
+	return nil
+}
+
+func (g *gce) AutoScalingGroupStatus() ([]asg.Instance, asg.Instance, int, error) {
+	igm, err := g.compute.getInstanceGroupManager(g.config.Project, g.location, g.config.InstanceGroup)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("failed to get gce managed instance group: %v", err)
+	}
+	managedInstances, err := g.compute.listManagedInstances(g.config.Project, g.location, g.config.InstanceGroup)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("failed to list gce managed instance group's instances: %v", err)
+	}
+	// The addresses are not part of the managed instances, list them all at once rather than describing each instance.
+	gceInstances, err := g.compute.listInstances(g.config.Project, g.location)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("failed to list gce instances: %v", err)
+	}
+
+	var instances []asg.Instance
+	var self asg.Instance
+	var instancesStr []string
+	for _, mi := range managedInstances {
+		name := path.Base(mi.Instance)
+
+		// Instances that are not running can not be reached, and the ones being abandoned are leaving the group.
+		if mi.InstanceStatus != "RUNNING" || mi.CurrentAction == "ABANDONING" {
+			continue
+		}
+
+		gceInstance, ok := gceInstances[instanceKey(mi.Instance)]
+		if !ok || len(gceInstance.NetworkInterfaces) == 0 || gceInstance.NetworkInterfaces[0].NetworkIP == "" {
+			continue
+		}
+
+		instance := &instance{name: name, address: gceInstance.NetworkInterfaces[0].NetworkIP}
+		if instance.name == g.config.InstanceName {
+			self = instance
+		}
+		instances = append(instances, instance)
+		instancesStr = append(instancesStr, fmt.Sprintf("%s (%s)", instance.address, strings.ToLower(mi.CurrentAction)))
+	}
+	if self == nil {
+		return nil, nil, 0, fmt.Errorf("the local instance %q is not a running instance of the gce managed instance group", g.config.InstanceName)
+	}
+
+	zap.S().Debugf("Discovered %d / %d replicas: %s", len(instances), igm.TargetSize, strings.Join(instancesStr, ", "))
+	return instances, self, igm.TargetSize, nil
+}
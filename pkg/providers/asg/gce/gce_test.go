@@ -0,0 +1,233 @@
+// Copyright 2017 Quentin Machu & eco authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gce
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/quentin-m/etcd-cloud-operator/pkg/providers/asg"
+	"github.com/quentin-m/etcd-cloud-operator/pkg/providers/asg/asgtest"
+)
+
+const testToken = "test-token"
+
+// fakeGCE serves both the metadata server, under /metadata, and the compute api, under /compute, for the instance
+// eco-a of the managed instance group eco in the project my-project.
+type fakeGCE struct {
+	createdBy string
+
+	// The managed instances and the instances of the group, served one per page.
+	managedInstances []managedInstance
+	instances        map[string]string
+
+	requests []string
+}
+
+func (f *fakeGCE) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+
+	if p := strings.TrimPrefix(r.URL.Path, "/metadata"); p != r.URL.Path {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			http.Error(w, "missing Metadata-Flavor header", http.StatusForbidden)
+			return
+		}
+		switch p {
+		case "/project/project-id":
+			fmt.Fprint(w, "my-project")
+		case "/instance/name":
+			fmt.Fprint(w, "eco-a")
+		case "/instance/attributes/created-by":
+			fmt.Fprint(w, f.createdBy)
+		case "/instance/service-accounts/default/token":
+			fmt.Fprintf(w, `{"access_token": %q, "expires_in": 3600, "token_type": "Bearer"}`, testToken)
+		default:
+			http.NotFound(w, r)
+		}
+		return
+	}
+
+	if r.Header.Get("Authorization") != "Bearer "+testToken {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"error": {"message": "invalid credentials"}}`)
+		return
+	}
+	page, _ := strconv.Atoi(r.URL.Query().Get("pageToken"))
+	nextPageToken := ""
+
+	location := strings.Join(strings.Split(f.createdBy, "/")[2:4], "/")
+	switch p := strings.TrimPrefix(r.URL.Path, "/compute"); p {
+	case "/projects/my-project/" + location + "/instanceGroupManagers/eco":
+		json.NewEncoder(w).Encode(instanceGroupManager{Name: "eco", TargetSize: 3})
+	case "/projects/my-project/" + location + "/instanceGroupManagers/eco/listManagedInstances":
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if page+1 < len(f.managedInstances) {
+			nextPageToken = strconv.Itoa(page + 1)
+		}
+		json.NewEncoder(w).Encode(managedInstanceList{ManagedInstances: f.managedInstances[page : page+1], NextPageToken: nextPageToken})
+	case "/projects/my-project/zones/europe-west1-b/instances", "/projects/my-project/aggregated/instances":
+		if filter := r.URL.Query().Get("filter"); filter != `status = "RUNNING"` {
+			http.Error(w, "unexpected filter "+filter, http.StatusBadRequest)
+			return
+		}
+		if page == 0 {
+			nextPageToken = "1"
+		}
+		var items []map[string]interface{}
+		for selfLink, ip := range f.instances {
+			// The zonal instances are served on the first page, the other ones on the second page.
+			if strings.Contains(selfLink, "/europe-west1-b/") != (page == 0) {
+				continue
+			}
+			items = append(items, map[string]interface{}{
+				"selfLink":          selfLink,
+				"name":              selfLink[strings.LastIndex(selfLink, "/")+1:],
+				"status":            "RUNNING",
+				"networkInterfaces": []map[string]string{{"networkIP": ip}},
+			})
+		}
+		if strings.Contains(p, "/aggregated/") {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"items": map[string]interface{}{
+					"zones/europe-west1-b": map[string]interface{}{"instances": items},
+					"zones/us-central1-a":  map[string]interface{}{"warning": map[string]string{"code": "NO_RESULTS_ON_PAGE"}},
+				},
+				"nextPageToken": nextPageToken,
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"items": items, "nextPageToken": nextPageToken})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newFakeGCE(t *testing.T, createdBy string) (*fakeGCE, *gce) {
+	f := &fakeGCE{createdBy: createdBy}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+
+	g := &gce{}
+	err := g.Configure(asg.Config{Params: map[string]interface{}{
+		"metadata-endpoint": server.URL + "/metadata",
+		"compute-endpoint":  server.URL + "/compute",
+	}})
+	if err != nil {
+		t.Fatalf("failed to configure provider: %v", err)
+	}
+	return f, g
+}
+
+func instanceURL(zone, name string) string {
+	return "https://www.googleapis.com/compute/v1/projects/my-project/zones/" + zone + "/instances/" + name
+}
+
+func TestConfigure(t *testing.T) {
+	for _, tc := range []struct {
+		createdBy, location string
+	}{
+		{createdBy: "projects/123456/zones/europe-west1-b/instanceGroupManagers/eco", location: "zones/europe-west1-b"},
+		{createdBy: "projects/123456/regions/europe-west1/instanceGroupManagers/eco", location: "regions/europe-west1"},
+	} {
+		_, g := newFakeGCE(t, tc.createdBy)
+		if g.config.Project != "my-project" || g.config.InstanceName != "eco-a" || g.config.InstanceGroup != "eco" {
+			t.Errorf("got project %q, instance %q and group %q, want my-project, eco-a and eco", g.config.Project, g.config.InstanceName, g.config.InstanceGroup)
+		}
+		if g.location != tc.location {
+			t.Errorf("got location %q for %q, want %q", g.location, tc.createdBy, tc.location)
+		}
+	}
+}
+
+func TestConfigureNotInGroup(t *testing.T) {
+	for _, createdBy := range []string{"", "projects/123456/zones/europe-west1-b/instanceGroups/eco", "projects/123456/global/instanceGroupManagers/eco"} {
+		server := httptest.NewServer(&fakeGCE{createdBy: createdBy})
+		defer server.Close()
+
+		g := &gce{}
+		err := g.Configure(asg.Config{Params: map[string]interface{}{"metadata-endpoint": server.URL + "/metadata"}})
+		if err == nil || !strings.Contains(err.Error(), "not running inside a gce managed instance group") {
+			t.Errorf("got error %v for %q, want not running inside a gce managed instance group", err, createdBy)
+		}
+	}
+}
+
+func TestAutoScalingGroupStatus(t *testing.T) {
+	for _, tc := range []struct {
+		name, createdBy string
+		// The zone of the instances eco-b and eco-c, eco-a being in europe-west1-b.
+		zone string
+	}{
+		{name: "zonal", createdBy: "projects/123456/zones/europe-west1-b/instanceGroupManagers/eco", zone: "europe-west1-b"},
+		{name: "regional", createdBy: "projects/123456/regions/europe-west1/instanceGroupManagers/eco", zone: "europe-west1-c"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f, g := newFakeGCE(t, tc.createdBy)
+			f.instances = map[string]string{
+				instanceURL("europe-west1-b", "eco-a"): "10.0.0.1",
+				instanceURL(tc.zone, "eco-b"):          "10.0.0.2",
+				instanceURL(tc.zone, "eco-c"):          "10.0.0.3",
+			}
+			f.managedInstances = []managedInstance{
+				{Instance: instanceURL("europe-west1-b", "eco-a"), InstanceStatus: "RUNNING", CurrentAction: "NONE"},
+				{Instance: instanceURL("europe-west1-b", "eco-d"), InstanceStatus: "STAGING", CurrentAction: "CREATING"},
+				{Instance: instanceURL(tc.zone, "eco-b"), InstanceStatus: "RUNNING", CurrentAction: "NONE"},
+				{Instance: instanceURL(tc.zone, "eco-c"), InstanceStatus: "RUNNING", CurrentAction: "ABANDONING"},
+				// Not running anymore, hence missing from the instances.
+				{Instance: instanceURL("europe-west1-b", "eco-e"), InstanceStatus: "RUNNING", CurrentAction: "DELETING"},
+			}
+			f.requests = nil
+
+			instances, self, size, err := g.AutoScalingGroupStatus()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got, want := asgtest.InstancesString(instances), "eco-a=10.0.0.1,eco-b=10.0.0.2"; got != want {
+				t.Errorf("got instances %s, want %s", got, want)
+			}
+			if self.Name() != "eco-a" || self.BindAddress() != "10.0.0.1" {
+				t.Errorf("got self %s bound to %s, want eco-a bound to 10.0.0.1", self.Name(), self.BindAddress())
+			}
+			if size != 3 {
+				t.Errorf("got size %d, want 3", size)
+			}
+			// The group, the pages of managed instances, and the pages of instances.
+			if len(f.requests) != 1+len(f.managedInstances)+2 {
+				t.Errorf("got requests %v, want one per page", f.requests)
+			}
+		})
+	}
+}
+
+func TestAutoScalingGroupStatusSelfNotRunning(t *testing.T) {
+	f, g := newFakeGCE(t, "projects/123456/zones/europe-west1-b/instanceGroupManagers/eco")
+	f.instances = map[string]string{instanceURL("europe-west1-b", "eco-b"): "10.0.0.2"}
+	f.managedInstances = []managedInstance{
+		{Instance: instanceURL("europe-west1-b", "eco-a"), InstanceStatus: "STOPPING", CurrentAction: "DELETING"},
+		{Instance: instanceURL("europe-west1-b", "eco-b"), InstanceStatus: "RUNNING", CurrentAction: "NONE"},
+	}
+
+	if _, _, _, err := g.AutoScalingGroupStatus(); err == nil || !strings.Contains(err.Error(), "is not a running instance") {
+		t.Errorf("got error %v, want the local instance not to be running", err)
+	}
+}
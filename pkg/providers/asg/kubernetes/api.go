@@ -0,0 +1,185 @@
+// Copyright 2017 Quentin Machu & eco authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubernetes
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const apiTimeout = 10 * time.Second
+
+// apiClient is a minimal client of the Kubernetes API, authenticated with a bearer token.
+type apiClient struct {
+	endpoint  string
+	tokenFile string
+	http      *http.Client
+}
+
+func newAPIClient(endpoint, tokenFile, caFile string) (*apiClient, error) {
+	tc := &tls.Config{}
+	if caFile != "" {
+		caPEM, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read kubernetes CA file: %v", err)
+		}
+		tc.RootCAs = x509.NewCertPool()
+		if !tc.RootCAs.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificate found in kubernetes CA file %q", caFile)
+		}
+	}
+
+	return &apiClient{
+		endpoint:  strings.TrimSuffix(endpoint, "/"),
+		tokenFile: tokenFile,
+		http:      &http.Client{Timeout: apiTimeout, Transport: &http.Transport{TLSClientConfig: tc}},
+	}, nil
+}
+
+// get queries the given path of the API, and decodes the response into v.
+func (c *apiClient) get(path string, query url.Values, v interface{}) error {
+	u := c.endpoint + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	// The token is read on every request, as projected service account tokens are rotated.
+	if c.tokenFile != "" {
+		token, err := ioutil.ReadFile(c.tokenFile)
+		if err != nil {
+			return fmt.Errorf("failed to read kubernetes token: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to query kubernetes api: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var status apiStatus
+		if json.NewDecoder(resp.Body).Decode(&status) == nil && status.Message != "" {
+			return fmt.Errorf("kubernetes api returned %d for %s: %s", resp.StatusCode, path, status.Message)
+		}
+		return fmt.Errorf("kubernetes api returned %d for %s", resp.StatusCode, path)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (c *apiClient) getPod(namespace, name string) (*pod, error) {
+	var p pod
+	if err := c.get(fmt.Sprintf("/api/v1/namespaces/%s/pods/%s", namespace, name), nil, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (c *apiClient) listPods(namespace, labelSelector string) ([]pod, error) {
+	var list podList
+	if err := c.get(fmt.Sprintf("/api/v1/namespaces/%s/pods", namespace), url.Values{"labelSelector": {labelSelector}}, &list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+func (c *apiClient) getStatefulSet(namespace, name string) (*statefulSet, error) {
+	var sts statefulSet
+	if err := c.get(fmt.Sprintf("/apis/apps/v1/namespaces/%s/statefulsets/%s", namespace, name), nil, &sts); err != nil {
+		return nil, err
+	}
+	return &sts, nil
+}
+
+// The subset of the Kubernetes objects used by the provider.
+
+type apiStatus struct {
+	Message string `json:"message"`
+}
+
+type objectMeta struct {
+	Name              string            `json:"name"`
+	Namespace         string            `json:"namespace"`
+	Labels            map[string]string `json:"labels"`
+	DeletionTimestamp *time.Time        `json:"deletionTimestamp"`
+	OwnerReferences   []struct {
+		Kind       string `json:"kind"`
+		Name       string `json:"name"`
+		Controller bool   `json:"controller"`
+	} `json:"ownerReferences"`
+}
+
+type pod struct {
+	Metadata objectMeta `json:"metadata"`
+	Spec     struct {
+		Hostname  string `json:"hostname"`
+		Subdomain string `json:"subdomain"`
+	} `json:"spec"`
+	Status struct {
+		Phase      string `json:"phase"`
+		PodIP      string `json:"podIP"`
+		Conditions []struct {
+			Type   string `json:"type"`
+			Status string `json:"status"`
+		} `json:"conditions"`
+	} `json:"status"`
+}
+
+func (p *pod) isReady() bool {
+	for _, c := range p.Status.Conditions {
+		if c.Type == "Ready" {
+			return c.Status == "True"
+		}
+	}
+	return false
+}
+
+// statefulSetName returns the name of the StatefulSet controlling the pod, if any.
+func (p *pod) statefulSetName() string {
+	for _, ref := range p.Metadata.OwnerReferences {
+		if ref.Kind == "StatefulSet" && ref.Controller {
+			return ref.Name
+		}
+	}
+	return ""
+}
+
+type podList struct {
+	Items []pod `json:"items"`
+}
+
+type statefulSet struct {
+	Metadata objectMeta `json:"metadata"`
+	Spec     struct {
+		Replicas    *int   `json:"replicas"`
+		ServiceName string `json:"serviceName"`
+		Selector    struct {
+			MatchLabels map[string]string `json:"matchLabels"`
+		} `json:"selector"`
+	} `json:"spec"`
+}
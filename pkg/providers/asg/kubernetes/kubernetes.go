@@ -0,0 +1,258 @@
+// Copyright 2017 Quentin Machu & eco authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package kubernetes implements an auto-scaling group provider that discovers the members from the pods found with
+// the Kubernetes API, and the size of the cluster from their StatefulSet.
+package kubernetes
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/quentin-m/etcd-cloud-operator/pkg/providers"
+	"github.com/quentin-m/etcd-cloud-operator/pkg/providers/asg"
+)
+
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+	addressPodIP = "pod-ip"
+	addressDNS   = "dns"
+)
+
+func init() {
+	asg.Register("kubernetes", &kubernetes{})
+}
+
+type kubernetes struct {
+	config config
+	client *apiClient
+}
+
+type config struct {
+	// Optional, the in-cluster API server and service account credentials are used otherwise.
+	APIServer string `yaml:"api-server"`
+	TokenFile string `yaml:"token-file"`
+	CAFile    string `yaml:"ca-file"`
+
+	// Optional, the namespace and name of the local pod, discovered from the service account and the environment
+	// (POD_NAMESPACE, POD_NAME, HOSTNAME) otherwise.
+	Namespace string `yaml:"namespace"`
+	PodName   string `yaml:"pod-name"`
+
+	// Optional, the StatefulSet giving the size of the cluster, defaults to the one controlling the local pod.
+	StatefulSet string `yaml:"statefulset"`
+	// Optional, the size of the cluster when the pods are not part of a StatefulSet.
+	Size int `yaml:"size"`
+
+	// Optional, the label selector of the pods, defaults to the selector of the StatefulSet.
+	LabelSelector string `yaml:"label-selector"`
+
+	// Address is how the members are addressed: by their pod IP ("pod-ip"), or by their stable DNS name ("dns"),
+	// <hostname>.<subdomain>.<namespace>.svc.<cluster-domain>, which requires a headless service. Defaults to "dns" if
+	// the StatefulSet has a service name, as the pod IPs change whenever the pods are re-created, and to "pod-ip"
+	// otherwise.
+	Address       string `yaml:"address"`
+	ClusterDomain string `yaml:"cluster-domain"`
+
+	// RequireReady keeps the pods that are not ready out of the members, the local one excepted. As the readiness of
+	// the pods usually depends on the operator itself, it must not be set if the readiness probe targets it.
+	RequireReady bool `yaml:"require-ready"`
+}
+
+type instance struct {
+	name, address, bindAddress string
+	ready                      bool
+}
+
+func (i *instance) Name() string {
+	return i.name
+}
+
+func (i *instance) Address() string {
+	return i.address
+}
+
+func (i *instance) BindAddress() string {
+	return i.bindAddress
+}
+
+func (k *kubernetes) Configure(providerConfig asg.Config) error {
+	k.config = config{ClusterDomain: "cluster.local"}
+	if err := providers.ParseParams(providerConfig.Params, &k.config); err != nil {
+		return fmt.Errorf("invalid configuration: %v", err)
+	}
+	if k.config.Address != "" && k.config.Address != addressPodIP && k.config.Address != addressDNS {
+		return fmt.Errorf("invalid configuration: address must be %q or %q", addressPodIP, addressDNS)
+	}
+
+	if k.config.APIServer == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return errors.New("application is not running on kubernetes, and no api-server is set")
+		}
+		k.config.APIServer = "https://" + net.JoinHostPort(host, port)
+		if k.config.TokenFile == "" {
+			k.config.TokenFile = serviceAccountDir + "/token"
+		}
+		if k.config.CAFile == "" {
+			k.config.CAFile = serviceAccountDir + "/ca.crt"
+		}
+	}
+
+	if k.config.Namespace == "" {
+		k.config.Namespace = os.Getenv("POD_NAMESPACE")
+	}
+	if k.config.Namespace == "" {
+		if ns, err := ioutil.ReadFile(serviceAccountDir + "/namespace"); err == nil {
+			k.config.Namespace = strings.TrimSpace(string(ns))
+		}
+	}
+	if k.config.PodName == "" {
+		k.config.PodName = os.Getenv("POD_NAME")
+	}
+	if k.config.PodName == "" {
+		k.config.PodName, _ = os.Hostname()
+	}
+	if k.config.Namespace == "" || k.config.PodName == "" {
+		return errors.New("invalid configuration: the namespace and name of the local pod could not be discovered")
+	}
+
+	client, err := newAPIClient(k.config.APIServer, k.config.TokenFile, k.config.CAFile)
+	if err != nil {
+		return err
+	}
+	k.client = client
+
+	// Fetch the local pod once to verify the API is reachable, and to find its StatefulSet.
+	self, err := k.client.getPod(k.config.Namespace, k.config.PodName)
+	if err != nil {
+		return fmt.Errorf("failed to get the local pod: %v", err)
+	}
+	if k.config.StatefulSet == "" {
+		k.config.StatefulSet = self.statefulSetName()
+	}
+	if k.config.StatefulSet == "" && k.config.Size <= 0 {
+		return errors.New("invalid configuration: the pods are not part of a StatefulSet, size must be set")
+	}
+
+	if k.config.StatefulSet == "" {
+		if k.config.LabelSelector == "" {
+			return errors.New("invalid configuration: the pods are not part of a StatefulSet, label-selector must be set")
+		}
+		if k.config.Address == "" {
+			k.config.Address = addressPodIP
+		}
+	} else {
+		sts, err := k.client.getStatefulSet(k.config.Namespace, k.config.StatefulSet)
+		if err != nil {
+			return fmt.Errorf("failed to get the statefulset: %v", err)
+		}
+		if k.config.LabelSelector == "" {
+			k.config.LabelSelector = labelSelector(sts.Spec.Selector.MatchLabels)
+			if k.config.LabelSelector == "" {
+				return errors.New("invalid configuration: the statefulset has no matchLabels selector, label-selector must be set")
+			}
+		}
+		if k.config.Address == "" {
+			k.config.Address = addressPodIP
+			if sts.Spec.ServiceName != "" {
+				k.config.Address = addressDNS
+			}
+		}
+	}
+
+	zap.S().Debugf("Running as pod %s/%s, with members selected by %q and addressed by %s", k.config.Namespace, k.config.PodName, k.config.LabelSelector, k.config.Address)
+	return nil
+}
+
+func (k *kubernetes) AutoScalingGroupStatus() ([]asg.Instance, asg.Instance, int, error) {
+	size, serviceName := k.config.Size, ""
+	if k.config.StatefulSet != "" {
+		sts, err := k.client.getStatefulSet(k.config.Namespace, k.config.StatefulSet)
+		if err != nil {
+			return nil, nil, 0, fmt.Errorf("failed to get the statefulset: %v", err)
+		}
+		size, serviceName = 1, sts.Spec.ServiceName
+		if sts.Spec.Replicas != nil {
+			size = *sts.Spec.Replicas
+		}
+	}
+
+	pods, err := k.client.listPods(k.config.Namespace, k.config.LabelSelector)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("failed to list pods: %v", err)
+	}
+
+	var instances []asg.Instance
+	var self *instance
+	var instancesStr []string
+	for i := range pods {
+		p := &pods[i]
+		isSelf := p.Metadata.Name == k.config.PodName
+
+		// Pods that are not running yet can not be reached, and the ones being deleted remain members until they
+		// actually leave.
+		if p.Status.Phase != "Running" || p.Status.PodIP == "" {
+			continue
+		}
+		if k.config.RequireReady && !p.isReady() && !isSelf {
+			continue
+		}
+
+		inst := &instance{name: p.Metadata.Name, address: p.Status.PodIP, bindAddress: p.Status.PodIP, ready: p.isReady()}
+		if k.config.Address == addressDNS {
+			inst.address, inst.bindAddress = k.podDNSName(p, serviceName), "0.0.0.0"
+		}
+		if isSelf {
+			self = inst
+		}
+		instances = append(instances, inst)
+		instancesStr = append(instancesStr, fmt.Sprintf("%s (ready: %v)", inst.address, inst.ready))
+	}
+	if self == nil {
+		return nil, nil, 0, fmt.Errorf("the local pod %q is not running, or is not selected by %q", k.config.PodName, k.config.LabelSelector)
+	}
+
+	zap.S().Debugf("Discovered %d / %d replicas: %s", len(instances), size, strings.Join(instancesStr, ", "))
+	return instances, self, size, nil
+}
+
+// podDNSName returns the stable DNS name of the pod, given by the headless service it is a subdomain of.
+func (k *kubernetes) podDNSName(p *pod, serviceName string) string {
+	hostname, subdomain := p.Spec.Hostname, p.Spec.Subdomain
+	if hostname == "" {
+		hostname = p.Metadata.Name
+	}
+	if subdomain == "" {
+		subdomain = serviceName
+	}
+	return fmt.Sprintf("%s.%s.%s.svc.%s", hostname, subdomain, k.config.Namespace, k.config.ClusterDomain)
+}
+
+func labelSelector(labels map[string]string) string {
+	var selectors []string
+	for k, v := range labels {
+		selectors = append(selectors, k+"="+v)
+	}
+	sort.Strings(selectors)
+	return strings.Join(selectors, ",")
+}
@@ -0,0 +1,313 @@
+// Copyright 2017 Quentin Machu & eco authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubernetes
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/quentin-m/etcd-cloud-operator/pkg/providers/asg"
+	"github.com/quentin-m/etcd-cloud-operator/pkg/providers/asg/asgtest"
+)
+
+const testToken = "secret-token"
+
+// fakeAPI serves the subset of the Kubernetes API used by the provider, for the pods of the "etcd" namespace.
+type fakeAPI struct {
+	mu sync.Mutex
+
+	// Pods, as JSON objects, by name.
+	pods     map[string]string
+	podNames []string
+
+	// The StatefulSet "eco", as a JSON object, if any.
+	statefulSet string
+}
+
+func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer "+testToken {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"message": "unauthorized"}`)
+		return
+	}
+
+	switch path := r.URL.Path; {
+	case path == "/api/v1/namespaces/etcd/pods":
+		var items []string
+		if r.URL.Query().Get("labelSelector") == "app=eco,tier=db" {
+			for _, name := range f.podNames {
+				items = append(items, f.pods[name])
+			}
+		}
+		fmt.Fprintf(w, `{"items": [%s]}`, strings.Join(items, ","))
+	case strings.HasPrefix(path, "/api/v1/namespaces/etcd/pods/"):
+		if p, ok := f.pods[strings.TrimPrefix(path, "/api/v1/namespaces/etcd/pods/")]; ok {
+			fmt.Fprint(w, p)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"message": "pod not found"}`)
+	case path == "/apis/apps/v1/namespaces/etcd/statefulsets/eco" && f.statefulSet != "":
+		fmt.Fprint(w, f.statefulSet)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"message": "not found"}`)
+	}
+}
+
+func (f *fakeAPI) addPod(name, phase, ip string, ready, deleting, inStatefulSet bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var deletionTimestamp, ownerReferences string
+	if deleting {
+		deletionTimestamp = `"deletionTimestamp": "2017-01-01T00:00:00Z",`
+	}
+	if inStatefulSet {
+		ownerReferences = `"ownerReferences": [{"kind": "StatefulSet", "name": "eco", "controller": true}],`
+	}
+	readyStatus := "False"
+	if ready {
+		readyStatus = "True"
+	}
+
+	if f.pods == nil {
+		f.pods = make(map[string]string)
+	}
+	f.pods[name] = fmt.Sprintf(`{
+		"metadata": {"name": %q, "namespace": "etcd", %s %s "labels": {"app": "eco"}},
+		"spec": {"hostname": %q},
+		"status": {"phase": %q, "podIP": %q, "conditions": [{"type": "Ready", "status": %q}]}
+	}`, name, deletionTimestamp, ownerReferences, name, phase, ip, readyStatus)
+	f.podNames = append(f.podNames, name)
+}
+
+func (f *fakeAPI) setReplicas(replicas int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.statefulSet = fmt.Sprintf(`{
+		"metadata": {"name": "eco", "namespace": "etcd"},
+		"spec": {"replicas": %d, "serviceName": "eco", "selector": {"matchLabels": {"tier": "db", "app": "eco"}}}
+	}`, replicas)
+}
+
+// newFakeAPI returns a fake API serving a StatefulSet of 3 replicas, whose pods are: ready, not ready, pending and being
+// deleted.
+func newFakeAPI() *fakeAPI {
+	f := &fakeAPI{}
+	f.setReplicas(3)
+	f.addPod("eco-0", "Running", "10.0.0.1", true, false, true)
+	f.addPod("eco-1", "Running", "10.0.0.2", false, false, true)
+	f.addPod("eco-2", "Pending", "", false, false, true)
+	f.addPod("eco-3", "Running", "10.0.0.4", true, true, true)
+	return f
+}
+
+func newTestProvider(t *testing.T, fake *fakeAPI, params map[string]interface{}) (*kubernetes, error) {
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(tokenFile, []byte(testToken+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	p := map[string]interface{}{"api-server": server.URL, "token-file": tokenFile, "namespace": "etcd"}
+	for k, v := range params {
+		p[k] = v
+	}
+
+	k := &kubernetes{}
+	return k, k.Configure(asg.Config{Params: p})
+}
+
+func TestAutoScalingGroupStatus(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		params map[string]interface{}
+
+		instances, self, selfBindAddress string
+	}{
+		{
+			name:      "dns addressing by default",
+			params:    map[string]interface{}{"pod-name": "eco-0"},
+			instances: "eco-0=eco-0.eco.etcd.svc.cluster.local,eco-1=eco-1.eco.etcd.svc.cluster.local,eco-3=eco-3.eco.etcd.svc.cluster.local",
+			self:      "eco-0", selfBindAddress: "0.0.0.0",
+		},
+		{
+			name:      "pod ip addressing",
+			params:    map[string]interface{}{"pod-name": "eco-0", "address": "pod-ip"},
+			instances: "eco-0=10.0.0.1,eco-1=10.0.0.2,eco-3=10.0.0.4",
+			self:      "eco-0", selfBindAddress: "10.0.0.1",
+		},
+		{
+			name:      "custom cluster domain",
+			params:    map[string]interface{}{"pod-name": "eco-0", "cluster-domain": "example.org"},
+			instances: "eco-0=eco-0.eco.etcd.svc.example.org,eco-1=eco-1.eco.etcd.svc.example.org,eco-3=eco-3.eco.etcd.svc.example.org",
+			self:      "eco-0", selfBindAddress: "0.0.0.0",
+		},
+		{
+			name:      "require ready",
+			params:    map[string]interface{}{"pod-name": "eco-0", "address": "pod-ip", "require-ready": true},
+			instances: "eco-0=10.0.0.1,eco-3=10.0.0.4",
+			self:      "eco-0", selfBindAddress: "10.0.0.1",
+		},
+		{
+			name:      "require ready keeps self",
+			params:    map[string]interface{}{"pod-name": "eco-1", "address": "pod-ip", "require-ready": true},
+			instances: "eco-0=10.0.0.1,eco-1=10.0.0.2,eco-3=10.0.0.4",
+			self:      "eco-1", selfBindAddress: "10.0.0.2",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			k, err := newTestProvider(t, newFakeAPI(), tc.params)
+			if err != nil {
+				t.Fatalf("failed to configure provider: %v", err)
+			}
+
+			instances, self, size, err := k.AutoScalingGroupStatus()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := asgtest.InstancesString(instances); got != tc.instances {
+				t.Errorf("got instances %s, want %s", got, tc.instances)
+			}
+			if self.Name() != tc.self || self.BindAddress() != tc.selfBindAddress {
+				t.Errorf("got self %s bound to %s, want %s bound to %s", self.Name(), self.BindAddress(), tc.self, tc.selfBindAddress)
+			}
+			if size != 3 {
+				t.Errorf("got size %d, want 3", size)
+			}
+		})
+	}
+}
+
+func TestAutoScalingGroupStatusScaling(t *testing.T) {
+	fake := newFakeAPI()
+	k, err := newTestProvider(t, fake, map[string]interface{}{"pod-name": "eco-0"})
+	if err != nil {
+		t.Fatalf("failed to configure provider: %v", err)
+	}
+
+	// The size follows the StatefulSet's replicas, without re-configuring the provider.
+	fake.setReplicas(5)
+	fake.addPod("eco-4", "Running", "10.0.0.5", true, false, true)
+	instances, _, size, err := k.AutoScalingGroupStatus()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if size != 5 {
+		t.Errorf("got size %d, want 5", size)
+	}
+	if len(instances) != 4 {
+		t.Errorf("got instances %s, want 4 of them", asgtest.InstancesString(instances))
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	fake := newFakeAPI()
+	fake.addPod("standalone", "Running", "10.0.1.1", true, false, false)
+
+	for _, tc := range []struct {
+		name   string
+		params map[string]interface{}
+
+		err, address, labelSelector string
+		size                        int
+	}{
+		{
+			name:          "statefulset",
+			params:        map[string]interface{}{"pod-name": "eco-0"},
+			address:       addressDNS,
+			labelSelector: "app=eco,tier=db",
+			size:          3,
+		},
+		{
+			name:          "without statefulset",
+			params:        map[string]interface{}{"pod-name": "standalone", "size": 3, "label-selector": "app=eco,tier=db"},
+			address:       addressPodIP,
+			labelSelector: "app=eco,tier=db",
+			size:          3,
+		},
+		{
+			name:   "without statefulset nor size",
+			params: map[string]interface{}{"pod-name": "standalone", "label-selector": "app=eco,tier=db"},
+			err:    "size must be set",
+		},
+		{
+			name:   "without statefulset nor label selector",
+			params: map[string]interface{}{"pod-name": "standalone", "size": 3},
+			err:    "label-selector must be set",
+		},
+		{
+			name:   "invalid address",
+			params: map[string]interface{}{"pod-name": "eco-0", "address": "hostname"},
+			err:    "address must be",
+		},
+		{
+			name:   "unknown pod",
+			params: map[string]interface{}{"pod-name": "unknown"},
+			err:    "pod not found",
+		},
+		{
+			name:   "invalid token",
+			params: map[string]interface{}{"pod-name": "eco-0", "token-file": "/dev/null"},
+			err:    "unauthorized",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			k, err := newTestProvider(t, fake, tc.params)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("got error %v, want %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to configure provider: %v", err)
+			}
+			if k.config.Address != tc.address || k.config.LabelSelector != tc.labelSelector {
+				t.Errorf("got address %q and label selector %q, want %q and %q", k.config.Address, k.config.LabelSelector, tc.address, tc.labelSelector)
+			}
+
+			_, self, size, err := k.AutoScalingGroupStatus()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if self.Name() != k.config.PodName || size != tc.size {
+				t.Errorf("got self %s and size %d, want %s and %d", self.Name(), size, k.config.PodName, tc.size)
+			}
+		})
+	}
+}
+
+func TestAutoScalingGroupStatusSelfNotRunning(t *testing.T) {
+	k, err := newTestProvider(t, newFakeAPI(), map[string]interface{}{"pod-name": "eco-2"})
+	if err != nil {
+		t.Fatalf("failed to configure provider: %v", err)
+	}
+	if _, _, _, err := k.AutoScalingGroupStatus(); err == nil {
+		t.Error("expected an error while the local pod is pending")
+	}
+}
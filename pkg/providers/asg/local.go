@@ -0,0 +1,121 @@
+// Copyright 2017 Quentin Machu & eco authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// Resolver resolves hostnames, such as net.DefaultResolver.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// interfaceAddrs lists the addresses of the local network interfaces.
+var interfaceAddrs = net.InterfaceAddrs
+
+// FindLocalInstance returns the instance running locally, for the providers listing members that do not know which one
+// they are: the instance whose name or address matches the hostname, or else whose address resolves to one of the local
+// IP addresses. Several instances matching the hostname, or running locally, can not be told apart, which is an error.
+func FindLocalInstance(ctx context.Context, resolver Resolver, instances []Instance) (Instance, error) {
+	if hostname, err := os.Hostname(); err == nil {
+		var matches []Instance
+		for _, i := range instances {
+			if matchesHostname(i.Name(), hostname) || matchesHostname(i.Address(), hostname) {
+				matches = append(matches, i)
+			}
+		}
+		// Members sharing an address, on different ports, all match the hostname.
+		if len(matches) > 1 {
+			return nil, fmt.Errorf("members %q and %q both run locally, set self to pick one", matches[0].Name(), matches[1].Name())
+		}
+		if len(matches) == 1 {
+			return matches[0], nil
+		}
+	}
+
+	localIPs, err := localIPs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the local addresses: %v", err)
+	}
+
+	var found Instance
+	for _, i := range instances {
+		for _, ip := range resolve(ctx, resolver, i.Address()) {
+			if !localIPs[ip.String()] {
+				continue
+			}
+			// Several members sharing the host can only be told apart with the explicit override.
+			if found != nil && found != i {
+				return nil, fmt.Errorf("members %q and %q both run locally, set self to pick one", found.Name(), i.Name())
+			}
+			found = i
+		}
+	}
+	if found == nil {
+		return nil, errors.New("none of the members matches the hostname or a local address, set self to pick one")
+	}
+	return found, nil
+}
+
+// matchesHostname returns whether the given name or address is the hostname, or a domain name of the same host.
+func matchesHostname(value, hostname string) bool {
+	if value == hostname {
+		return true
+	}
+	if net.ParseIP(strings.Trim(value, "[]")) != nil {
+		return false
+	}
+	return strings.SplitN(value, ".", 2)[0] == strings.SplitN(hostname, ".", 2)[0]
+}
+
+func localIPs() (map[string]bool, error) {
+	addrs, err := interfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+
+	ips := make(map[string]bool)
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			ips[ipNet.IP.String()] = true
+		}
+	}
+	return ips, nil
+}
+
+// resolve returns the IP addresses of the given address, which is either an IP address or a hostname.
+func resolve(ctx context.Context, resolver Resolver, address string) []net.IP {
+	if ip := net.ParseIP(strings.Trim(address, "[]")); ip != nil {
+		return []net.IP{ip}
+	}
+	addrs, err := resolver.LookupIPAddr(ctx, address)
+	if err != nil {
+		zap.S().With(zap.Error(err)).Debugf("failed to resolve %q", address)
+		return nil
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ips
+}
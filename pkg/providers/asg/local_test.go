@@ -0,0 +1,131 @@
+// Copyright 2017 Quentin Machu & eco authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asg
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+type testInstance struct {
+	name, address string
+}
+
+func (i *testInstance) Name() string        { return i.name }
+func (i *testInstance) Address() string     { return i.address }
+func (i *testInstance) BindAddress() string { return i.address }
+
+type fakeResolver map[string][]string
+
+func (r fakeResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	ips, ok := r[host]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	var addrs []net.IPAddr
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return addrs, nil
+}
+
+func TestFindLocalInstance(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatalf("failed to get hostname: %v", err)
+	}
+	shortHostname := strings.SplitN(hostname, ".", 2)[0]
+
+	defer func(f func() ([]net.Addr, error)) { interfaceAddrs = f }(interfaceAddrs)
+	interfaceAddrs = func() ([]net.Addr, error) {
+		return []net.Addr{
+			&net.IPNet{IP: net.ParseIP("127.0.0.1"), Mask: net.CIDRMask(8, 32)},
+			&net.IPNet{IP: net.ParseIP("10.0.0.2"), Mask: net.CIDRMask(24, 32)},
+			&net.IPNet{IP: net.ParseIP("fd00::2"), Mask: net.CIDRMask(64, 128)},
+		}, nil
+	}
+	resolver := fakeResolver{
+		"etcd-1.example.com": {"10.0.0.1"},
+		"etcd-2.example.com": {"fd00::2", "10.0.0.2"},
+		"etcd-3.example.com": {"10.0.0.3"},
+	}
+
+	for _, tc := range []struct {
+		name      string
+		instances []Instance
+		want, err string
+	}{
+		{
+			name:      "hostname as name",
+			instances: []Instance{&testInstance{"a", "10.0.0.1"}, &testInstance{hostname, "10.0.0.9"}},
+			want:      hostname,
+		},
+		{
+			name:      "hostname as domain name",
+			instances: []Instance{&testInstance{"a", "10.0.0.1"}, &testInstance{"b", shortHostname + ".example.com"}},
+			want:      "b",
+		},
+		{
+			name:      "hostname shared by members on different ports",
+			instances: []Instance{&testInstance{"a", shortHostname + ".example.com"}, &testInstance{"b", shortHostname + ".example.com"}},
+			err:       "set self to pick one",
+		},
+		{
+			name:      "local IP",
+			instances: []Instance{&testInstance{"a", "10.0.0.1"}, &testInstance{"b", "10.0.0.2"}},
+			want:      "b",
+		},
+		{
+			name:      "local IPv6",
+			instances: []Instance{&testInstance{"a", "[fd00::1]"}, &testInstance{"b", "[fd00::2]"}},
+			want:      "b",
+		},
+		{
+			name:      "resolved to local IPs",
+			instances: []Instance{&testInstance{"a", "etcd-1.example.com"}, &testInstance{"b", "etcd-2.example.com"}, &testInstance{"c", "unknown.example.com"}},
+			want:      "b",
+		},
+		{
+			name:      "ambiguous",
+			instances: []Instance{&testInstance{"a", "10.0.0.2"}, &testInstance{"b", "etcd-2.example.com"}},
+			err:       "set self to pick one",
+		},
+		{
+			name:      "none",
+			instances: []Instance{&testInstance{"a", "etcd-1.example.com"}, &testInstance{"b", "etcd-3.example.com"}},
+			err:       "none of the members",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := FindLocalInstance(context.Background(), resolver, tc.instances)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("got %v, %v, want error %q", got, err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got.Name() != tc.want {
+				t.Errorf("got %s, want %s", got.Name(), tc.want)
+			}
+		})
+	}
+}
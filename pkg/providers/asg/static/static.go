@@ -0,0 +1,160 @@
+// Copyright 2017 Quentin Machu & eco authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package static implements an auto-scaling group provider for a fixed list of members, such as bare-metal hosts.
+package static
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/quentin-m/etcd-cloud-operator/pkg/providers"
+	"github.com/quentin-m/etcd-cloud-operator/pkg/providers/asg"
+)
+
+func init() {
+	asg.Register("static", &static{})
+}
+
+type static struct {
+	config config
+
+	instances []asg.Instance
+	self      *instance
+}
+
+type config struct {
+	Members []member `yaml:"members"`
+
+	// Optional, the name of the local member. Otherwise, it is the member whose name or address matches the hostname,
+	// or whose address is one of the local IP addresses.
+	Self string `yaml:"self"`
+
+	// Optional, the number of members of the cluster. Defaults to the number of listed members.
+	Size int `yaml:"size"`
+}
+
+type member struct {
+	Name    string `yaml:"name"`
+	Address string `yaml:"address"`
+
+	// Optional, the address to listen on. Defaults to the address if it is an IP address, or to all the addresses
+	// otherwise.
+	BindAddress string `yaml:"bind-address"`
+
+	// Optional, overrides the cluster's ports, e.g. when several members share a host.
+	Ports asg.Ports `yaml:"ports"`
+}
+
+type instance struct {
+	name, address, bindAddress string
+	ports                      asg.Ports
+}
+
+func (i *instance) Name() string {
+	return i.name
+}
+
+func (i *instance) Address() string {
+	return i.address
+}
+
+func (i *instance) BindAddress() string {
+	return i.bindAddress
+}
+
+func (i *instance) Ports() asg.Ports {
+	return i.ports
+}
+
+func (s *static) Configure(providerConfig asg.Config) error {
+	s.config = config{}
+	if err := providers.ParseParams(providerConfig.Params, &s.config); err != nil {
+		return fmt.Errorf("invalid configuration: %v", err)
+	}
+	if len(s.config.Members) == 0 {
+		return errors.New("invalid configuration: no member given")
+	}
+	if s.config.Size < 0 {
+		return errors.New("invalid configuration: size can not be negative")
+	}
+	if s.config.Size > len(s.config.Members) {
+		return fmt.Errorf("invalid configuration: size %d exceeds the number of members", s.config.Size)
+	}
+	if s.config.Size == 0 {
+		s.config.Size = len(s.config.Members)
+	}
+
+	s.instances, s.self = nil, nil
+	names := make(map[string]struct{})
+	for _, m := range s.config.Members {
+		if m.Name == "" || m.Address == "" {
+			return errors.New("invalid configuration: members must have a name and an address")
+		}
+		if _, ok := names[m.Name]; ok {
+			return fmt.Errorf("invalid configuration: duplicated member name %q", m.Name)
+		}
+		names[m.Name] = struct{}{}
+
+		bindAddress := m.BindAddress
+		if bindAddress == "" {
+			bindAddress = m.Address
+			if net.ParseIP(strings.Trim(m.Address, "[]")) == nil {
+				// etcd can only listen on IP addresses.
+				bindAddress = "0.0.0.0"
+			}
+		}
+		s.instances = append(s.instances, &instance{name: m.Name, address: m.Address, bindAddress: bindAddress, ports: m.Ports})
+	}
+
+	self, err := s.findSelf()
+	if err != nil {
+		return err
+	}
+	s.self = self
+
+	zap.S().Debugf("Running as %s (%s) within a static cluster of %d members", s.self.name, s.self.address, s.config.Size)
+	return nil
+}
+
+// findSelf determines the local member, from the explicit override, the hostname, or the local IP addresses.
+func (s *static) findSelf() (*instance, error) {
+	if s.config.Self != "" {
+		for _, i := range s.instances {
+			if i.Name() == s.config.Self {
+				return i.(*instance), nil
+			}
+		}
+		return nil, fmt.Errorf("self %q is not one of the members", s.config.Self)
+	}
+
+	self, err := asg.FindLocalInstance(context.Background(), net.DefaultResolver, s.instances)
+	if err != nil {
+		return nil, err
+	}
+	return self.(*instance), nil
+}
+
+func (s *static) AutoScalingGroupStatus() ([]asg.Instance, asg.Instance, int, error) {
+	return s.instances, s.self, s.config.Size, nil
+}
+
+func (s *static) SelfPorts() asg.Ports {
+	return s.self.ports
+}
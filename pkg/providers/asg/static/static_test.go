@@ -0,0 +1,161 @@
+// Copyright 2017 Quentin Machu & eco authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package static
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/quentin-m/etcd-cloud-operator/pkg/providers/asg"
+)
+
+func TestConfigure(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatalf("failed to get hostname: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		config string
+
+		// Expected outcome: either an error containing err, or the local member, its bind address and the size.
+		err         string
+		self        string
+		bindAddress string
+		size        int
+	}{
+		{
+			name:   "override",
+			config: "{self: b, members: [{name: a, address: 198.51.100.1}, {name: b, address: 198.51.100.2}]}",
+			self:   "b", bindAddress: "198.51.100.2", size: 2,
+		},
+		{
+			name:   "hostname",
+			config: fmt.Sprintf("{size: 1, members: [{name: a, address: 198.51.100.1}, {name: %q, address: 198.51.100.2}]}", hostname),
+			self:   hostname, bindAddress: "198.51.100.2", size: 1,
+		},
+		{
+			name:   "local IP",
+			config: "{members: [{name: a, address: 198.51.100.1}, {name: b, address: 127.0.0.1}, {name: c, address: 198.51.100.3}]}",
+			self:   "b", bindAddress: "127.0.0.1", size: 3,
+		},
+		{
+			name:   "hostname address",
+			config: "{members: [{name: a, address: localhost}, {name: b, address: 198.51.100.2}]}",
+			self:   "a", bindAddress: "0.0.0.0", size: 2,
+		},
+		{
+			name:   "explicit bind address",
+			config: "{self: a, members: [{name: a, address: 198.51.100.1, bind-address: 0.0.0.0}]}",
+			self:   "a", bindAddress: "0.0.0.0", size: 1,
+		},
+		{
+			name:   "ambiguous",
+			config: "{members: [{name: a, address: 127.0.0.1, ports: {client: 2379}}, {name: b, address: 127.0.0.1, ports: {client: 3379}}]}",
+			err:    "set self to pick one",
+		},
+		{
+			name:   "no local member",
+			config: "{members: [{name: a, address: 198.51.100.1}]}",
+			err:    "none of the members matches",
+		},
+		{
+			name:   "unknown override",
+			config: "{self: c, members: [{name: a, address: 198.51.100.1}]}",
+			err:    `self "c" is not one of the members`,
+		},
+		{
+			name:   "no member",
+			config: "{self: a}",
+			err:    "no member given",
+		},
+		{
+			name:   "negative size",
+			config: "{self: a, size: -1, members: [{name: a, address: 198.51.100.1}]}",
+			err:    "size can not be negative",
+		},
+		{
+			name:   "size exceeding the members",
+			config: "{self: a, size: 3, members: [{name: a, address: 198.51.100.1}, {name: b, address: 198.51.100.2}]}",
+			err:    "exceeds the number of members",
+		},
+		{
+			name:   "duplicated name",
+			config: "{self: a, members: [{name: a, address: 198.51.100.1}, {name: a, address: 198.51.100.2}]}",
+			err:    `duplicated member name "a"`,
+		},
+		{
+			name:   "missing address",
+			config: "{self: a, members: [{name: a}]}",
+			err:    "members must have a name and an address",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var params map[string]interface{}
+			if err := yaml.Unmarshal([]byte(tc.config), &params); err != nil {
+				t.Fatalf("invalid test config: %v", err)
+			}
+
+			s := &static{}
+			err := s.Configure(asg.Config{Params: params})
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("got error %v, want %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			instances, self, size, err := s.AutoScalingGroupStatus()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if self.Name() != tc.self || self.BindAddress() != tc.bindAddress {
+				t.Errorf("got self %s bound to %s, want %s bound to %s", self.Name(), self.BindAddress(), tc.self, tc.bindAddress)
+			}
+			if size != tc.size {
+				t.Errorf("got size %d, want %d", size, tc.size)
+			}
+			if len(instances) != len(s.config.Members) {
+				t.Errorf("got %d instances, want %d", len(instances), len(s.config.Members))
+			}
+		})
+	}
+}
+
+func TestSelfPorts(t *testing.T) {
+	s := &static{}
+	err := s.Configure(asg.Config{Params: map[string]interface{}{
+		"self": "b",
+		"members": []interface{}{
+			map[string]interface{}{"name": "a", "address": "127.0.0.1"},
+			map[string]interface{}{"name": "b", "address": "127.0.0.1", "ports": map[string]interface{}{"status": 3378}},
+		},
+	}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if got := s.SelfPorts().WithDefaults(asg.Ports{Client: 2379, Status: 2378}); got != (asg.Ports{Client: 2379, Status: 3378}) {
+		t.Errorf("got ports %+v, want the status port overridden", got)
+	}
+}
@@ -67,6 +67,17 @@ func (f *etcd) Info() (*snapshot.Metadata, error) {
 	return snapshot.NewMetadata(dbPath, status.Revision, status.TotalSize, f)
 }
 
+func (f *etcd) List() ([]*snapshot.Metadata, error) {
+	metadata, err := f.Info()
+	if err == snapshot.ErrNoSnapshot {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []*snapshot.Metadata{metadata}, nil
+}
+
 func (f *etcd) Get(metadata *snapshot.Metadata) (string, bool, error) {
 	in, err := os.Open(metadata.Name)
 	if err != nil {
@@ -92,6 +103,6 @@ func (f *etcd) Get(metadata *snapshot.Metadata) (string, bool, error) {
 	return dst.Name(), true, err
 }
 
-func (f *etcd) Purge(ttl time.Duration) error {
+func (f *etcd) Purge(ttl time.Duration) (int, error) {
 	panic("not implemented")
 }
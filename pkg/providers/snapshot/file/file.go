@@ -32,6 +32,8 @@ import (
 const (
 	filePermissions     = 0600
 	directoryPermission = 0700
+
+	secretsDir = "secrets"
 )
 
 func init() {
@@ -85,6 +87,17 @@ func (f *file) Save(r io.ReadCloser, metadata *snapshot.Metadata) error {
 }
 
 func (f *file) Info() (*snapshot.Metadata, error) {
+	metadatas, err := f.List()
+	if err != nil {
+		return nil, err
+	}
+	if len(metadatas) == 0 {
+		return nil, snapshot.ErrNoSnapshot
+	}
+	return metadatas[len(metadatas)-1], nil
+}
+
+func (f *file) List() ([]*snapshot.Metadata, error) {
 	files, err := ioutil.ReadDir(f.config.Dir)
 	if err != nil {
 		return nil, fmt.Errorf("failed to list dir: %s", err)
@@ -103,29 +116,74 @@ func (f *file) Info() (*snapshot.Metadata, error) {
 		}
 		metadatas = append(metadatas, metadata)
 	}
-	if len(metadatas) == 0 {
-		return nil, snapshot.ErrNoSnapshot
-	}
 	sort.Sort(snapshot.MetadataSorter(metadatas))
 
-	return metadatas[len(metadatas)-1], nil
+	return metadatas, nil
 }
 
 func (f *file) Get(metadata *snapshot.Metadata) (string, bool, error) {
 	return filepath.Join(f.config.Dir, metadata.Name), false, nil
 }
 
-func (f *file) Purge(ttl time.Duration) error {
+func (f *file) Purge(ttl time.Duration) (int, error) {
 	files, err := ioutil.ReadDir(f.config.Dir)
 	if err != nil {
-		return fmt.Errorf("failed to list dir: %s", err)
+		return 0, fmt.Errorf("failed to list dir: %s", err)
 	}
 
+	var purged int
 	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
 		if time.Since(file.ModTime()) > ttl {
 			zap.S().Infof("purging snapshot file %q because it is that older than %v", file.Name(), ttl)
-			os.Remove(filepath.Join(f.config.Dir, file.Name()))
+			if err := os.Remove(filepath.Join(f.config.Dir, file.Name())); err != nil {
+				zap.S().With(zap.Error(err)).Warn("failed to remove snapshot file")
+				continue
+			}
+			purged++
 		}
 	}
+	return purged, nil
+}
+
+func (f *file) GetSecret(name string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filepath.Join(f.config.Dir, secretsDir, name))
+	if os.IsNotExist(err) {
+		return nil, snapshot.ErrNoSecret
+	}
+	return data, err
+}
+
+func (f *file) PutSecret(name string, data []byte) error {
+	dir := filepath.Join(f.config.Dir, secretsDir)
+	if err := os.MkdirAll(dir, directoryPermission); err != nil {
+		return err
+	}
+
+	tmpF, err := ioutil.TempFile(dir, name)
+	if err != nil {
+		return err
+	}
+	if _, err := tmpF.Write(data); err != nil {
+		tmpF.Close()
+		os.Remove(tmpF.Name())
+		return err
+	}
+	if err := tmpF.Sync(); err != nil {
+		tmpF.Close()
+		os.Remove(tmpF.Name())
+		return err
+	}
+	if err := tmpF.Close(); err != nil {
+		os.Remove(tmpF.Name())
+		return err
+	}
+
+	if err := os.Rename(tmpF.Name(), filepath.Join(dir, name)); err != nil {
+		os.Remove(tmpF.Name())
+		return err
+	}
 	return nil
 }
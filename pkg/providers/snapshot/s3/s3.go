@@ -15,15 +15,18 @@
 package s3
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
 	"github.com/aws/aws-sdk-go/aws/session"
 	ss3 "github.com/aws/aws-sdk-go/service/s3"
@@ -34,6 +37,9 @@ import (
 	"github.com/quentin-m/etcd-cloud-operator/pkg/providers/snapshot"
 )
 
+// secretsPrefix is the prefix of the keys under which secrets are stored, and that are not snapshots.
+const secretsPrefix = "secrets/"
+
 func init() {
 	snapshot.Register("s3", &s3{})
 }
@@ -137,6 +143,17 @@ func (s *s3) Get(metadata *snapshot.Metadata) (string, bool, error) {
 }
 
 func (s *s3) Info() (*snapshot.Metadata, error) {
+	metadatas, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+	if len(metadatas) == 0 {
+		return nil, snapshot.ErrNoSnapshot
+	}
+	return metadatas[len(metadatas)-1], nil
+}
+
+func (s *s3) List() ([]*snapshot.Metadata, error) {
 	sess, err := session.NewSession(aws.NewConfig().WithRegion(s.region))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create aws session: %v", err)
@@ -150,6 +167,9 @@ func (s *s3) Info() (*snapshot.Metadata, error) {
 
 	var metadatas []*snapshot.Metadata
 	for _, obj := range resp.Contents {
+		if strings.HasPrefix(*obj.Key, secretsPrefix) {
+			continue
+		}
 		metadata, err := snapshot.NewMetadata(*obj.Key, -1, *obj.Size, s)
 		if err != nil {
 			zap.S().Warnf("failed to parse metadata for snapshot %v", *obj.Key)
@@ -157,27 +177,28 @@ func (s *s3) Info() (*snapshot.Metadata, error) {
 		}
 		metadatas = append(metadatas, metadata)
 	}
-	if len(metadatas) == 0 {
-		return nil, snapshot.ErrNoSnapshot
-	}
 	sort.Sort(snapshot.MetadataSorter(metadatas))
 
-	return metadatas[len(metadatas)-1], nil
+	return metadatas, nil
 }
 
-func (s *s3) Purge(ttl time.Duration) error {
+func (s *s3) Purge(ttl time.Duration) (int, error) {
 	sess, err := session.NewSession(aws.NewConfig().WithRegion(s.region))
 	if err != nil {
-		return fmt.Errorf("failed to create aws session: %v", err)
+		return 0, fmt.Errorf("failed to create aws session: %v", err)
 	}
 	s3s := ss3.New(sess)
 
 	resp, err := s3s.ListObjects(&ss3.ListObjectsInput{Bucket: aws.String(s.config.Bucket)})
 	if err != nil {
-		return fmt.Errorf("failed to list aws s3 objects: %v", err)
+		return 0, fmt.Errorf("failed to list aws s3 objects: %v", err)
 	}
 
+	var purged int
 	for _, item := range resp.Contents {
+		if strings.HasPrefix(*item.Key, secretsPrefix) {
+			continue
+		}
 		if time.Since(*item.LastModified) > ttl {
 			zap.S().Infof("purging snapshot file %q because it is that older than %v", *item.Key, ttl)
 
@@ -187,9 +208,50 @@ func (s *s3) Purge(ttl time.Duration) error {
 			})
 			if err != nil {
 				zap.S().With(zap.Error(err)).Warn("failed to remove aws s3 object")
+				continue
 			}
+			purged++
 		}
 	}
 
+	return purged, nil
+}
+
+func (s *s3) GetSecret(name string) ([]byte, error) {
+	sess, err := session.NewSession(aws.NewConfig().WithRegion(s.region))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create aws session: %v", err)
+	}
+
+	resp, err := ss3.New(sess).GetObject(&ss3.GetObjectInput{
+		Bucket: aws.String(s.config.Bucket),
+		Key:    aws.String(secretsPrefix + name),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == ss3.ErrCodeNoSuchKey {
+		return nil, snapshot.ErrNoSecret
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get aws s3 object: %v", err)
+	}
+	defer resp.Body.Close()
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (s *s3) PutSecret(name string, data []byte) error {
+	sess, err := session.NewSession(aws.NewConfig().WithRegion(s.region))
+	if err != nil {
+		return fmt.Errorf("failed to create aws session: %v", err)
+	}
+
+	_, err = ss3.New(sess).PutObject(&ss3.PutObjectInput{
+		Bucket:               aws.String(s.config.Bucket),
+		Key:                  aws.String(secretsPrefix + name),
+		Body:                 bytes.NewReader(data),
+		ServerSideEncryption: aws.String(ss3.ServerSideEncryptionAes256),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to put aws s3 object: %v", err)
+	}
 	return nil
 }
@@ -26,6 +26,7 @@ var (
 	providersM sync.RWMutex
 
 	ErrNoSnapshot = errors.New("no snapshot available")
+	ErrNoSecret   = errors.New("no such secret")
 )
 
 type Provider interface {
@@ -34,7 +35,20 @@ type Provider interface {
 	Save(io.ReadCloser, *Metadata) error
 	Get(*Metadata) (string, bool, error)
 	Info() (*Metadata, error)
-	Purge(time.Duration) error
+	// List returns the available snapshots, sorted by ascending revision.
+	List() ([]*Metadata, error)
+	// Purge removes the snapshots older than the given TTL, and returns the
+	// number of snapshots that were removed.
+	Purge(time.Duration) (int, error)
+}
+
+// SecretStore is implemented by the providers that can also keep small sensitive objects, such as the key of the
+// internal certificate authority, alongside the snapshots. Secrets are neither listed nor purged as snapshots.
+type SecretStore interface {
+	// GetSecret returns the secret stored under the given name, or ErrNoSecret.
+	GetSecret(name string) ([]byte, error)
+	// PutSecret stores the secret under the given name, replacing any existing one.
+	PutSecret(name string, data []byte) error
 }
 
 // Config represents the configuration of the snapshot provider.
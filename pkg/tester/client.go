@@ -43,7 +43,7 @@ func isHealthy(c *etcd.Client, clusterSize int) (uint64, error) {
 	var leaderChanged bool
 
 	c.ForEachMember(func(c *etcd.Client, m *etcdserverpb.Member) error {
-		cURL := etcd.URL2Address(m.PeerURLs[0])
+		cURL := etcd.MemberEndpoint(m.PeerURLs, m.ClientURLs)
 
 		resp, err := c.Status(ctx, etcd.ClientURL(cURL, c.SC.TLSEnabled()))
 		if err != nil {